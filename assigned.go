@@ -0,0 +1,262 @@
+package main
+
+// Definite assignment finds the reads of variables declared without an
+// initializer which may happen before an assignment on some path through
+// if, while, for, and and or.
+//
+// A function is analyzed on its own: reads in functions nested in the one
+// declaring the variable are not checked, since the closure may run at any
+// time, and variables assigned there are left out.
+
+// unassigned is the set of variables which may be unassigned at a point of
+// the program, dead when no path reaches the point.
+type unassigned struct {
+	vars map[*decl]bool
+	dead bool
+}
+
+func (u unassigned) copy() unassigned {
+	c := unassigned{make(map[*decl]bool, len(u.vars)), u.dead}
+	for d := range u.vars {
+		c.vars[d] = true
+	}
+	return c
+}
+
+// deadEnd returns the set after a jump.
+func deadEnd() unassigned {
+	return unassigned{vars: make(map[*decl]bool), dead: true}
+}
+
+// join returns the set at a point reached from both u and v.
+func (u unassigned) join(v unassigned) unassigned {
+	switch {
+	case u.dead:
+		return v.copy()
+	case v.dead:
+		return u.copy()
+	}
+	j := u.copy()
+	for d := range v.vars {
+		j.vars[d] = true
+	}
+	return j
+}
+
+type assignFlow struct {
+	res     *resolution
+	decls   map[*tokenObj]*decl // by the names declared
+	checked map[*decl]bool      // variables declared without an initializer
+	state   unassigned
+	loops   []*[]unassigned // states at the breaks of the enclosing loops
+	conts   []*[]unassigned // states at the continues
+	reads   []*tokenObj
+}
+
+// uninitReads returns the reads of variables which may not be assigned yet.
+func uninitReads(stmts []Stmt, res *resolution) []*tokenObj {
+	a := &assignFlow{res: res, decls: make(map[*tokenObj]*decl), checked: make(map[*decl]bool)}
+	for _, d := range res.decls {
+		a.decls[d.name] = d
+	}
+	// the function of every declaration and assignment
+	declFn := make(map[*decl]interface{})
+	assignFns := make(map[*decl][]interface{})
+	var walk func(fn interface{}, list []Stmt)
+	walk = func(fn interface{}, list []Stmt) {
+		inspectList(list, func(n interface{}) bool {
+			switch n := n.(type) {
+			case *VarStmt:
+				if d := a.decls[n.name]; d != nil && n.init == nil {
+					declFn[d] = fn
+				}
+			case *AssignExpr:
+				if d := res.refs[n.name]; d != nil {
+					assignFns[d] = append(assignFns[d], fn)
+				}
+			case *FunStmt:
+				walk(n, n.body)
+				return false
+			case *FunExpr:
+				walk(n, n.body)
+				return false
+			}
+			return true
+		})
+	}
+	walk(nil, stmts)
+	for d, fn := range declFn {
+		if d.global && len(res.globals[d.name.lexeme]) > 1 {
+			continue
+		}
+		local := true
+		for _, f := range assignFns[d] {
+			local = local && f == fn
+		}
+		if local {
+			a.checked[d] = true
+		}
+	}
+	if len(a.checked) == 0 {
+		return nil
+	}
+	a.function(stmts)
+	return a.reads
+}
+
+// uninitWarnings returns the warnings for the reads of uninitReads, they
+// are reported by glox check.
+func uninitWarnings(stmts []Stmt) []*Diagnostic {
+	res, errs := resolve(stmts)
+	if len(errs) > 0 {
+		return nil
+	}
+	var list []*Diagnostic
+	for _, t := range uninitReads(stmts, res) {
+		d := errorAtToken(phaseResolve, codeUninitRead, t, t.lexeme+" may be read before it is assigned")
+		d.Severity = severityWarning
+		list = append(list, d)
+	}
+	return list
+}
+
+// function analyzes the body of a function or the top level of the script.
+func (a *assignFlow) function(body []Stmt) {
+	saved, loops, conts := a.state, a.loops, a.conts
+	a.state, a.loops, a.conts = unassigned{vars: make(map[*decl]bool)}, nil, nil
+	a.stmts(body)
+	a.state, a.loops, a.conts = saved, loops, conts
+}
+
+func (a *assignFlow) stmts(list []Stmt) {
+	for _, s := range list {
+		a.stmt(s)
+	}
+}
+
+func (a *assignFlow) stmt(s Stmt) {
+	switch s := s.(type) {
+	case *BlockStmt:
+		a.stmts(s.list)
+	case *BreakStmt:
+		if n := len(a.loops); n > 0 {
+			*a.loops[n-1] = append(*a.loops[n-1], a.state)
+		}
+		a.state = deadEnd()
+	case *ContinueStmt:
+		if n := len(a.conts); n > 0 {
+			*a.conts[n-1] = append(*a.conts[n-1], a.state)
+		}
+		a.state = deadEnd()
+	case *ExprStmt:
+		a.expr(s.expression)
+	case *ForStmt:
+		if s.init != nil {
+			a.stmt(s.init)
+		}
+		a.loop(s.condition, s.body, s.increment)
+	case *FunStmt:
+		a.function(s.body)
+	case *IfStmt:
+		a.expr(s.condition)
+		before := a.state.copy()
+		a.stmt(s.block1)
+		after := a.state
+		a.state = before
+		if s.block2 != nil {
+			a.stmt(s.block2)
+		}
+		// a constant condition takes a single branch
+		switch constCond(s.condition) {
+		case false:
+			after = a.state
+		case nil:
+			after = after.join(a.state)
+		}
+		a.state = after
+	case *PrintStmt:
+		a.expr(s.expression)
+	case *ReturnStmt:
+		if s.value != nil {
+			a.expr(s.value)
+		}
+		a.state = deadEnd()
+	case *VarStmt:
+		if s.init != nil {
+			a.expr(s.init)
+		}
+		if d := a.decls[s.name]; a.checked[d] {
+			a.state.vars[d] = true
+		}
+	case *WhileStmt:
+		a.loop(s.condition, s.body, nil)
+	}
+}
+
+// loop analyzes a loop, which ends when the condition is false or at a
+// break. Without a condition, or with true, it ends at breaks only.
+func (a *assignFlow) loop(cond Expr, body Stmt, incr Expr) {
+	var breaks, conts []unassigned
+	exit := deadEnd()
+	if cond != nil {
+		a.expr(cond)
+		if constCond(cond) != true {
+			exit = a.state.copy()
+		}
+	}
+	a.loops, a.conts = append(a.loops, &breaks), append(a.conts, &conts)
+	a.stmt(body)
+	a.loops, a.conts = a.loops[:len(a.loops)-1], a.conts[:len(a.conts)-1]
+	if incr != nil {
+		for _, c := range conts {
+			a.state = a.state.join(c)
+		}
+		a.expr(incr)
+	}
+	for _, b := range breaks {
+		exit = exit.join(b)
+	}
+	a.state = exit
+}
+
+// constCond returns the value of a literal true or false condition, nil
+// for others.
+func constCond(cond Expr) value {
+	if l, ok := cond.(*LiteralExpr); ok {
+		if b, ok := l.value.(bool); ok {
+			return b
+		}
+	}
+	return nil
+}
+
+func (a *assignFlow) expr(e Expr) {
+	switch e := e.(type) {
+	case *AssignExpr:
+		a.expr(e.value)
+		delete(a.state.vars, a.res.refs[e.name])
+	case *BinaryExpr:
+		a.expr(e.left)
+		a.expr(e.right)
+	case *CallExpr:
+		a.expr(e.callee)
+		for _, arg := range e.args {
+			a.expr(arg)
+		}
+	case *FunExpr:
+		a.function(e.body)
+	case *GroupingExpr:
+		a.expr(e.e)
+	case *LogicalExpr:
+		a.expr(e.left)
+		before := a.state.copy()
+		a.expr(e.right)
+		a.state = before.join(a.state)
+	case *UnaryExpr:
+		a.expr(e.right)
+	case *VarExpr:
+		if a.state.vars[a.res.refs[e.name]] {
+			a.reads = append(a.reads, e.name)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestUninitWarnings checks the reads warned about on the paths through
+// if, while, for, and, or and functions.
+func TestUninitWarnings(t *testing.T) {
+	tests := []struct {
+		source string
+		want   []string
+	}{
+		{"var x;\nprint x;", []string{"[line 2] warning at 'x': x may be read before it is assigned"}},
+		{"var x = nil;\nprint x;", nil},
+		{"var x;\nx = 1;\nprint x;", nil},
+		{"var x;\nif (clock() > 0) x = 1;\nprint x;", []string{"[line 3] warning at 'x': x may be read before it is assigned"}},
+		{"var x;\nif (clock() > 0) x = 1; else x = 2;\nprint x;", nil},
+		{"var x;\nwhile (clock() < 0) x = 1;\nprint x;", []string{"[line 3] warning at 'x': x may be read before it is assigned"}},
+		{"var x;\nwhile (true) { x = 1; break; }\nprint x;", nil},
+		{"for (var i; i < 3; i = i + 1) print i;", []string{
+			"[line 1] warning at 'i': i may be read before it is assigned",
+			"[line 1] warning at 'i': i may be read before it is assigned",
+			"[line 1] warning at 'i': i may be read before it is assigned",
+		}},
+		{"var x;\nif ((x = 1) and clock() > 0) print x;", nil},
+		{"var x;\nclock() > 0 and (x = 1);\nprint x;", []string{"[line 3] warning at 'x': x may be read before it is assigned"}},
+		{"var x;\nclock() > 0 or (x = 1);\nprint x;", []string{"[line 3] warning at 'x': x may be read before it is assigned"}},
+		{"fun f(c) {\n  var x;\n  if (c) return 0; else x = 1;\n  return x;\n}\nprint f(true);", nil},
+		{"var x;\nfun f() { return x; }\nx = 1;\nprint f();", nil},
+		{"var x;\nfun f() { x = 1; }\nf();\nprint x;", nil},
+	}
+	for _, tt := range tests {
+		stmts, errs := parseProgram(tt.source)
+		if len(errs) > 0 {
+			t.Errorf("%q: %v", tt.source, errs)
+			continue
+		}
+		var got []string
+		for _, d := range uninitWarnings(stmts) {
+			got = append(got, d.Error())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.source, got, tt.want)
+		}
+	}
+}
+
+// TestUninitRuntime checks that reading an unassigned variable still fails
+// when the program runs, on both backends.
+func TestUninitRuntime(t *testing.T) {
+	stmts, errs := parseProgram("var x;\nif (clock() < 0) x = 1;\nprint x;")
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	saved := stdout
+	stdout = &strings.Builder{}
+	defer func() { stdout = saved }()
+	for with, err := range map[string]error{
+		"tree": interpret(stmts, NewEnv(nil)),
+		"vm":   interpretVM(stmts),
+	} {
+		if err == nil || diagnosticOf(err).Code != codeUninit {
+			t.Errorf("%v: got %v, want an error %v", with, err, codeUninit)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// startToken returns the first token of the node or nil for nodes made up
+// by the optimizer without one.
+func startToken(n interface{}) *tokenObj {
+	switch n := n.(type) {
+	case *AssignExpr:
+		return n.name
+	case *BinaryExpr:
+		return startToken(n.left)
+	case *CallExpr:
+		return startToken(n.callee)
+	case *FunExpr:
+		return n.keyword
+	case *GroupingExpr:
+		return n.paren
+	case *LiteralExpr:
+		return n.token
+	case *LogicalExpr:
+		return startToken(n.left)
+	case *UnaryExpr:
+		return n.operator
+	case *VarExpr:
+		return n.name
+	case *BlockStmt:
+		if n.brace == nil && len(n.list) > 0 {
+			return startToken(n.list[0])
+		}
+		return n.brace
+	case *BreakStmt:
+		return n.keyword
+	case *ContinueStmt:
+		return n.keyword
+	case *ExprStmt:
+		return startToken(n.expression)
+	case *ForStmt:
+		return n.keyword
+	case *FunStmt:
+		return n.keyword
+	case *IfStmt:
+		return n.keyword
+	case *PrintStmt:
+		return n.keyword
+	case *ReturnStmt:
+		return n.keyword
+	case *VarStmt:
+		return n.keyword
+	case *WhileStmt:
+		return n.keyword
+	}
+	return nil
+}
+
+// sexpr prints nodes in Lisp-like form, with the line and column of each
+// node after its head when pos is set.
+type sexpr struct {
+	pos bool
+}
+
+// printAST returns the expression in Lisp-like form.
+func printAST(e Expr) string {
+	return sexpr{}.expr(e)
+}
+
+// printStmt returns the statement in Lisp-like form, nested statements are
+// put on separate lines indented by level. Negative level keeps everything
+// on one line.
+func printStmt(s Stmt, level int) string {
+	return sexpr{}.stmt(s, level)
+}
+
+func (p sexpr) at(n interface{}) string {
+	if t := startToken(n); p.pos && t != nil {
+		return fmt.Sprintf("@%v:%v", t.line, t.col)
+	}
+	return ""
+}
+
+func (p sexpr) expr(e Expr) string {
+	at := p.at(e)
+	switch e := e.(type) {
+	case *AssignExpr:
+		return fmt.Sprintf("(=%v %v %v)", at, e.name.lexeme, p.expr(e.value))
+	case *BinaryExpr:
+		return fmt.Sprintf("(%v%v %v %v)",
+			e.operator.tok, at, p.expr(e.left), p.expr(e.right))
+	case *CallExpr:
+		s := []string{"call" + at, p.expr(e.callee)}
+		for _, a := range e.args {
+			s = append(s, p.expr(a))
+		}
+		return "(" + strings.Join(s, " ") + ")"
+	case *FunExpr:
+		var b strings.Builder
+		fmt.Fprintf(&b, "(fun%v (%v)", at, paramList(e.params))
+		for _, s := range e.body {
+			b.WriteString(" " + p.stmt(s, -1))
+		}
+		b.WriteString(")")
+		return b.String()
+	case *GroupingExpr:
+		return fmt.Sprintf("(group%v %v)", at, p.expr(e.e))
+	case *LiteralExpr:
+		return literalString(e.value) + at
+	case *LogicalExpr:
+		return fmt.Sprintf("(%v%v %v %v)",
+			e.operator.tok, at, p.expr(e.left), p.expr(e.right))
+	case *UnaryExpr:
+		return fmt.Sprintf("(%v%v %v)", e.operator.tok, at, p.expr(e.right))
+	case *VarExpr:
+		return e.name.lexeme + at
+	}
+	panic(fmt.Sprintf("unexpected type of expr %T", e))
+}
+
+func (p sexpr) stmt(s Stmt, level int) string {
+	at := p.at(s)
+	list := func(head string, stmts []Stmt) string {
+		var b strings.Builder
+		b.WriteString("(" + head)
+		for _, st := range stmts {
+			b.WriteString(p.nested(st, level))
+		}
+		b.WriteString(")")
+		return b.String()
+	}
+	switch s := s.(type) {
+	case *BlockStmt:
+		return list("block"+at, s.list)
+	case *BreakStmt:
+		return "(break" + at + ")"
+	case *ContinueStmt:
+		return "(continue" + at + ")"
+	case *ExprStmt:
+		return fmt.Sprintf("(expr%v %v)", at, p.expr(s.expression))
+	case *ForStmt:
+		init, cond, incr := "()", "()", "()"
+		if s.init != nil {
+			init = p.stmt(s.init, -1)
+		}
+		if s.condition != nil {
+			cond = p.expr(s.condition)
+		}
+		if s.increment != nil {
+			incr = p.expr(s.increment)
+		}
+		return fmt.Sprintf("(for%v %v %v %v%v)", at, init, cond, incr, p.nested(s.body, level))
+	case *FunStmt:
+		return list(fmt.Sprintf("fun%v %v (%v)", at, s.name.lexeme, paramList(s.params)), s.body)
+	case *IfStmt:
+		r := fmt.Sprintf("(if%v %v%v", at, p.expr(s.condition), p.nested(s.block1, level))
+		if s.block2 != nil {
+			r += p.nested(s.block2, level)
+		}
+		return r + ")"
+	case *PrintStmt:
+		return fmt.Sprintf("(print%v %v)", at, p.expr(s.expression))
+	case *ReturnStmt:
+		if s.value == nil {
+			return "(return" + at + ")"
+		}
+		return fmt.Sprintf("(return%v %v)", at, p.expr(s.value))
+	case *VarStmt:
+		if s.init == nil {
+			return fmt.Sprintf("(var%v %v)", at, s.name.lexeme)
+		}
+		return fmt.Sprintf("(var%v %v %v)", at, s.name.lexeme, p.expr(s.init))
+	case *WhileStmt:
+		return fmt.Sprintf("(while%v %v%v)", at, p.expr(s.condition), p.nested(s.body, level))
+	}
+	panic(fmt.Sprintf("unexpected type of stmt %T", s))
+}
+
+func (p sexpr) nested(s Stmt, level int) string {
+	if level < 0 {
+		return " " + p.stmt(s, level)
+	}
+	return "\n" + strings.Repeat("  ", level+1) + p.stmt(s, level+1)
+}
+
+func paramList(params []*tokenObj) string {
+	s := make([]string, 0, len(params))
+	for _, p := range params {
+		s = append(s, p.lexeme)
+	}
+	return strings.Join(s, " ")
+}
+
+func literalString(v value) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case string:
+		return fmt.Sprintf("%q", v)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// dumpAST prints every statement of the program on its own line.
+func dumpAST(w io.Writer, stmts []Stmt, pos bool) {
+	p := sexpr{pos: pos}
+	for _, s := range stmts {
+		fmt.Fprintln(w, p.stmt(s, 0))
+	}
+}
+
+// astVersion is increased on incompatible changes of the JSON form.
+const astVersion = 2
+
+// jsonObject is a JSON object keeping the order of its fields.
+type jsonObject []jsonField
+
+type jsonField struct {
+	key   string
+	value interface{}
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(f.key)
+		v, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// dumpJSON prints the program as a JSON object. Every node has its type
+// and, unless made up by the optimizer, the line and column where it
+// starts.
+func dumpJSON(w io.Writer, stmts []Stmt) error {
+	prog := jsonObject{
+		{"type", "Program"},
+		{"version", astVersion},
+		{"body", jsonStmts(stmts)},
+	}
+	b, err := json.MarshalIndent(prog, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+func jsonNode(n interface{}, typ string, fields ...jsonField) jsonObject {
+	o := jsonObject{{"type", typ}}
+	if t := startToken(n); t != nil {
+		o = append(o, jsonField{"line", t.line}, jsonField{"col", t.col})
+	}
+	return append(o, fields...)
+}
+
+func jsonParams(params []*tokenObj) []jsonObject {
+	l := make([]jsonObject, 0, len(params))
+	for _, p := range params {
+		l = append(l, jsonObject{{"name", p.lexeme}, {"line", p.line}, {"col", p.col}})
+	}
+	return l
+}
+
+func jsonLiteral(v value) interface{} {
+	if f, ok := v.(float64); ok && (math.IsInf(f, 0) || math.IsNaN(f)) {
+		// not representable in JSON
+		return fmt.Sprintf("%v", f)
+	}
+	return v
+}
+
+func jsonExprs(list []Expr) []interface{} {
+	l := make([]interface{}, 0, len(list))
+	for _, e := range list {
+		l = append(l, jsonExpr(e))
+	}
+	return l
+}
+
+func jsonExpr(e Expr) interface{} {
+	switch e := e.(type) {
+	case nil:
+		return nil
+	case *AssignExpr:
+		return jsonNode(e, "AssignExpr",
+			jsonField{"name", e.name.lexeme},
+			jsonField{"value", jsonExpr(e.value)})
+	case *BinaryExpr:
+		return jsonNode(e, "BinaryExpr",
+			jsonField{"operator", e.operator.lexeme},
+			jsonField{"left", jsonExpr(e.left)},
+			jsonField{"right", jsonExpr(e.right)})
+	case *CallExpr:
+		return jsonNode(e, "CallExpr",
+			jsonField{"callee", jsonExpr(e.callee)},
+			jsonField{"args", jsonExprs(e.args)})
+	case *FunExpr:
+		return jsonNode(e, "FunExpr",
+			jsonField{"params", jsonParams(e.params)},
+			jsonField{"body", jsonStmts(e.body)})
+	case *GroupingExpr:
+		return jsonNode(e, "GroupingExpr",
+			jsonField{"expression", jsonExpr(e.e)})
+	case *LiteralExpr:
+		return jsonNode(e, "LiteralExpr",
+			jsonField{"value", jsonLiteral(e.value)})
+	case *LogicalExpr:
+		return jsonNode(e, "LogicalExpr",
+			jsonField{"operator", e.operator.lexeme},
+			jsonField{"left", jsonExpr(e.left)},
+			jsonField{"right", jsonExpr(e.right)})
+	case *UnaryExpr:
+		return jsonNode(e, "UnaryExpr",
+			jsonField{"operator", e.operator.lexeme},
+			jsonField{"right", jsonExpr(e.right)})
+	case *VarExpr:
+		return jsonNode(e, "VarExpr",
+			jsonField{"name", e.name.lexeme})
+	}
+	panic(fmt.Sprintf("unexpected type of expr %T", e))
+}
+
+func jsonStmts(list []Stmt) []interface{} {
+	l := make([]interface{}, 0, len(list))
+	for _, s := range list {
+		l = append(l, jsonStmt(s))
+	}
+	return l
+}
+
+func jsonStmt(s Stmt) interface{} {
+	switch s := s.(type) {
+	case nil:
+		return nil
+	case *BlockStmt:
+		return jsonNode(s, "BlockStmt",
+			jsonField{"body", jsonStmts(s.list)})
+	case *BreakStmt:
+		return jsonNode(s, "BreakStmt")
+	case *ContinueStmt:
+		return jsonNode(s, "ContinueStmt")
+	case *ExprStmt:
+		return jsonNode(s, "ExprStmt",
+			jsonField{"expression", jsonExpr(s.expression)})
+	case *ForStmt:
+		return jsonNode(s, "ForStmt",
+			jsonField{"init", jsonStmt(s.init)},
+			jsonField{"condition", jsonExpr(s.condition)},
+			jsonField{"increment", jsonExpr(s.increment)},
+			jsonField{"body", jsonStmt(s.body)})
+	case *FunStmt:
+		return jsonNode(s, "FunStmt",
+			jsonField{"name", s.name.lexeme},
+			jsonField{"params", jsonParams(s.params)},
+			jsonField{"body", jsonStmts(s.body)})
+	case *IfStmt:
+		return jsonNode(s, "IfStmt",
+			jsonField{"condition", jsonExpr(s.condition)},
+			jsonField{"then", jsonStmt(s.block1)},
+			jsonField{"else", jsonStmt(s.block2)})
+	case *PrintStmt:
+		return jsonNode(s, "PrintStmt",
+			jsonField{"expression", jsonExpr(s.expression)})
+	case *ReturnStmt:
+		return jsonNode(s, "ReturnStmt",
+			jsonField{"value", jsonExpr(s.value)})
+	case *VarStmt:
+		return jsonNode(s, "VarStmt",
+			jsonField{"name", s.name.lexeme},
+			jsonField{"init", jsonExpr(s.init)})
+	case *WhileStmt:
+		return jsonNode(s, "WhileStmt",
+			jsonField{"condition", jsonExpr(s.condition)},
+			jsonField{"body", jsonStmt(s.body)})
+	}
+	panic(fmt.Sprintf("unexpected type of stmt %T", s))
+}
@@ -0,0 +1,93 @@
+package main
+
+// opcode is a single bytecode instruction understood by the vm. Operands
+// follow the opcode in the code stream; their width is noted next to each
+// opcode.
+type opcode byte
+
+const (
+	OpConstant     opcode = iota // idx16
+	OpNil                        //
+	OpTrue                       //
+	OpFalse                      //
+	OpUninit                     // idx16: name of the variable
+	OpUndeclared                 // idx16: name of the variable
+	OpPop                        //
+	OpGetLocal                   // slot8
+	OpSetLocal                   // slot8
+	OpGetGlobal                  // idx16
+	OpDefineGlobal               // idx16
+	OpSetGlobal                  // idx16
+	OpGetUpvalue                 // idx8
+	OpSetUpvalue                 // idx8
+	OpEqual                      //
+	OpNotEqual                   //
+	OpGreater                    //
+	OpGreaterEqual               //
+	OpLess                       //
+	OpLessEqual                  //
+	OpAdd                        //
+	OpSubtract                   //
+	OpMultiply                   //
+	OpDivide                     //
+	OpNot                        //
+	OpNegate                     //
+	OpPrint                      //
+	OpJump                       // off16
+	OpJumpIfFalse                // off16
+	OpLoop                       // off16
+	OpCall                       // argc8
+	OpTailCall                   // argc8
+	OpClosure                    // idx16, then (isLocal8, index8) per upvalue
+	OpCloseUpvalue               //
+	OpReturn                     //
+)
+
+// chunk is a compiled sequence of instructions together with its constant
+// pool. lines holds the source line for every byte of code.
+type chunk struct {
+	code      []byte
+	lines     []int
+	constants []value
+}
+
+func (c *chunk) write(b byte, line int) {
+	c.code = append(c.code, b)
+	c.lines = append(c.lines, line)
+}
+
+// addConstant adds v to the constant pool and returns its index. Equal
+// numbers and strings share one slot.
+func (c *chunk) addConstant(v value) int {
+	switch v.(type) {
+	case float64, string:
+		for i, k := range c.constants {
+			if k == v {
+				return i
+			}
+		}
+	}
+	c.constants = append(c.constants, v)
+	return len(c.constants) - 1
+}
+
+// function is the compiled form of a FunStmt, a FunExpr or the top level
+// script.
+type function struct {
+	name         string   // empty for anonymous functions
+	params       []string // used only for printing
+	arity        int
+	upvalueCount int
+	chunk        chunk
+
+	// names of the locals visible at the accesses of globals, by the offset
+	// of the instruction, for suggestions when the global is undefined
+	scopes map[int][]string
+}
+
+func (f *function) String() string {
+	if f.name == "" {
+		return "<lambda>"
+	}
+	return "<fn " + f.name + ">"
+}
@@ -0,0 +1,872 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type command struct {
+	name  string
+	args  string
+	short string
+	run   func(args []string) int
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"run", "[-e code | script [args...]]", "run a script, the code or the REPL", cmdRun},
+		{"repl", "", "start the interactive prompt", cmdRepl},
+		{"tokens", "script", "print tokens of the script", cmdTokens},
+		{"ast", "[-format sexpr|json] script", "print the syntax tree of the script", cmdAST},
+		{"cst", "[-text] script", "print the concrete syntax tree of the script", cmdCST},
+		{"fmt", "[-w | -d] [script...]", "format scripts in the canonical layout", cmdFmt},
+		{"lint", "[-enable rules] [-disable rules] script...", "report likely mistakes in the scripts", cmdLint},
+		{"lsp", "[-replay session]", "run the language server on stdin and stdout", cmdLSP},
+		{"debug", "script [args...]", "run the script in the debugger", cmdDebug},
+		{"dap", "[-replay session]", "run the debug adapter on stdin and stdout", cmdDAP},
+		{"test", "[-run regexp] [-junit file] [-cover] [path...]", "run the tests of *_test.glx files", cmdTest},
+		{"conform", "[-backends list] [path...]", "check the output of scripts against their expect comments", cmdConform},
+		{"cover", "[-format f] [-o file] script [args...]", "run the script and report its coverage", cmdCover},
+		{"profile", "[-sample d] [-folded file] [-pprof file] script [args...]", "run the script and report where it spends time", cmdProfile},
+		{"check", "script...", "report errors without running the scripts", cmdCheck},
+		{"disasm", "script", "print the bytecode of a script or a compiled program", cmdDisasm},
+		{"compile", "script [-o file.gloxc]", "compile the script for the vm", cmdCompile},
+		{"compare", "script...", "run scripts with both backends and compare output", cmdCompare},
+		{"help", "", "print this help", cmdHelp},
+	}
+}
+
+// runCommand dispatches the command line and returns the exit code.
+// Without a command the arguments are those of run.
+func runCommand(args []string) int {
+	if len(args) > 0 {
+		for _, c := range commands {
+			if c.name == args[0] {
+				return c.run(args[1:])
+			}
+		}
+	}
+	return cmdRun(args)
+}
+
+func usage(w io.Writer) {
+	fmt.Fprint(w, "usage: glox [command] [flags] [arguments]\n\n")
+	fmt.Fprint(w, "Without a command glox runs the script given, the code of -e or the REPL.\n")
+	fmt.Fprint(w, "The script - or a missing script with a non-terminal stdin runs the standard input.\n\n")
+	fmt.Fprint(w, "commands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-8v %-30v %v\n", c.name, c.args, c.short)
+	}
+	fmt.Fprint(w, "\nexit codes: 64 usage, 65 syntax errors, 66 unreadable script, 70 runtime error\n")
+}
+
+func cmdHelp(args []string) int {
+	usage(os.Stdout)
+	return exitOK
+}
+
+// newFlags returns flags of the command, with the options of running
+// programs when exec is set.
+func newFlags(name, args string, exec bool) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: glox %v [flags] %v\n", name, args)
+		fs.PrintDefaults()
+	}
+	if exec {
+		fs.StringVar(&backend, "backend", backend, "execution backend: tree or vm")
+		fs.BoolVar(&vmTrace, "vmtrace", vmTrace, "print the vm stack and each instruction to stderr")
+		fs.BoolVar(&traceExec, "trace", traceExec, "print each statement, call and assignment of the tree backend to stderr")
+		fs.StringVar(&traceFunc, "trace-func", traceFunc, "trace only within calls of functions matching the `regexp`")
+		fs.StringVar(&traceOut, "trace-out", traceOut, "write the trace to the `file` instead of stderr")
+	}
+	fs.BoolVar(&optAST, "O", optAST, "optimize the program")
+	fs.StringVar(&errorFormat, "error-format", errorFormat, "print errors in the `format`: human or json, one object per line")
+	return fs
+}
+
+// parseFlags parses flags of the command, flags may follow its arguments
+// when interspersed is set. It returns the arguments or false on errors.
+func parseFlags(fs *flag.FlagSet, args []string, interspersed bool) ([]string, bool) {
+	rest := make([]string, 0)
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, false
+		}
+		if !interspersed || fs.NArg() == 0 {
+			rest = append(rest, fs.Args()...)
+			break
+		}
+		rest = append(rest, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if backend != "tree" && backend != "vm" {
+		fmt.Fprintf(os.Stderr, "unknown backend %q\n", backend)
+		return nil, false
+	}
+	if errorFormat != "human" && errorFormat != "json" {
+		fmt.Fprintf(os.Stderr, "unknown error format %q\n", errorFormat)
+		return nil, false
+	}
+	if vmTrace && backend != "vm" {
+		fmt.Fprintln(os.Stderr, "-vmtrace needs the vm backend, -trace traces the tree backend")
+		return nil, false
+	}
+	if traceExec && tracing == nil {
+		if backend == "vm" {
+			fmt.Fprintln(os.Stderr, "-trace needs the tree backend, -vmtrace traces the vm")
+			return nil, false
+		}
+		t, err := newTracer(traceFunc, traceOut)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return nil, false
+		}
+		tracing = t
+	}
+	return rest, true
+}
+
+// readSource reads the script, "-" stands for the standard input. It
+// returns false after reporting errors.
+func readSource(file string) ([]byte, bool) {
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, false
+	}
+	return data, true
+}
+
+// scriptArgs are the arguments following the name of the script.
+var scriptArgs []string
+
+func cmdRun(args []string) int {
+	fs := newFlags("run", "[-e code | script [args...]]", true)
+	code := fs.String("e", "", "run the `code` given instead of a script")
+	args, ok := parseFlags(fs, args, false)
+	if !ok {
+		return exitUsage
+	}
+	if *code != "" {
+		scriptArgs = args
+		run("", *code)
+		return exitCode()
+	}
+	if len(args) == 0 {
+		if !isTerminal(os.Stdin) {
+			// the program is piped in
+			return runFile("-")
+		}
+		runPrompt()
+		return exitOK
+	}
+	scriptArgs = args[1:]
+	return runFile(args[0])
+}
+
+func cmdRepl(args []string) int {
+	fs := newFlags("repl", "", true)
+	args, ok := parseFlags(fs, args, false)
+	if !ok || len(args) != 0 {
+		return exitUsage
+	}
+	runPrompt()
+	return exitOK
+}
+
+func cmdTokens(args []string) int {
+	fs := newFlags("tokens", "script", false)
+	args, ok := parseFlags(fs, args, true)
+	if !ok || len(args) != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	data, ok := readSource(args[0])
+	if !ok {
+		return exitNoInput
+	}
+	tokens, errs := NewScanner(string(data)).scan()
+	for _, t := range tokens {
+		lit := ""
+		if t.literal != nil {
+			lit = literalString(t.literal)
+		}
+		fmt.Printf("%4d %-10v %-16q %v\n", t.line, t.tok, t.lexeme, lit)
+	}
+	for _, e := range errs {
+		fmt.Println(e)
+	}
+	if len(errs) > 0 {
+		return exitData
+	}
+	return exitOK
+}
+
+func cmdAST(args []string) int {
+	fs := newFlags("ast", "[-format sexpr|json] script", false)
+	format := fs.String("format", "sexpr", "output `format`: sexpr or json")
+	pos := fs.Bool("pos", false, "print line and column of nodes in sexpr format")
+	args, ok := parseFlags(fs, args, true)
+	if !ok || len(args) != 1 || (*format != "sexpr" && *format != "json") {
+		fs.Usage()
+		return exitUsage
+	}
+	data, ok := readSource(args[0])
+	if !ok {
+		return exitNoInput
+	}
+	stmt := parseSource(args[0], string(data))
+	if stmt == nil {
+		return exitCode()
+	}
+	if *format == "json" {
+		if err := dumpJSON(os.Stdout, stmt); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitSoftware
+		}
+	} else {
+		dumpAST(os.Stdout, stmt, *pos)
+	}
+	return exitCode()
+}
+
+// cmdCST prints the tree or, with -text, the source made of it.
+func cmdCST(args []string) int {
+	fs := newFlags("cst", "[-text] script", false)
+	text := fs.Bool("text", false, "print the source reproduced from the tree")
+	args, ok := parseFlags(fs, args, true)
+	if !ok || len(args) != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	data, ok := readSource(args[0])
+	if !ok {
+		return exitNoInput
+	}
+	tree, errs := parseCST(string(data))
+	if len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Println(e)
+		}
+		return exitData
+	}
+	if *text {
+		tree.text(os.Stdout)
+	} else {
+		tree.dump(os.Stdout, 0)
+	}
+	return exitOK
+}
+
+// cmdFmt prints the formatted scripts or the standard input without
+// scripts.
+func cmdFmt(args []string) int {
+	fs := newFlags("fmt", "[-w | -d] [script...]", false)
+	write := fs.Bool("w", false, "write the result to the script instead of stdout")
+	diff := fs.Bool("d", false, "print diffs instead of the formatted scripts")
+	args, ok := parseFlags(fs, args, true)
+	if !ok || (*write && (*diff || len(args) == 0)) {
+		fs.Usage()
+		return exitUsage
+	}
+	if len(args) == 0 {
+		args = []string{"-"}
+	}
+	code := exitOK
+	for _, file := range args {
+		data, ok := readSource(file)
+		if !ok {
+			code = exitNoInput
+			continue
+		}
+		res, errs := format(string(data))
+		if len(errs) > 0 {
+			for _, e := range errs {
+				fmt.Printf("%v: %v\n", file, e)
+			}
+			code = exitData
+			continue
+		}
+		switch {
+		case *diff:
+			unifiedDiff(os.Stdout, file, string(data), string(res))
+		case *write:
+			if bytes.Equal(data, res) {
+				continue
+			}
+			if err := os.WriteFile(file, res, 0644); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				code = exitSoftware
+			}
+		default:
+			os.Stdout.Write(res)
+		}
+	}
+	return code
+}
+
+func cmdLint(args []string) int {
+	fs := newFlags("lint", "[-enable rules] [-disable rules] script...", false)
+	enable := fs.String("enable", "", "comma separated `rules` to enable, all for every rule")
+	disable := fs.String("disable", "", "comma separated `rules` to disable")
+	list := fs.Bool("rules", false, "list the rules")
+	args, ok := parseFlags(fs, args, true)
+	if !ok {
+		return exitUsage
+	}
+	if *list {
+		for _, r := range lintRules {
+			state := "on"
+			if !r.enabled {
+				state = "off"
+			}
+			fmt.Printf("%-12v %-4v %v\n", r.name, state, r.doc)
+		}
+		return exitOK
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	rules := defaultRules()
+	for _, opt := range []struct {
+		names string
+		on    bool
+	}{{*enable, true}, {*disable, false}} {
+		for _, name := range strings.Split(opt.names, ",") {
+			name = strings.TrimSpace(name)
+			if _, ok := rules[name]; ok {
+				rules[name] = opt.on
+			} else if name == "all" {
+				for r := range rules {
+					rules[r] = opt.on
+				}
+			} else if name != "" {
+				fmt.Fprintf(os.Stderr, "unknown lint rule %q\n", name)
+				return exitUsage
+			}
+		}
+	}
+	code := exitOK
+	for _, file := range args {
+		data, ok := readSource(file)
+		if !ok {
+			code = exitNoInput
+			continue
+		}
+		issues, errs := lint(string(data), rules)
+		for _, e := range errs {
+			printError(file, e)
+		}
+		for _, i := range issues {
+			if errorFormat == "json" {
+				d := *i.diag
+				d.File = file
+				printJSON(&d)
+			} else {
+				fmt.Printf("%v:%v\n", file, i)
+			}
+		}
+		if len(errs) > 0 {
+			code = exitData
+		} else if len(issues) > 0 && code == exitOK {
+			code = exitFindings
+		}
+	}
+	return code
+}
+
+// cmdLSP serves editors, or replays the client messages of a session file
+// given with -replay.
+func cmdLSP(args []string) int {
+	fs := newFlags("lsp", "[-replay session]", false)
+	replay := fs.String("replay", "", "run the JSON messages of the `session`, one per line, and print the replies")
+	args, ok := parseFlags(fs, args, true)
+	if !ok || len(args) != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	if *replay != "" {
+		data, ok := readSource(*replay)
+		if !ok {
+			return exitNoInput
+		}
+		return replayLSP(bytes.NewReader(data), os.Stdout)
+	}
+	return serveLSP(os.Stdin, os.Stdout)
+}
+
+// cmdDebug runs the script with the tree interpreter under the debugger
+// reading commands from stdin.
+func cmdDebug(args []string) int {
+	fs := newFlags("debug", "script [args...]", false)
+	args, ok := parseFlags(fs, args, false)
+	if !ok || len(args) == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	data, ok := readSource(args[0])
+	if !ok {
+		return exitNoInput
+	}
+	stmt := parseSource(args[0], string(data))
+	if stmt == nil {
+		return exitCode()
+	}
+	scriptArgs = args[1:]
+	reportRuntime(args[0], debugScript(stmt, string(data), os.Stdin, os.Stdout))
+	return exitCode()
+}
+
+// cmdDAP serves debuggers of editors, or replays the requests of a session
+// file given with -replay.
+func cmdDAP(args []string) int {
+	fs := newFlags("dap", "[-replay session]", false)
+	replay := fs.String("replay", "", "run the JSON requests of the `session`, one per line, and print the messages of the adapter")
+	args, ok := parseFlags(fs, args, true)
+	if !ok || len(args) != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	if *replay != "" {
+		data, ok := readSource(*replay)
+		if !ok {
+			return exitNoInput
+		}
+		return replayDAP(bytes.NewReader(data), os.Stdout)
+	}
+	return serveDAP(os.Stdin, os.Stdout)
+}
+
+// cmdTest runs the tests of the files given and of the *_test.glx files in
+// the directories, the current one without paths.
+func cmdTest(args []string) int {
+	fs := newFlags("test", "[-run regexp] [-junit file] [-cover] [path...]", true)
+	run := fs.String("run", "", "run only the tests whose names match the `regexp`")
+	junit := fs.String("junit", "", "write a JUnit XML report to the `file`")
+	verbose := fs.Bool("v", false, "print the tests passed and their output")
+	cover := fs.Bool("cover", false, "print the coverage of the test files")
+	profile := fs.String("coverprofile", "", "write the coverage to the `file` in the lcov format")
+	args, ok := parseFlags(fs, args, true)
+	if !ok {
+		return exitUsage
+	}
+	var cov *coverage
+	if *cover || *profile != "" {
+		if backend != "tree" {
+			fmt.Fprintln(os.Stderr, "coverage needs the tree backend")
+			return exitUsage
+		}
+		cov = newCoverage()
+		hook = cov
+		defer func() {
+			hook = nil
+		}()
+	}
+	var match *regexp.Regexp
+	if *run != "" {
+		var err error
+		if match, err = regexp.Compile(*run); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+	}
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	paths, err := findScripts(args, "_test.glx")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitNoInput
+	}
+	if len(paths) == 0 {
+		fmt.Println("no test files")
+		return exitOK
+	}
+	code := exitOK
+	files := make([]*testFile, 0, len(paths))
+	for _, p := range paths {
+		f := runTestFile(p, match, cov)
+		printTests(os.Stdout, []*testFile{f}, *verbose)
+		if len(f.errs) > 0 {
+			code = exitData
+		} else if f.failed() > 0 && code == exitOK {
+			code = exitFindings
+		}
+		files = append(files, f)
+	}
+	if *cover {
+		cov.writeSummary(os.Stdout)
+	}
+	if *profile != "" {
+		if err := writeCoverage(cov, "lcov", *profile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitSoftware
+		}
+	}
+	if *junit != "" {
+		w, err := os.Create(*junit)
+		if err == nil {
+			err = writeJUnit(w, files)
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitSoftware
+		}
+	}
+	return code
+}
+
+// cmdConform runs the scripts given and the scripts in the directories
+// with the backends and compares their output with the annotations.
+func cmdConform(args []string) int {
+	fs := newFlags("conform", "[-backends list] [path...]", false)
+	list := fs.String("backends", "tree,vm", "comma separated `backends` to run the scripts with")
+	args, ok := parseFlags(fs, args, true)
+	if !ok {
+		return exitUsage
+	}
+	backends := strings.Split(*list, ",")
+	for _, b := range backends {
+		if b != "tree" && b != "vm" {
+			fmt.Fprintf(os.Stderr, "unknown backend %q\n", b)
+			return exitUsage
+		}
+	}
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	paths, err := findScripts(args, ".glx")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitNoInput
+	}
+	results := make([]conformResult, 0, len(paths))
+	for _, p := range paths {
+		data, ok := readSource(p)
+		if !ok {
+			return exitNoInput
+		}
+		r := conformResult{p, make(map[string][]string)}
+		for _, b := range backends {
+			r.diffs[b] = conformance(string(data), b)
+		}
+		results = append(results, r)
+	}
+	if printConformance(os.Stdout, results, backends) > 0 {
+		return exitFindings
+	}
+	return exitOK
+}
+
+// cmdCover runs the script with the tree interpreter and reports the lines
+// and branches it ran.
+func cmdCover(args []string) int {
+	fs := newFlags("cover", "[-format f] [-o file] script [args...]", false)
+	format := fs.String("format", "text", "report `format`: text, annotate, html or lcov")
+	out := fs.String("o", "", "write the report to the `file` instead of stdout")
+	args, ok := parseFlags(fs, args, false)
+	switch *format {
+	case "text", "annotate", "html", "lcov":
+	default:
+		ok = false
+	}
+	if !ok || len(args) == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	data, ok := readSource(args[0])
+	if !ok {
+		return exitNoInput
+	}
+	stmt := parseSource(args[0], string(data))
+	if stmt == nil {
+		return exitCode()
+	}
+	scriptArgs = args[1:]
+	cov := newCoverage()
+	cov.add(args[0], string(data), stmt)
+	restore := programOutput(*out)
+	hook = cov
+	err := interpret(stmt, NewEnv(nil))
+	hook = nil
+	reportRuntime(args[0], err)
+	restore()
+	if err := writeCoverage(cov, *format, *out); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitSoftware
+	}
+	return exitCode()
+}
+
+// cmdProfile runs the script with the tree interpreter and reports the
+// calls of functions, their time and the lines run most often.
+func cmdProfile(args []string) int {
+	fs := newFlags("profile", "[-sample d] [-folded file] [-pprof file] script [args...]", false)
+	interval := fs.Duration("sample", 0, "sample the call stack every `interval` instead of timing every call")
+	out := fs.String("o", "", "write the report to the `file` instead of stdout")
+	folded := fs.String("folded", "", "write the folded stacks for flame graphs to the `file`")
+	pprof := fs.String("pprof", "", "write the profile in the format of pprof to the `file`")
+	lines := fs.Int("lines", 10, "report the `n` lines run most often")
+	args, ok := parseFlags(fs, args, false)
+	if !ok || len(args) == 0 || *interval < 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	data, ok := readSource(args[0])
+	if !ok {
+		return exitNoInput
+	}
+	stmt := parseSource(args[0], string(data))
+	if stmt == nil {
+		return exitCode()
+	}
+	scriptArgs = args[1:]
+	p := newProfiler(*interval)
+	restore := programOutput(*out)
+	hook = p
+	err := interpret(stmt, NewEnv(nil))
+	hook = nil
+	p.stop()
+	reportRuntime(args[0], err)
+	restore()
+	writes := []struct {
+		file  string
+		write func(w io.Writer) error
+	}{
+		{*out, func(w io.Writer) error {
+			p.writeReport(w, string(data), *lines)
+			return nil
+		}},
+		{*folded, func(w io.Writer) error {
+			p.writeFolded(w)
+			return nil
+		}},
+		{*pprof, func(w io.Writer) error {
+			return p.writePprof(w, args[0])
+		}},
+	}
+	for i, wr := range writes {
+		if wr.file == "" && i > 0 {
+			continue
+		}
+		if err := writeFile(wr.file, wr.write); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitSoftware
+		}
+	}
+	return exitCode()
+}
+
+// programOutput sends what the program prints, and its errors, to stderr
+// when the report goes to stdout, "" for the file of the report, so stdout
+// has the report alone. It returns the function restoring stdout.
+func programOutput(report string) func() {
+	saved := stdout
+	if report == "" {
+		stdout = os.Stderr
+	}
+	return func() { stdout = saved }
+}
+
+// writeFile writes to the file, or to stdout without a file.
+func writeFile(file string, write func(w io.Writer) error) error {
+	if file == "" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func cmdCheck(args []string) int {
+	fs := newFlags("check", "script...", false)
+	args, ok := parseFlags(fs, args, true)
+	if !ok || len(args) == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	code := exitOK
+	for _, file := range args {
+		data, ok := readSource(file)
+		if !ok {
+			code = exitNoInput
+			continue
+		}
+		stmts, errs, warns := parseWarnings(string(data))
+		for _, e := range errs {
+			printError(file, e)
+		}
+		if len(errs) > 0 {
+			code = exitData
+			continue
+		}
+		warns = append(warns, uninitWarnings(stmts)...)
+		sort.SliceStable(warns, func(i, j int) bool {
+			return warns[i].Span.Line < warns[j].Span.Line
+		})
+		for _, w := range warns {
+			printError(file, w)
+		}
+	}
+	return code
+}
+
+func cmdDisasm(args []string) int {
+	fs := newFlags("disasm", "script", false)
+	args, ok := parseFlags(fs, args, true)
+	if !ok || len(args) != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	fn, code := compileFile(args[0])
+	if fn == nil {
+		return code
+	}
+	disassemble(os.Stdout, fn)
+	return exitOK
+}
+
+// cmdCompile writes the compiled script next to the source unless -o is
+// given.
+func cmdCompile(args []string) int {
+	fs := newFlags("compile", "script [-o file.gloxc]", false)
+	out := fs.String("o", "", "output `file`")
+	args, ok := parseFlags(fs, args, true)
+	if !ok || len(args) != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	file := args[0]
+	if *out == "" {
+		*out = strings.TrimSuffix(file, filepath.Ext(file)) + ".gloxc"
+	}
+	fn, code := compileFile(file)
+	if fn == nil {
+		return code
+	}
+	if err := os.WriteFile(*out, encodeProgram(fn), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitSoftware
+	}
+	return exitOK
+}
+
+// compileFile returns the compiled script from the file or nil and the
+// exit code after reporting the errors.
+func compileFile(file string) (*function, int) {
+	data, ok := readSource(file)
+	if !ok {
+		return nil, exitNoInput
+	}
+	if isCompiled(data) {
+		fn, err := decodeProgram(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", file, err)
+			return nil, exitData
+		}
+		return fn, exitOK
+	}
+	stmt := parseSource(file, string(data))
+	if stmt == nil {
+		return nil, exitData
+	}
+	fn, errs := compile(stmt)
+	if len(errs) > 0 {
+		for _, e := range errs {
+			reportError(file, e)
+		}
+		return nil, exitData
+	}
+	return fn, exitOK
+}
+
+// cmdCompare runs every file with the interpreter and with the vm and
+// reports the files whose output differs.
+func cmdCompare(args []string) int {
+	fs := newFlags("compare", "script...", false)
+	args, ok := parseFlags(fs, args, true)
+	if !ok || len(args) == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	code := exitOK
+	for _, file := range args {
+		data, ok := readSource(file)
+		if !ok {
+			return exitNoInput
+		}
+		tree := runCaptured(string(data), "tree")
+		vm := runCaptured(string(data), "vm")
+		if tree == vm {
+			fmt.Printf("ok   %v\n", file)
+			continue
+		}
+		code = exitSoftware
+		fmt.Printf("FAIL %v\n", file)
+		printDiff(tree, vm)
+	}
+	return code
+}
+
+func runCaptured(source, with string) string {
+	var buf bytes.Buffer
+	saved, savedBackend := stdout, backend
+	stdout, backend = &buf, with
+	defer func() {
+		stdout, backend = saved, savedBackend
+		hadError, hadRuntimeError, exitStatus = false, false, -1
+	}()
+	run("", source)
+	return buf.String()
+}
+
+// printDiff prints the first line where outputs of the backends differ.
+func printDiff(tree, vm string) {
+	a := strings.Split(tree, "\n")
+	b := strings.Split(vm, "\n")
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y string
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			fmt.Printf("\tline %v:\n\t\ttree: %q\n\t\tvm:   %q\n", i+1, x, y)
+			return
+		}
+	}
+}
+
+// isTerminal reports whether f is an interactive terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,590 @@
+package main
+
+import "fmt"
+
+// Compiler from AST into bytecode for the vm.
+//
+// Variables declared at the top level live in the globals table and are
+// looked up by name, like in the tree-walking interpreter. Everything
+// declared inside of blocks and functions lives in stack slots that are
+// resolved at compile time, variables of enclosing functions are reached
+// through upvalues.
+//
+// The interpreter looks locals up by name in the environment of their
+// block when they are used. So a function may use a local declared after
+// it in the block, its slot is reserved when the block begins, and a
+// local declared again in its scope is the same variable.
+
+type local struct {
+	name     string
+	depth    int
+	captured bool
+	later    bool // declared further in the block, seen by functions only
+}
+
+type upvalueRef struct {
+	index   byte
+	isLocal bool
+}
+
+type loop struct {
+	start  int   // offset continue jumps to
+	depth  int   // scope depth outside of the loop body
+	breaks []int // jumps to be patched to the loop exit
+}
+
+type compiler struct {
+	enclosing *compiler
+	fn        *function
+	locals    []local
+	upvalues  []upvalueRef
+	depth     int
+	loops     []*loop
+	line      int
+	errs      *[]error
+}
+
+// compile translates the program into the function of the top level script.
+func compile(stmts []Stmt) (*function, []error) {
+	errs := make([]error, 0)
+	c := &compiler{fn: &function{name: "script"}, errs: &errs, line: 1}
+	// slot zero is reserved for the function being called
+	c.locals = append(c.locals, local{name: "", depth: 0})
+	for _, s := range stmts {
+		c.stmt(s)
+	}
+	c.emitReturn()
+	return c.fn, errs
+}
+
+// error records the error at t, or at the current line when t is nil.
+func (c *compiler) error(t *tokenObj, code, msg string) {
+	var d *Diagnostic
+	if t != nil {
+		d = errorAtToken(phaseCompile, code, t, msg)
+	} else {
+		d = newDiag(phaseCompile, code, c.line, msg)
+	}
+	*c.errs = append(*c.errs, CompileError{d})
+}
+
+func (c *compiler) chunk() *chunk {
+	return &c.fn.chunk
+}
+
+func (c *compiler) at(t *tokenObj) {
+	if t != nil {
+		c.line = t.line
+	}
+}
+
+func (c *compiler) emit(bs ...byte) {
+	for _, b := range bs {
+		c.chunk().write(b, c.line)
+	}
+}
+
+func (c *compiler) emitOp(op opcode) {
+	c.emit(byte(op))
+}
+
+func (c *compiler) emitIndex(op opcode, idx int) {
+	c.emit(byte(op), byte(idx>>8), byte(idx))
+}
+
+func (c *compiler) constant(t *tokenObj, v value) int {
+	idx := c.chunk().addConstant(v)
+	if idx > 0xffff {
+		c.error(t, codeTooManyConsts, "too many constants in one chunk")
+		return 0
+	}
+	return idx
+}
+
+func (c *compiler) emitJump(op opcode) int {
+	c.emit(byte(op), 0xff, 0xff)
+	return len(c.chunk().code) - 2
+}
+
+func (c *compiler) patchJump(t *tokenObj, at int) {
+	jump := len(c.chunk().code) - at - 2
+	if jump > 0xffff {
+		c.error(t, codeJumpTooFar, "too much code to jump over")
+	}
+	c.chunk().code[at] = byte(jump >> 8)
+	c.chunk().code[at+1] = byte(jump)
+}
+
+func (c *compiler) emitLoop(t *tokenObj, start int) {
+	c.emitOp(OpLoop)
+	off := len(c.chunk().code) - start + 2
+	if off > 0xffff {
+		c.error(t, codeJumpTooFar, "loop body too large")
+	}
+	c.emit(byte(off>>8), byte(off))
+}
+
+func (c *compiler) emitReturn() {
+	c.emitOp(OpNil)
+	c.emitOp(OpReturn)
+}
+
+// ---------------------------------------------------------
+// scopes
+
+func (c *compiler) beginScope() {
+	c.depth++
+}
+
+func (c *compiler) endScope() {
+	c.depth--
+	c.popLocals(c.depth)
+	for len(c.locals) > 0 && c.locals[len(c.locals)-1].depth > c.depth {
+		c.locals = c.locals[:len(c.locals)-1]
+	}
+}
+
+// popLocals emits instructions discarding all locals deeper than depth
+// without forgetting them, so it can be used for jumps out of scopes.
+func (c *compiler) popLocals(depth int) {
+	for i := len(c.locals) - 1; i >= 0 && c.locals[i].depth > depth; i-- {
+		if c.locals[i].captured {
+			c.emitOp(OpCloseUpvalue)
+		} else {
+			c.emitOp(OpPop)
+		}
+	}
+}
+
+func (c *compiler) addLocal(name *tokenObj) {
+	if len(c.locals) >= 256 {
+		c.error(name, codeTooManyLocals, "too many local variables in function")
+		return
+	}
+	c.locals = append(c.locals, local{name: name.lexeme, depth: c.depth})
+}
+
+// declareLocal makes the value on the top of the stack the local of the
+// name. The local of the name in the scope, declared before or reserved
+// by declareAhead, is assigned instead.
+func (c *compiler) declareLocal(name *tokenObj) {
+	if l := c.scopeLocal(name.lexeme); l != -1 {
+		c.locals[l].later = false
+		c.emit(byte(OpSetLocal), byte(l))
+		c.emitOp(OpPop)
+		return
+	}
+	c.addLocal(name)
+}
+
+// declareAhead reserves the slots of the locals of the block which
+// functions use before the locals are declared.
+func (c *compiler) declareAhead(list []Stmt) {
+	used := make(map[string]bool)     // by the functions so far
+	declared := make(map[string]bool) // by the block so far
+	for _, s := range list {
+		var name *tokenObj
+		switch s := s.(type) {
+		case *VarStmt:
+			// a function in the initializer runs once the variable is declared
+			funUses(s.init, used)
+			name = s.name
+		case *FunStmt:
+			name = s.name
+		}
+		if name != nil && used[name.lexeme] && !declared[name.lexeme] && c.scopeLocal(name.lexeme) == -1 {
+			c.emitIndex(OpUndeclared, c.constant(name, name.lexeme))
+			c.addLocal(name)
+			c.locals[len(c.locals)-1].later = true
+		}
+		if name != nil {
+			declared[name.lexeme] = true
+		}
+		funUses(s, used)
+	}
+}
+
+// funUses adds the names used in the functions of the node to used.
+func funUses(n interface{}, used map[string]bool) {
+	inspect(n, func(n interface{}) bool {
+		var body []Stmt
+		switch n := n.(type) {
+		case *FunExpr:
+			body = n.body
+		case *FunStmt:
+			body = n.body
+		default:
+			return true
+		}
+		inspectList(body, func(n interface{}) bool {
+			switch n := n.(type) {
+			case *AssignExpr:
+				used[n.name.lexeme] = true
+			case *VarExpr:
+				used[n.name.lexeme] = true
+			}
+			return true
+		})
+		return false
+	})
+}
+
+// scopeLocal returns the slot of the local of the name in the current
+// scope, -1 if none.
+func (c *compiler) scopeLocal(name string) int {
+	for i := len(c.locals) - 1; i >= 0 && c.locals[i].depth == c.depth; i-- {
+		if c.locals[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *compiler) resolveLocal(name string) int {
+	for i := len(c.locals) - 1; i >= 0; i-- {
+		if c.locals[i].name == name && !c.locals[i].later {
+			return i
+		}
+	}
+	return -1
+}
+
+// resolveCaptured is resolveLocal for the functions declared here, they
+// see the locals declared later too.
+func (c *compiler) resolveCaptured(name string) int {
+	for i := len(c.locals) - 1; i >= 0; i-- {
+		if c.locals[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *compiler) resolveUpvalue(t *tokenObj) int {
+	if c.enclosing == nil {
+		return -1
+	}
+	if l := c.enclosing.resolveCaptured(t.lexeme); l != -1 {
+		c.enclosing.locals[l].captured = true
+		return c.addUpvalue(t, byte(l), true)
+	}
+	if u := c.enclosing.resolveUpvalue(t); u != -1 {
+		return c.addUpvalue(t, byte(u), false)
+	}
+	return -1
+}
+
+func (c *compiler) addUpvalue(t *tokenObj, index byte, isLocal bool) int {
+	for i, u := range c.upvalues {
+		if u.index == index && u.isLocal == isLocal {
+			return i
+		}
+	}
+	if len(c.upvalues) >= 256 {
+		c.error(t, codeTooManyUpvalues, "too many closure variables in function")
+		return 0
+	}
+	c.upvalues = append(c.upvalues, upvalueRef{index, isLocal})
+	c.fn.upvalueCount++
+	return len(c.upvalues) - 1
+}
+
+// ---------------------------------------------------------
+// statements
+
+func (c *compiler) stmt(s Stmt) {
+	switch s := s.(type) {
+	case *BlockStmt:
+		c.beginScope()
+		c.declareAhead(s.list)
+		for _, st := range s.list {
+			c.stmt(st)
+		}
+		c.endScope()
+	case *BreakStmt:
+		c.at(s.keyword)
+		if len(c.loops) == 0 {
+			c.error(s.keyword, codeOutsideLoop, "expected inside the loop")
+			return
+		}
+		l := c.loops[len(c.loops)-1]
+		c.popLocals(l.depth)
+		l.breaks = append(l.breaks, c.emitJump(OpJump))
+	case *ContinueStmt:
+		c.at(s.keyword)
+		if len(c.loops) == 0 {
+			c.error(s.keyword, codeOutsideLoop, "expected inside the loop")
+			return
+		}
+		l := c.loops[len(c.loops)-1]
+		c.popLocals(l.depth)
+		c.emitLoop(s.keyword, l.start)
+	case *ExprStmt:
+		c.expr(s.expression)
+		c.emitOp(OpPop)
+	case *FunStmt:
+		c.at(s.name)
+		if l := c.scopeLocal(s.name.lexeme); c.depth > 0 && l != -1 {
+			c.locals[l].later = false
+			c.function(s.name, s.name.lexeme, s.params, s.body)
+			c.emit(byte(OpSetLocal), byte(l))
+			c.emitOp(OpPop)
+			return
+		}
+		if c.depth > 0 {
+			// declared before the body so that the function can call itself
+			c.addLocal(s.name)
+			c.function(s.name, s.name.lexeme, s.params, s.body)
+			return
+		}
+		c.function(s.name, s.name.lexeme, s.params, s.body)
+		c.emitIndex(OpDefineGlobal, c.constant(s.name, s.name.lexeme))
+	case *IfStmt:
+		c.expr(s.condition)
+		thenJump := c.emitJump(OpJumpIfFalse)
+		c.emitOp(OpPop)
+		c.stmt(s.block1)
+		elseJump := c.emitJump(OpJump)
+		c.patchJump(nil, thenJump)
+		c.emitOp(OpPop)
+		if s.block2 != nil {
+			c.stmt(s.block2)
+		}
+		c.patchJump(nil, elseJump)
+	case *PrintStmt:
+		c.expr(s.expression)
+		c.emitOp(OpPrint)
+	case *ReturnStmt:
+		c.at(s.keyword)
+		if call, ok := s.value.(*CallExpr); ok && c.enclosing != nil {
+			c.call(call, OpTailCall)
+		} else if s.value != nil {
+			c.expr(s.value)
+		} else {
+			c.emitOp(OpNil)
+		}
+		c.emitOp(OpReturn)
+	case *VarStmt:
+		c.at(s.name)
+		// initializer is compiled before the variable is declared, so it
+		// refers to the shadowed variable as in the interpreter
+		if s.init != nil {
+			c.expr(s.init)
+		} else {
+			c.emitIndex(OpUninit, c.constant(s.name, s.name.lexeme))
+		}
+		c.at(s.name)
+		if c.depth > 0 {
+			c.declareLocal(s.name)
+			return
+		}
+		c.emitIndex(OpDefineGlobal, c.constant(s.name, s.name.lexeme))
+	case *ForStmt:
+		c.beginScope()
+		if s.init != nil {
+			c.stmt(s.init)
+		}
+		start := len(c.chunk().code)
+		exit := -1
+		if s.condition != nil {
+			c.expr(s.condition)
+			exit = c.emitJump(OpJumpIfFalse)
+			c.emitOp(OpPop)
+		}
+		l := &loop{start: start, depth: c.depth}
+		if s.increment != nil {
+			// the increment follows the condition but runs after the body
+			body := c.emitJump(OpJump)
+			l.start = len(c.chunk().code)
+			c.expr(s.increment)
+			c.emitOp(OpPop)
+			c.emitLoop(nil, start)
+			c.patchJump(nil, body)
+		}
+		c.loops = append(c.loops, l)
+		c.stmt(s.body)
+		c.loops = c.loops[:len(c.loops)-1]
+		c.emitLoop(nil, l.start)
+		if exit >= 0 {
+			c.patchJump(nil, exit)
+			c.emitOp(OpPop)
+		}
+		for _, b := range l.breaks {
+			c.patchJump(nil, b)
+		}
+		c.endScope()
+	case *WhileStmt:
+		l := &loop{start: len(c.chunk().code), depth: c.depth}
+		c.expr(s.condition)
+		exit := c.emitJump(OpJumpIfFalse)
+		c.emitOp(OpPop)
+		c.loops = append(c.loops, l)
+		c.stmt(s.body)
+		c.loops = c.loops[:len(c.loops)-1]
+		c.emitLoop(nil, l.start)
+		c.patchJump(nil, exit)
+		c.emitOp(OpPop)
+		for _, b := range l.breaks {
+			c.patchJump(nil, b)
+		}
+	default:
+		panic(fmt.Sprintf("compile: unexpected statement %T", s))
+	}
+}
+
+// function compiles the body into a new function and emits the closure
+// creating it.
+func (c *compiler) function(t *tokenObj, name string, params []*tokenObj, body []Stmt) {
+	fc := &compiler{
+		enclosing: c,
+		fn:        &function{name: name, arity: len(params)},
+		errs:      c.errs,
+		line:      c.line,
+		depth:     1,
+	}
+	fc.locals = append(fc.locals, local{name: "", depth: 1})
+	for _, p := range params {
+		fc.fn.params = append(fc.fn.params, p.lexeme)
+		fc.addLocal(p)
+	}
+	fc.declareAhead(body)
+	for _, s := range body {
+		fc.stmt(s)
+	}
+	fc.emitReturn()
+
+	c.emitIndex(OpClosure, c.constant(t, fc.fn))
+	for _, u := range fc.upvalues {
+		if u.isLocal {
+			c.emit(1, u.index)
+		} else {
+			c.emit(0, u.index)
+		}
+	}
+}
+
+// ---------------------------------------------------------
+// expressions
+
+var binaryOps = map[token]opcode{
+	Plus:         OpAdd,
+	Minus:        OpSubtract,
+	Star:         OpMultiply,
+	Slash:        OpDivide,
+	Greater:      OpGreater,
+	GreaterEqual: OpGreaterEqual,
+	Less:         OpLess,
+	LessEqual:    OpLessEqual,
+	EqualEqual:   OpEqual,
+	BangEqual:    OpNotEqual,
+}
+
+func (c *compiler) expr(e Expr) {
+	switch e := e.(type) {
+	case *AssignExpr:
+		c.expr(e.value)
+		c.at(e.name)
+		c.setVariable(e.name)
+	case *BinaryExpr:
+		c.expr(e.left)
+		c.expr(e.right)
+		c.at(e.operator)
+		c.emitOp(binaryOps[e.operator.tok])
+	case *CallExpr:
+		c.call(e, OpCall)
+	case *FunExpr:
+		c.function(nil, "", e.params, e.body)
+	case *GroupingExpr:
+		c.expr(e.e)
+	case *LiteralExpr:
+		switch e.value {
+		case nil:
+			c.emitOp(OpNil)
+		case true:
+			c.emitOp(OpTrue)
+		case false:
+			c.emitOp(OpFalse)
+		default:
+			c.emitIndex(OpConstant, c.constant(nil, e.value))
+		}
+	case *LogicalExpr:
+		c.expr(e.left)
+		c.at(e.operator)
+		if e.operator.tok == Or {
+			elseJump := c.emitJump(OpJumpIfFalse)
+			endJump := c.emitJump(OpJump)
+			c.patchJump(e.operator, elseJump)
+			c.emitOp(OpPop)
+			c.expr(e.right)
+			c.patchJump(e.operator, endJump)
+		} else {
+			endJump := c.emitJump(OpJumpIfFalse)
+			c.emitOp(OpPop)
+			c.expr(e.right)
+			c.patchJump(e.operator, endJump)
+		}
+	case *UnaryExpr:
+		c.expr(e.right)
+		c.at(e.operator)
+		if e.operator.tok == Minus {
+			c.emitOp(OpNegate)
+		} else {
+			c.emitOp(OpNot)
+		}
+	case *VarExpr:
+		c.at(e.name)
+		c.getVariable(e.name)
+	default:
+		panic(fmt.Sprintf("compile: unexpected expression %T", e))
+	}
+}
+
+// call compiles the call, op is OpTailCall for calls in tail position.
+func (c *compiler) call(e *CallExpr, op opcode) {
+	c.expr(e.callee)
+	for _, a := range e.args {
+		c.expr(a)
+	}
+	c.at(e.paren)
+	c.emit(byte(op), byte(len(e.args)))
+}
+
+func (c *compiler) getVariable(name *tokenObj) {
+	if l := c.resolveLocal(name.lexeme); l != -1 {
+		c.emit(byte(OpGetLocal), byte(l))
+	} else if u := c.resolveUpvalue(name); u != -1 {
+		c.emit(byte(OpGetUpvalue), byte(u))
+	} else {
+		c.global(OpGetGlobal, name)
+	}
+}
+
+func (c *compiler) setVariable(name *tokenObj) {
+	if l := c.resolveLocal(name.lexeme); l != -1 {
+		c.emit(byte(OpSetLocal), byte(l))
+	} else if u := c.resolveUpvalue(name); u != -1 {
+		c.emit(byte(OpSetUpvalue), byte(u))
+	} else {
+		c.global(OpSetGlobal, name)
+	}
+}
+
+// global emits the access of the global name and keeps the locals visible
+// there, the tree backend suggests them too when the name is undefined.
+func (c *compiler) global(op opcode, name *tokenObj) {
+	var names []string
+	for cc := c; cc != nil; cc = cc.enclosing {
+		for _, l := range cc.locals {
+			if l.name != "" && !l.later {
+				names = append(names, l.name)
+			}
+		}
+	}
+	if len(names) > 0 {
+		if c.fn.scopes == nil {
+			c.fn.scopes = make(map[int][]string)
+		}
+		c.fn.scopes[len(c.chunk().code)] = names
+	}
+	c.emitIndex(op, c.constant(name, name.lexeme))
+}
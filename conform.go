@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Conformance runner for scripts annotated in the format of the tests of
+// Crafting Interpreters:
+//
+//	print 1; // expect: 1
+//	print nil + 1; // expect runtime error: operands must be two numbers or two strings
+//	print (; // Error at ';': expected expression
+//	// [line 3] Error at end: expected ';' after value
+//
+// The output of the script must be the expected lines in order, followed by
+// the runtime error. A script with expected errors must fail to compile with
+// exactly those errors.
+
+var (
+	expectOutput  = regexp.MustCompile(`// expect: ?(.*)$`)
+	expectRuntime = regexp.MustCompile(`// expect runtime error: (.+)$`)
+	expectError   = regexp.MustCompile(`// (\[line (\d+)\] )?Error((?: at (?:'.*'|end))?: .+)$`)
+)
+
+// expectedOutput returns the output the annotations of the source expect.
+func expectedOutput(source string) []string {
+	var output, errors []string
+	runtime := ""
+	for i, line := range strings.Split(source, "\n") {
+		if m := expectOutput.FindStringSubmatch(line); m != nil {
+			output = append(output, m[1])
+		} else if m := expectRuntime.FindStringSubmatch(line); m != nil {
+			d := Diagnostic{Phase: phaseRuntime, Span: Span{Line: i + 1}, Message: m[1]}
+			runtime = d.Error()
+		} else if m := expectError.FindStringSubmatch(line); m != nil {
+			at := fmt.Sprint(i + 1)
+			if m[2] != "" {
+				at = m[2]
+			}
+			errors = append(errors, "[line "+at+"] error"+m[3])
+		}
+	}
+	if len(errors) > 0 {
+		return errors
+	}
+	if runtime != "" {
+		output = append(output, runtime)
+	}
+	return output
+}
+
+const maxDiffs = 10 // reported for a run
+
+// conformance returns the differences between the output of the script run
+// with the backend and the expected one.
+func conformance(source, with string) []string {
+	want := expectedOutput(source)
+	out := runCaptured(source, with)
+	got := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if out == "" {
+		got = nil
+	}
+	var diffs []string
+	for i := 0; i < len(want) || i < len(got); i++ {
+		if len(diffs) == maxDiffs {
+			diffs = append(diffs, "...")
+			break
+		}
+		switch {
+		case i >= len(got):
+			diffs = append(diffs, fmt.Sprintf("missing %q", want[i]))
+		case i >= len(want):
+			diffs = append(diffs, fmt.Sprintf("unexpected %q", got[i]))
+		case want[i] != got[i]:
+			diffs = append(diffs, fmt.Sprintf("output line %v: got %q, want %q", i+1, got[i], want[i]))
+		}
+	}
+	return diffs
+}
+
+type conformResult struct {
+	file  string
+	diffs map[string][]string // by backend
+}
+
+// printConformance prints a table of the results by backend and the
+// differences of the failed runs. It returns the number of failed runs.
+func printConformance(w io.Writer, results []conformResult, backends []string) int {
+	width := len("file")
+	for _, r := range results {
+		if len(r.file) > width {
+			width = len(r.file)
+		}
+	}
+	fmt.Fprintf(w, "%-*v", width, "file")
+	for _, b := range backends {
+		fmt.Fprintf(w, "  %-4v", b)
+	}
+	fmt.Fprintln(w)
+	failed, passed := 0, 0
+	for _, r := range results {
+		fmt.Fprintf(w, "%-*v", width, r.file)
+		for _, b := range backends {
+			if len(r.diffs[b]) > 0 {
+				fmt.Fprint(w, "  FAIL")
+				failed++
+			} else {
+				fmt.Fprint(w, "  PASS")
+				passed++
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	for _, r := range results {
+		for _, b := range backends {
+			if len(r.diffs[b]) == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "\n%v (%v):\n", r.file, b)
+			for _, d := range r.diffs[b] {
+				fmt.Fprintf(w, "\t%v\n", d)
+			}
+		}
+	}
+	fmt.Fprintf(w, "\n%v passed, %v failed\n", passed, failed)
+	return failed
+}
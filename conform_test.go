@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// conformScripts returns the examples and the conformance scripts.
+func conformScripts(t *testing.T) []string {
+	t.Helper()
+	var files []string
+	for _, pattern := range []string{"examples/*.glx", "testdata/conform/*.glx"} {
+		m, err := filepath.Glob(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, m...)
+	}
+	if len(files) == 0 {
+		t.Fatal("no scripts found")
+	}
+	return files
+}
+
+// TestConformance runs the examples and the conformance scripts with both
+// backends, their output and errors must be the ones the // expect:
+// annotations of the scripts give.
+func TestConformance(t *testing.T) {
+	for _, file := range conformScripts(t) {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, with := range []string{"tree", "vm"} {
+			if diffs := conformance(string(data), with); len(diffs) > 0 {
+				t.Errorf("%v (%v):\n\t%v", file, with, strings.Join(diffs, "\n\t"))
+			}
+		}
+	}
+}
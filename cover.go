@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Coverage counts the executions of statements of the tree interpreter. A
+// line is covered when a statement starting on it ran; an if statement has
+// two branches, the else branch is taken without an else statement too.
+
+type coverage struct {
+	counts map[Stmt]int
+	files  []*coverFile
+}
+
+type coverFile struct {
+	path  string
+	lines []string // of the source
+	stmts []Stmt
+}
+
+type coverBranch struct {
+	line        int
+	ran         bool // the if statement
+	then, other int  // times the branches were taken
+}
+
+func newCoverage() *coverage {
+	return &coverage{counts: make(map[Stmt]int)}
+}
+
+// add registers the program of the file for the reports.
+func (c *coverage) add(path, source string, stmts []Stmt) {
+	c.files = append(c.files, &coverFile{path, strings.Split(source, "\n"), stmts})
+}
+
+func (c *coverage) stmt(s Stmt, env *Env) {
+	c.counts[s]++
+}
+
+func (c *coverage) enter(fn Callable, env *Env) {}
+
+func (c *coverage) leave(v value, returned bool) {}
+
+func (c *coverage) assign(name *tokenObj, v value, env *Env) {}
+
+// lineCounts returns the number of executions of the lines with
+// statements, the most of any statement starting on a line.
+func (c *coverage) lineCounts(f *coverFile) map[int]int {
+	lines := make(map[int]int)
+	inspectList(f.stmts, func(n interface{}) bool {
+		s, ok := n.(Stmt)
+		if _, block := n.(*BlockStmt); !ok || block {
+			return true
+		}
+		if t := startToken(s); t != nil {
+			if n, ok := lines[t.line]; !ok || c.counts[s] > n {
+				lines[t.line] = c.counts[s]
+			}
+		}
+		return true
+	})
+	return lines
+}
+
+func (c *coverage) branches(f *coverFile) []coverBranch {
+	var list []coverBranch
+	inspectList(f.stmts, func(n interface{}) bool {
+		s, ok := n.(*IfStmt)
+		if !ok || s.keyword == nil {
+			return true
+		}
+		b := coverBranch{line: s.keyword.line, ran: c.counts[s] > 0, then: c.counts[s.block1]}
+		if s.block2 != nil {
+			b.other = c.counts[s.block2]
+		} else {
+			b.other = c.counts[s] - b.then
+		}
+		list = append(list, b)
+		return true
+	})
+	return list
+}
+
+// summary returns the lines and branches covered of the file and their
+// numbers.
+func (c *coverage) summary(f *coverFile) (lines, nlines, branches, nbranches int) {
+	for _, n := range c.lineCounts(f) {
+		nlines++
+		if n > 0 {
+			lines++
+		}
+	}
+	for _, b := range c.branches(f) {
+		nbranches += 2
+		if b.then > 0 {
+			branches++
+		}
+		if b.other > 0 {
+			branches++
+		}
+	}
+	return
+}
+
+func percent(n, total int) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total))
+}
+
+// writeSummary writes the coverage of every file and the total.
+func (c *coverage) writeSummary(w io.Writer) {
+	var tl, tnl, tb, tnb int
+	for _, f := range c.files {
+		l, nl, b, nb := c.summary(f)
+		fmt.Fprintf(w, "%v\tlines %v (%v/%v)\tbranches %v (%v/%v)\n",
+			f.path, percent(l, nl), l, nl, percent(b, nb), b, nb)
+		tl, tnl, tb, tnb = tl+l, tnl+nl, tb+b, tnb+nb
+	}
+	if len(c.files) > 1 {
+		fmt.Fprintf(w, "total\tlines %v (%v/%v)\tbranches %v (%v/%v)\n",
+			percent(tl, tnl), tl, tnl, percent(tb, tnb), tb, tnb)
+	}
+}
+
+// writeAnnotated writes the sources with the number of executions before
+// every line with statements, ##### for those never run, and the branches
+// of if statements never taken.
+func (c *coverage) writeAnnotated(w io.Writer) {
+	for _, f := range c.files {
+		fmt.Fprintf(w, "%9v:%5v:%v\n", "-", 0, "Source:"+f.path)
+		counts := c.lineCounts(f)
+		missed := make(map[int][]string)
+		for _, b := range c.branches(f) {
+			if b.then == 0 {
+				missed[b.line] = append(missed[b.line], "then")
+			}
+			if b.other == 0 {
+				missed[b.line] = append(missed[b.line], "else")
+			}
+		}
+		for i, text := range f.lines {
+			if i == len(f.lines)-1 && text == "" {
+				break
+			}
+			count := "-"
+			if n, ok := counts[i+1]; ok {
+				count = fmt.Sprint(n)
+				if n == 0 {
+					count = "#####"
+				}
+			}
+			fmt.Fprintf(w, "%9v:%5v:%v\n", count, i+1, text)
+			if m := missed[i+1]; len(m) > 0 {
+				fmt.Fprintf(w, "%9v:%5v:  branch %v never taken\n", "-", i+1, strings.Join(m, " and "))
+			}
+		}
+	}
+}
+
+// writeHTML writes a page with the sources, the lines run are green and
+// the lines never run red, if statements with branches never taken yellow.
+func (c *coverage) writeHTML(w io.Writer) {
+	fmt.Fprint(w, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>glox coverage</title>
+<style>
+body { font-family: sans-serif; }
+pre { line-height: 1.3; }
+.run { background: #d9f2d9; }
+.missed { background: #f7d4d4; }
+.partial { background: #fbf0c2; }
+.n { color: #888; display: inline-block; width: 5em; text-align: right; margin-right: 1em; }
+</style>
+</head>
+<body>
+`)
+	for _, f := range c.files {
+		l, nl, b, nb := c.summary(f)
+		fmt.Fprintf(w, "<h2>%v</h2>\n<p>lines %v (%v/%v), branches %v (%v/%v)</p>\n<pre>",
+			html.EscapeString(f.path), percent(l, nl), l, nl, percent(b, nb), b, nb)
+		counts := c.lineCounts(f)
+		partial := make(map[int]bool)
+		for _, b := range c.branches(f) {
+			partial[b.line] = partial[b.line] || b.then == 0 || b.other == 0
+		}
+		for i, text := range f.lines {
+			if i == len(f.lines)-1 && text == "" {
+				break
+			}
+			class, count := "", ""
+			if n, ok := counts[i+1]; ok {
+				class, count = "run", fmt.Sprint(n)
+				if n == 0 {
+					class = "missed"
+				} else if partial[i+1] {
+					class = "partial"
+				}
+			}
+			fmt.Fprintf(w, "<span class=%q><span class=\"n\">%v %v</span>%v</span>\n",
+				class, i+1, count, html.EscapeString(text))
+		}
+		fmt.Fprint(w, "</pre>\n")
+	}
+	fmt.Fprint(w, "</body>\n</html>\n")
+}
+
+// writeLcov writes the coverage in the tracefile format of lcov.
+func (c *coverage) writeLcov(w io.Writer) {
+	for _, f := range c.files {
+		fmt.Fprintln(w, "TN:")
+		path, err := filepath.Abs(f.path)
+		if err != nil {
+			path = f.path
+		}
+		fmt.Fprintf(w, "SF:%v\n", path)
+		branches := c.branches(f)
+		hit := 0
+		for i, b := range branches {
+			for j, n := range []int{b.then, b.other} {
+				taken := "-"
+				if b.ran {
+					taken = fmt.Sprint(n)
+				}
+				if n > 0 {
+					hit++
+				}
+				fmt.Fprintf(w, "BRDA:%v,%v,%v,%v\n", b.line, i, j, taken)
+			}
+		}
+		fmt.Fprintf(w, "BRF:%v\nBRH:%v\n", 2*len(branches), hit)
+		counts := c.lineCounts(f)
+		hit = 0
+		for i := range f.lines {
+			if n, ok := counts[i+1]; ok {
+				fmt.Fprintf(w, "DA:%v,%v\n", i+1, n)
+				if n > 0 {
+					hit++
+				}
+			}
+		}
+		fmt.Fprintf(w, "LF:%v\nLH:%v\nend_of_record\n", len(counts), hit)
+	}
+}
+
+// writeCoverage writes the report in the format to the file, or to stdout
+// without a file.
+func writeCoverage(c *coverage, format, file string) error {
+	var w io.Writer = os.Stdout
+	if file != "" {
+		f, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	switch format {
+	case "text":
+		c.writeSummary(w)
+	case "annotate":
+		c.writeAnnotated(w)
+	case "html":
+		c.writeHTML(w)
+	case "lcov":
+		c.writeLcov(w)
+	default:
+		return fmt.Errorf("unknown coverage format %q", format)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const coverSource = `fun sign(n) {
+  if (n < 0) {
+    return -1;
+  } else {
+    return 1;
+  }
+}
+for (var i = -1; i < 2; i = i + 1)
+  print sign(i);
+if (false)
+  print "never";
+`
+
+// runCoverage runs the source with the coverage counted and drops what
+// it prints.
+func runCoverage(t *testing.T, path, source string) *coverage {
+	t.Helper()
+	stmts, errs := parseProgram(source)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	cov := newCoverage()
+	cov.add(path, source, stmts)
+	saved := stdout
+	stdout, hook = &bytes.Buffer{}, cov
+	defer func() { stdout, hook = saved, nil }()
+	if err := interpret(stmts, NewEnv(nil)); err != nil {
+		t.Fatal(err)
+	}
+	return cov
+}
+
+// TestCoverCounts checks the executions of lines and the branches taken,
+// both branches of the if in sign are taken and only the else branch of
+// the last one.
+func TestCoverCounts(t *testing.T) {
+	cov := runCoverage(t, "sign.glx", coverSource)
+	f := cov.files[0]
+	lines := map[int]int{1: 1, 2: 3, 3: 1, 5: 2, 8: 1, 9: 3, 10: 1, 11: 0}
+	if got := cov.lineCounts(f); !reflect.DeepEqual(got, lines) {
+		t.Errorf("line counts %v, want %v", got, lines)
+	}
+	branches := []coverBranch{{2, true, 1, 2}, {10, true, 0, 1}}
+	if got := cov.branches(f); !reflect.DeepEqual(got, branches) {
+		t.Errorf("branches %v, want %v", got, branches)
+	}
+}
+
+// TestCoverReports compares the text, annotate and lcov reports.
+func TestCoverReports(t *testing.T) {
+	path, err := filepath.Abs("sign.glx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cov := runCoverage(t, "sign.glx", coverSource)
+	tests := []struct {
+		format string
+		write  func(w io.Writer)
+		want   string
+	}{
+		{"text", cov.writeSummary, "sign.glx\tlines 87.5% (7/8)\tbranches 75.0% (3/4)\n"},
+		{"annotate", cov.writeAnnotated, `        -:    0:Source:sign.glx
+        1:    1:fun sign(n) {
+        3:    2:  if (n < 0) {
+        1:    3:    return -1;
+        -:    4:  } else {
+        2:    5:    return 1;
+        -:    6:  }
+        -:    7:}
+        1:    8:for (var i = -1; i < 2; i = i + 1)
+        3:    9:  print sign(i);
+        1:   10:if (false)
+        -:   10:  branch then never taken
+    #####:   11:  print "never";
+`},
+		{"lcov", cov.writeLcov, "TN:\nSF:" + path + `
+BRDA:2,0,0,1
+BRDA:2,0,1,2
+BRDA:10,1,0,0
+BRDA:10,1,1,1
+BRF:4
+BRH:3
+DA:1,1
+DA:2,3
+DA:3,1
+DA:5,2
+DA:8,1
+DA:9,3
+DA:10,1
+DA:11,0
+LF:8
+LH:7
+end_of_record
+`},
+	}
+	for _, tt := range tests {
+		var got bytes.Buffer
+		tt.write(&got)
+		if got.String() != tt.want {
+			t.Errorf("%v report:\n%swant\n%s", tt.format, &got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Concrete syntax tree keeps every token of the source with its trivia, so
+// the source is reproduced exactly. Its nodes are those of the AST.
+
+type cstNode struct {
+	node     interface{}   // Expr or Stmt, nil for the program
+	children []interface{} // *tokenObj or *cstNode in the order of the source
+}
+
+// parseCST scans in the trivia mode and parses the source keeping tokens.
+func parseCST(source string) (*cstNode, []error) {
+	s := NewScanner(source)
+	s.keepTrivia = true
+	tokens, errs := s.scan()
+	p := NewParser(tokens)
+	p.ends = make(map[interface{}]int)
+	stmts, perrs := p.parse()
+	if errs = syntaxErrors(errs, perrs); len(errs) > 0 {
+		return nil, errs
+	}
+	b := &cstBuilder{tokens: tokens, ends: p.ends, index: make(map[*tokenObj]int)}
+	for i, t := range tokens {
+		b.index[t] = i
+	}
+	list := make([]interface{}, 0, len(stmts))
+	for _, s := range stmts {
+		list = append(list, s)
+	}
+	return b.build(nil, list, 0, len(tokens)), nil
+}
+
+type cstBuilder struct {
+	tokens []*tokenObj
+	ends   map[interface{}]int
+	index  map[*tokenObj]int
+}
+
+// build returns the node of the tokens from start to end, where the
+// children take their own tokens.
+func (b *cstBuilder) build(n interface{}, children []interface{}, start, end int) *cstNode {
+	sort.SliceStable(children, func(i, j int) bool {
+		return b.index[startToken(children[i])] < b.index[startToken(children[j])]
+	})
+	res := &cstNode{node: n}
+	i := start
+	for _, c := range children {
+		cstart, cend := b.index[startToken(c)], b.ends[c]
+		for ; i < cstart; i++ {
+			res.children = append(res.children, b.tokens[i])
+		}
+		res.children = append(res.children, b.build(c, astChildren(c), cstart, cend))
+		i = cend
+	}
+	for ; i < end; i++ {
+		res.children = append(res.children, b.tokens[i])
+	}
+	return res
+}
+
+// astChildren returns the nodes directly below the node n.
+func astChildren(n interface{}) []interface{} {
+	var list []interface{}
+	inspect(n, func(c interface{}) bool {
+		if c == n {
+			return true
+		}
+		list = append(list, c)
+		return false
+	})
+	return list
+}
+
+// text writes the source of the node.
+func (n *cstNode) text(w io.Writer) {
+	for _, c := range n.children {
+		switch c := c.(type) {
+		case *tokenObj:
+			writeTrivia(w, c.leading)
+			io.WriteString(w, c.lexeme)
+			writeTrivia(w, c.trailing)
+		case *cstNode:
+			c.text(w)
+		}
+	}
+}
+
+func writeTrivia(w io.Writer, list []trivia) {
+	for _, t := range list {
+		io.WriteString(w, t.text)
+	}
+}
+
+// dump writes the tree with a node or a token per line.
+func (n *cstNode) dump(w io.Writer, level int) {
+	indent := strings.Repeat("  ", level)
+	if n.node == nil {
+		fmt.Fprintf(w, "%vProgram\n", indent)
+	} else {
+		t := startToken(n.node)
+		fmt.Fprintf(w, "%v%v %v:%v", indent, strings.TrimPrefix(fmt.Sprintf("%T", n.node), "*main."), t.line, t.col)
+		if doc := docComment(t); doc != "" {
+			fmt.Fprintf(w, " doc %q", doc)
+		}
+		fmt.Fprintln(w)
+	}
+	for _, c := range n.children {
+		switch c := c.(type) {
+		case *tokenObj:
+			fmt.Fprintf(w, "%v  %v %q", indent, c.tok, c.lexeme)
+			if len(c.leading) > 0 {
+				fmt.Fprintf(w, " leading %q", triviaText(c.leading))
+			}
+			if len(c.trailing) > 0 {
+				fmt.Fprintf(w, " trailing %q", triviaText(c.trailing))
+			}
+			fmt.Fprintln(w)
+		case *cstNode:
+			c.dump(w, level+1)
+		}
+	}
+}
+
+func triviaText(list []trivia) string {
+	var b strings.Builder
+	writeTrivia(&b, list)
+	return b.String()
+}
+
+// docComment returns the text of the comments on the lines right above the
+// token, which must have been scanned in the trivia mode.
+func docComment(t *tokenObj) string {
+	var lines []string
+	newlines := 0
+	for i := len(t.leading) - 1; i >= 0; i-- {
+		switch tr := t.leading[i]; tr.kind {
+		case triviaNewline:
+			if newlines++; newlines > 1 {
+				// a blank line ends the comment
+				return strings.Join(lines, "\n")
+			}
+		case triviaComment:
+			if strings.HasPrefix(tr.text, "#!") {
+				return strings.Join(lines, "\n")
+			}
+			newlines = 0
+			lines = append([]string{commentText(tr.text)}, lines...)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// commentText strips the comment markers.
+func commentText(c string) string {
+	if strings.HasPrefix(c, "//") {
+		return strings.TrimSpace(strings.TrimPrefix(c, "//"))
+	}
+	c = strings.TrimSuffix(strings.TrimPrefix(c, "/*"), "*/")
+	return strings.TrimSpace(c)
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Debug adapter speaking DAP over a pair of streams. The program runs in
+// the goroutine of the server: while it is stopped the debugger reads the
+// requests, so the state of the interpreter is only touched between
+// statements.
+
+type dapServer struct {
+	in   *bufio.Reader
+	out  io.Writer
+	seq  int
+	path string // of the program
+
+	stmts      []Stmt
+	d          *debugger
+	start      bool // configurationDone, the program runs
+	entry      bool // the first stop is the entry
+	stopped    bool
+	resumed    bool
+	terminated bool
+	scopes     []*Env // of variablesReference - 1, valid while stopped
+}
+
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type dapError string
+
+func (e dapError) Error() string {
+	return string(e)
+}
+
+type dapSource struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+type dapFrame struct {
+	ID     int       `json:"id"`
+	Name   string    `json:"name"`
+	Source dapSource `json:"source"`
+	Line   int       `json:"line"`
+	Column int       `json:"column"`
+}
+
+type dapScope struct {
+	Name               string `json:"name"`
+	VariablesReference int    `json:"variablesReference"`
+	Expensive          bool   `json:"expensive"`
+}
+
+type dapVariable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+// dapThread is the only thread of a program.
+const dapThread = 1
+
+// serveDAP answers the requests read from in until the disconnect request
+// or the end of in. It returns the exit code.
+func serveDAP(in io.Reader, out io.Writer) int {
+	s := &dapServer{in: bufio.NewReader(in), out: out}
+	for !s.terminated {
+		req, ok := s.read()
+		if !ok {
+			break
+		}
+		s.serve(req)
+		if s.start {
+			s.start = false
+			s.run()
+		}
+	}
+	return exitOK
+}
+
+func (s *dapServer) read() (*dapRequest, bool) {
+	data, err := readMessage(s.in)
+	if err != nil {
+		if err != io.EOF {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return nil, false
+	}
+	var req dapRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		s.event("output", map[string]string{"category": "stderr", "output": err.Error() + "\n"})
+		return &dapRequest{}, true
+	}
+	return &req, true
+}
+
+func (s *dapServer) send(m map[string]interface{}) {
+	s.seq++
+	m["seq"] = s.seq
+	writeMessage(s.out, m)
+}
+
+func (s *dapServer) event(name string, body interface{}) {
+	m := map[string]interface{}{"type": "event", "event": name}
+	if body != nil {
+		m["body"] = body
+	}
+	s.send(m)
+}
+
+// serve handles the request and sends the response.
+func (s *dapServer) serve(req *dapRequest) {
+	body, err := s.handle(req.Command, req.Arguments)
+	m := map[string]interface{}{
+		"type":        "response",
+		"request_seq": req.Seq,
+		"command":     req.Command,
+		"success":     err == nil,
+	}
+	if err != nil {
+		m["message"] = err.Error()
+	} else if body != nil {
+		m["body"] = body
+	}
+	s.send(m)
+	if req.Command == "initialize" && err == nil {
+		s.event("initialized", nil)
+	}
+}
+
+func (s *dapServer) handle(command string, args json.RawMessage) (interface{}, error) {
+	switch command {
+	case "initialize":
+		return map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsEvaluateForHovers":        true,
+		}, nil
+	case "launch":
+		var p struct {
+			Program     string   `json:"program"`
+			Args        []string `json:"args"`
+			StopOnEntry bool     `json:"stopOnEntry"`
+		}
+		if err := json.Unmarshal(args, &p); err != nil {
+			return nil, err
+		}
+		return nil, s.launch(p.Program, p.Args, p.StopOnEntry)
+	case "setBreakpoints":
+		var p struct {
+			Source      dapSource `json:"source"`
+			Breakpoints []struct {
+				Line int `json:"line"`
+			} `json:"breakpoints"`
+		}
+		if err := json.Unmarshal(args, &p); err != nil {
+			return nil, err
+		}
+		if s.d == nil {
+			return nil, dapError("no program launched")
+		}
+		s.d.breakpoints = make(map[int]bool)
+		list := make([]map[string]interface{}, 0, len(p.Breakpoints))
+		for _, b := range p.Breakpoints {
+			line := s.d.setBreakpoint(b.Line)
+			if line == 0 {
+				list = append(list, map[string]interface{}{"verified": false, "line": b.Line})
+			} else {
+				list = append(list, map[string]interface{}{"verified": true, "line": line})
+			}
+		}
+		return map[string]interface{}{"breakpoints": list}, nil
+	case "setExceptionBreakpoints":
+		return nil, nil
+	case "configurationDone":
+		if s.d == nil {
+			return nil, dapError("no program launched")
+		}
+		s.start = true
+		return nil, nil
+	case "threads":
+		return map[string]interface{}{
+			"threads": []map[string]interface{}{{"id": dapThread, "name": "main"}},
+		}, nil
+	case "disconnect", "terminate":
+		s.terminated = true
+		return nil, nil
+	}
+	if !s.stopped {
+		return nil, dapError(command + ": the program is not stopped")
+	}
+	switch command {
+	case "continue":
+		s.resume(stepNone)
+		return map[string]bool{"allThreadsContinued": true}, nil
+	case "next":
+		s.resume(stepOver)
+		return nil, nil
+	case "stepIn":
+		s.resume(stepInto)
+		return nil, nil
+	case "stepOut":
+		s.resume(stepOut)
+		return nil, nil
+	case "stackTrace":
+		frames := make([]dapFrame, 0, len(s.d.frames))
+		for i := range s.d.frames {
+			f := s.d.frame(i)
+			frames = append(frames, dapFrame{
+				ID:     i + 1,
+				Name:   f.name,
+				Source: dapSource{filepath.Base(s.path), s.path},
+				Line:   f.line,
+				Column: 1,
+			})
+		}
+		return map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)}, nil
+	case "scopes":
+		var p struct {
+			FrameID int `json:"frameId"`
+		}
+		if err := json.Unmarshal(args, &p); err != nil {
+			return nil, err
+		}
+		f, err := s.frame(p.FrameID)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"scopes": s.frameScopes(f)}, nil
+	case "variables":
+		var p struct {
+			VariablesReference int `json:"variablesReference"`
+		}
+		if err := json.Unmarshal(args, &p); err != nil {
+			return nil, err
+		}
+		if p.VariablesReference < 1 || p.VariablesReference > len(s.scopes) {
+			return nil, dapError(fmt.Sprintf("unknown variablesReference %v", p.VariablesReference))
+		}
+		vars := make([]dapVariable, 0)
+		for _, v := range variables(s.scopes[p.VariablesReference-1]) {
+			vars = append(vars, dapVariable{v.name, v.value, 0})
+		}
+		return map[string]interface{}{"variables": vars}, nil
+	case "evaluate":
+		var p struct {
+			Expression string `json:"expression"`
+			FrameID    int    `json:"frameId"`
+		}
+		if err := json.Unmarshal(args, &p); err != nil {
+			return nil, err
+		}
+		f := s.d.frame(0)
+		if p.FrameID != 0 {
+			var err error
+			if f, err = s.frame(p.FrameID); err != nil {
+				return nil, err
+			}
+		}
+		v, err := s.d.eval(p.Expression, f.env)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"result": literalString(v), "variablesReference": 0}, nil
+	}
+	return nil, dapError("unsupported request " + command)
+}
+
+func (s *dapServer) launch(path string, args []string, stopOnEntry bool) error {
+	if s.d != nil {
+		return dapError("the program is already launched")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	stmts, errs := parseProgram(string(data))
+	if len(errs) > 0 {
+		msg := make([]string, 0, len(errs))
+		for _, e := range errs {
+			msg = append(msg, e.Error())
+		}
+		return dapError(strings.Join(msg, "\n"))
+	}
+	s.path, s.stmts = path, stmts
+	scriptArgs = args
+	s.d = newDebugger(stmts, NewEnv(nil))
+	s.d.stop = s.stop
+	s.entry = stopOnEntry
+	if !stopOnEntry {
+		s.d.mode = stepNone
+	}
+	return nil
+}
+
+// run runs the program to its end or until the client disconnects.
+func (s *dapServer) run() {
+	saved := stdout
+	stdout = dapOutput{s}
+	hook = s.d
+	defer func() {
+		stdout = saved
+		hook = nil
+	}()
+	reportRuntime(s.path, interpret(s.stmts, s.d.frames[0].env))
+	if s.terminated {
+		return
+	}
+	s.event("exited", map[string]int{"exitCode": exitCode()})
+	s.event("terminated", nil)
+}
+
+// stop reports the stop to the client and serves the requests until the
+// program resumes.
+func (s *dapServer) stop(reason string) {
+	if s.entry {
+		reason, s.entry = "entry", false
+	}
+	s.stopped, s.resumed, s.scopes = true, false, nil
+	s.event("stopped", map[string]interface{}{
+		"reason":            reason,
+		"threadId":          dapThread,
+		"allThreadsStopped": true,
+	})
+	for !s.resumed {
+		req, ok := s.read()
+		if !ok {
+			s.terminated = true
+		} else {
+			s.serve(req)
+		}
+		if s.terminated {
+			hook = nil
+			panic(ExitError(exitOK))
+		}
+	}
+	s.stopped = false
+}
+
+func (s *dapServer) resume(mode stepMode) {
+	s.d.resume(mode)
+	s.resumed = true
+}
+
+func (s *dapServer) frame(id int) (*frame, error) {
+	if id < 1 || id > len(s.d.frames) {
+		return nil, dapError(fmt.Sprintf("unknown frame %v", id))
+	}
+	return s.d.frame(id - 1), nil
+}
+
+// frameScopes returns a scope for every environment of the frame, from the
+// innermost to the globals. Empty enclosing environments are left out.
+func (s *dapServer) frameScopes(f *frame) []dapScope {
+	list := make([]dapScope, 0)
+	for env := f.env; env != nil; env = env.enclosing {
+		name := "Locals"
+		switch {
+		case env == env.globals:
+			name = "Globals"
+		case len(list) > 0 && len(env.values) == 0:
+			continue
+		case len(list) > 0:
+			name = fmt.Sprintf("Enclosing %v", len(list))
+		}
+		s.scopes = append(s.scopes, env)
+		list = append(list, dapScope{name, len(s.scopes), env == env.globals})
+	}
+	return list
+}
+
+// dapOutput sends what the program prints as output events.
+type dapOutput struct {
+	s *dapServer
+}
+
+func (o dapOutput) Write(p []byte) (int, error) {
+	o.s.event("output", map[string]string{"category": "stdout", "output": string(p)})
+	return len(p), nil
+}
+
+// replayDAP runs the adapter on the requests of the script, one JSON
+// object per line, and prints every message of the adapter on its own
+// line. The seq and type of requests are filled in when missing.
+func replayDAP(script io.Reader, w io.Writer) int {
+	var in bytes.Buffer
+	sc := bufio.NewScanner(script)
+	sc.Buffer(nil, 1<<24)
+	for seq := 1; sc.Scan(); {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", line, err)
+			return exitData
+		}
+		if _, ok := m["seq"]; !ok {
+			m["seq"] = seq
+		}
+		if _, ok := m["type"]; !ok {
+			m["type"] = "request"
+		}
+		seq++
+		writeMessage(&in, m)
+	}
+	if err := sc.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitNoInput
+	}
+	var out bytes.Buffer
+	code := serveDAP(&in, &out)
+	r := bufio.NewReader(&out)
+	for {
+		data, err := readMessage(r)
+		if err != nil {
+			break
+		}
+		fmt.Fprintf(w, "%s\n", data)
+	}
+	return code
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// dapClient talks to serveDAP.
+type dapClient struct {
+	*pipeClient
+	seq    int
+	events []dapReply // read while waiting for a response
+}
+
+func newDAPClient(t *testing.T) *dapClient {
+	return &dapClient{pipeClient: newPipeClient(t, serveDAP)}
+}
+
+type dapReply struct {
+	Type       string          `json:"type"`
+	Event      string          `json:"event"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message"`
+	Body       json.RawMessage `json:"body"`
+}
+
+func (c *dapClient) read() dapReply {
+	c.t.Helper()
+	var m dapReply
+	c.readJSON(&m)
+	return m
+}
+
+// call sends the request and decodes the body of its response into v,
+// events sent before it are kept for wait.
+func (c *dapClient) call(command string, args interface{}, v interface{}) {
+	c.t.Helper()
+	c.seq++
+	writeMessage(c.w, map[string]interface{}{"seq": c.seq, "type": "request", "command": command, "arguments": args})
+	for {
+		m := c.read()
+		if m.Type == "event" {
+			c.events = append(c.events, m)
+			continue
+		}
+		if m.RequestSeq != c.seq {
+			continue
+		}
+		if !m.Success {
+			c.t.Fatalf("%v: %v", command, m.Message)
+		}
+		if v != nil {
+			if err := json.Unmarshal(m.Body, v); err != nil {
+				c.t.Fatal(err)
+			}
+		}
+		return
+	}
+}
+
+// wait returns the body of the next event with the name, the events before
+// it are dropped.
+func (c *dapClient) wait(name string) json.RawMessage {
+	c.t.Helper()
+	for {
+		var m dapReply
+		if len(c.events) > 0 {
+			m, c.events = c.events[0], c.events[1:]
+		} else {
+			m = c.read()
+		}
+		if m.Type == "event" && m.Event == name {
+			return m.Body
+		}
+	}
+}
+
+// stopped waits for the program to stop and checks the reason, the name of
+// the innermost frame and its line.
+func (c *dapClient) stopped(reason, name string, line int) {
+	c.t.Helper()
+	var ev struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(c.wait("stopped"), &ev); err != nil {
+		c.t.Fatal(err)
+	}
+	var st struct {
+		StackFrames []dapFrame `json:"stackFrames"`
+	}
+	c.call("stackTrace", map[string]int{"threadId": dapThread}, &st)
+	if len(st.StackFrames) == 0 {
+		c.t.Fatal("no stack frames")
+	}
+	f := st.StackFrames[0]
+	if ev.Reason != reason || f.Name != name || f.Line != line {
+		c.t.Errorf("stopped for %v in %v at line %v, want %v in %v at line %v", ev.Reason, f.Name, f.Line, reason, name, line)
+	}
+}
+
+// variables returns the values of the variables of the scope of the
+// innermost frame.
+func (c *dapClient) variables(scope string) map[string]string {
+	c.t.Helper()
+	var sc struct {
+		Scopes []dapScope `json:"scopes"`
+	}
+	c.call("scopes", map[string]int{"frameId": 1}, &sc)
+	for _, s := range sc.Scopes {
+		if s.Name != scope {
+			continue
+		}
+		var vs struct {
+			Variables []dapVariable `json:"variables"`
+		}
+		c.call("variables", map[string]int{"variablesReference": s.VariablesReference}, &vs)
+		values := make(map[string]string)
+		for _, v := range vs.Variables {
+			values[v.Name] = v.Value
+		}
+		return values
+	}
+	c.t.Fatalf("no scope %v in %+v", scope, sc.Scopes)
+	return nil
+}
+
+const dapScript = `fun add(a, b) {
+  var sum = a + b;
+  sum = sum + 0;
+  return sum;
+}
+var x = 1;
+var y = add(x, 2);
+var z = add(y, 1);
+print z;
+`
+
+func TestDAP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.glx")
+	if err := os.WriteFile(path, []byte(dapScript), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newDAPClient(t)
+	c.call("initialize", map[string]string{"adapterID": "glox"}, nil)
+	c.wait("initialized")
+	c.call("launch", map[string]interface{}{"program": path}, nil)
+	var bp struct {
+		Breakpoints []struct {
+			Verified bool `json:"verified"`
+			Line     int  `json:"line"`
+		} `json:"breakpoints"`
+	}
+	c.call("setBreakpoints", map[string]interface{}{
+		"source":      map[string]string{"path": path},
+		"breakpoints": []map[string]int{{"line": 5}},
+	}, &bp)
+	if len(bp.Breakpoints) != 1 || !bp.Breakpoints[0].Verified || bp.Breakpoints[0].Line != 6 {
+		t.Errorf("breakpoints %+v, want one moved to line 6", bp.Breakpoints)
+	}
+	c.call("configurationDone", nil, nil)
+	c.stopped("breakpoint", "<script>", 6)
+	c.call("next", map[string]int{"threadId": dapThread}, nil)
+	c.stopped("step", "<script>", 7)
+	if v := c.variables("Globals"); v["x"] != "1" {
+		t.Errorf("globals %v, want x = 1", v)
+	}
+
+	c.call("stepIn", map[string]int{"threadId": dapThread}, nil)
+	c.stopped("step", "add", 2)
+	c.call("next", map[string]int{"threadId": dapThread}, nil)
+	c.stopped("step", "add", 3)
+	if v := c.variables("Locals"); v["a"] != "1" || v["b"] != "2" || v["sum"] != "3" {
+		t.Errorf("locals %v, want a = 1, b = 2, sum = 3", v)
+	}
+
+	c.call("stepOut", map[string]int{"threadId": dapThread}, nil)
+	c.stopped("step", "<script>", 8)
+	if v := c.variables("Globals"); v["y"] != "3" {
+		t.Errorf("globals %v, want y = 3", v)
+	}
+	c.call("next", map[string]int{"threadId": dapThread}, nil)
+	c.stopped("step", "<script>", 9)
+	if v := c.variables("Globals"); v["z"] != "4" {
+		t.Errorf("globals %v, want z = 4", v)
+	}
+
+	c.call("continue", map[string]int{"threadId": dapThread}, nil)
+	var out struct {
+		Output string `json:"output"`
+	}
+	if err := json.Unmarshal(c.wait("output"), &out); err != nil || out.Output != "4\n" {
+		t.Errorf("output %q, %v", out.Output, err)
+	}
+	c.wait("terminated")
+	c.call("disconnect", nil, nil)
+	c.w.Close()
+	if code := <-c.code; code != exitOK {
+		t.Errorf("exit code %v", code)
+	}
+}
+
+func TestReplayDAP(t *testing.T) {
+	script := `{"command": "initialize"}
+# comments and blank lines are skipped
+
+{"command": "threads"}
+{"command": "disconnect"}
+`
+	var out strings.Builder
+	if code := replayDAP(strings.NewReader(script), &out); code != exitOK {
+		t.Errorf("exit code %v", code)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	want := []string{`"command":"initialize"`, `"event":"initialized"`, `"command":"threads"`, `"command":"disconnect"`}
+	if len(lines) != len(want) {
+		t.Fatalf("got %v messages, want %v:\n%v", len(lines), len(want), out.String())
+	}
+	for i, w := range want {
+		if !strings.Contains(lines[i], w) {
+			t.Errorf("message %v is %v, want %v", i+1, lines[i], w)
+		}
+	}
+	if !strings.Contains(lines[2], `"request_seq":2`) {
+		t.Errorf("the seq of the requests is not filled in: %v", lines[2])
+	}
+}
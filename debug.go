@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Debugger stops the tree interpreter at breakpoints and after steps. It is
+// the exec hook while a program is debugged, a front end decides what to do
+// when the program stops: the terminal below or the DAP server.
+
+type stepMode int
+
+const (
+	stepNone stepMode = iota // run to a breakpoint
+	stepInto
+	stepOver
+	stepOut
+)
+
+type frame struct {
+	name string
+	env  *Env // scope of the current statement
+	line int
+}
+
+type debugger struct {
+	lines       map[int]bool // lines where statements start
+	breakpoints map[int]bool
+	frames      []*frame // the innermost last
+	mode        stepMode
+	depth       int // number of frames when the step started
+
+	// the last statement executed, a line is stopped at once in a row
+	prevLine, prevDepth int
+
+	// stop is called when the program stops and returns when it resumes
+	stop func(reason string)
+}
+
+func newDebugger(stmts []Stmt, globals *Env) *debugger {
+	d := &debugger{
+		lines:       make(map[int]bool),
+		breakpoints: make(map[int]bool),
+		frames:      []*frame{{name: "<script>", env: globals}},
+		mode:        stepInto,
+	}
+	inspectList(stmts, func(n interface{}) bool {
+		if _, ok := n.(*BlockStmt); ok {
+			return true
+		}
+		if s, ok := n.(Stmt); ok {
+			if t := startToken(s); t != nil {
+				d.lines[t.line] = true
+			}
+		}
+		return true
+	})
+	return d
+}
+
+func (d *debugger) stmt(s Stmt, env *Env) {
+	f := d.frames[len(d.frames)-1]
+	f.env = env
+	t := startToken(s)
+	if t == nil {
+		return
+	}
+	line, depth := t.line, len(d.frames)
+	fresh := line != d.prevLine || depth != d.prevDepth
+	d.prevLine, d.prevDepth = line, depth
+	if _, ok := s.(*BlockStmt); ok {
+		return
+	}
+	f.line = line
+	if !fresh {
+		return
+	}
+	reason := ""
+	switch {
+	case d.breakpoints[line]:
+		reason = "breakpoint"
+	case d.mode == stepInto,
+		d.mode == stepOver && depth <= d.depth,
+		d.mode == stepOut && depth < d.depth:
+		reason = "step"
+	}
+	if reason != "" {
+		d.mode = stepNone
+		d.stop(reason)
+	}
+}
+
+func (d *debugger) enter(fn Callable, env *Env) {
+	d.frames = append(d.frames, &frame{name: funName(fn), env: env})
+}
+
+func (d *debugger) leave(v value, returned bool) {
+	d.frames = d.frames[:len(d.frames)-1]
+}
+
+func (d *debugger) assign(name *tokenObj, v value, env *Env) {}
+
+// resume continues the stopped program in the mode.
+func (d *debugger) resume(mode stepMode) {
+	d.mode = mode
+	d.depth = len(d.frames)
+}
+
+// setBreakpoint sets a breakpoint on the first line with a statement from
+// the line on and returns it, or 0 when there is none.
+func (d *debugger) setBreakpoint(line int) int {
+	max := 0
+	for l := range d.lines {
+		if l > max {
+			max = l
+		}
+	}
+	for ; line <= max; line++ {
+		if d.lines[line] {
+			d.breakpoints[line] = true
+			return line
+		}
+	}
+	return 0
+}
+
+// frame returns the frame n levels above the innermost one.
+func (d *debugger) frame(n int) *frame {
+	return d.frames[len(d.frames)-1-n]
+}
+
+func funName(fn Callable) string {
+	switch f := fn.(type) {
+	case *FunObj:
+		return f.decl.name.lexeme
+	case *FunAnon:
+		return "<lambda>"
+	}
+	return fmt.Sprint(fn)
+}
+
+// eval evaluates the expression in the environment, without stopping in
+// the functions it calls.
+func (d *debugger) eval(source string, env *Env) (v value, err error) {
+	tokens, errs := NewScanner(source).scan()
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	p := NewParser(tokens)
+	var e Expr
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				_ = r.(ParsingError)
+			}
+		}()
+		e = p.expression()
+		if !p.atEnd() {
+			p.perror(p.peek(), codeMissingToken, "expected end of expression")
+		}
+	}()
+	if len(p.errs) > 0 {
+		return nil, p.errs[0]
+	}
+
+	saved := hook
+	hook = nil
+	defer func() {
+		hook = saved
+		if r := recover(); r != nil {
+			rerr, ok := r.(RuntimeError)
+			if !ok {
+				panic(r)
+			}
+			err = rerr
+		}
+	}()
+	return e.eval(env), nil
+}
+
+type variable struct {
+	name  string
+	value string
+}
+
+// variables returns the variables defined in the environment itself,
+// sorted by name. Natives are left out.
+func variables(env *Env) []variable {
+	var list []variable
+	for name, v := range env.values {
+		if _, ok := v.(*nativeFn); ok {
+			continue
+		}
+		s := "<uninitialized>"
+		if env.init[name] {
+			s = literalString(v)
+		}
+		list = append(list, variable{name, s})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].name < list[j].name
+	})
+	return list
+}
+
+// debugScript runs the program stopping at its first statement for the
+// commands read from in.
+func debugScript(stmts []Stmt, source string, in io.Reader, out io.Writer) error {
+	globals := NewEnv(nil)
+	t := &debugTerm{
+		d:   newDebugger(stmts, globals),
+		in:  bufio.NewScanner(in),
+		out: out,
+		src: strings.Split(source, "\n"),
+	}
+	t.d.stop = t.stopped
+	hook = t.d
+	defer func() {
+		hook = nil
+	}()
+	return interpret(stmts, globals)
+}
+
+type debugTerm struct {
+	d        *debugger
+	in       *bufio.Scanner
+	out      io.Writer
+	src      []string // lines of the source
+	selected int      // frame of print, locals and list
+	lastCmd  string
+}
+
+const debugHelp = `commands:
+  b, break [line]       set a breakpoint or list them
+  clear [line]          delete the breakpoint or all of them
+  c, continue           run to the next breakpoint
+  s, step               step into calls
+  n, next               step over calls
+  o, out                run until the function returns
+  p, print expr         print the value of the expression in the frame
+  bt, backtrace         print the call stack
+  up, down, frame [n]   select the frame
+  locals                print the variables of the frame
+  globals               print the global variables
+  l, list [line]        print the source around the line
+  q, quit               stop the program
+An empty line repeats the last command.
+`
+
+func (t *debugTerm) stopped(reason string) {
+	t.selected = 0
+	f := t.d.frame(0)
+	if reason == "breakpoint" {
+		fmt.Fprintf(t.out, "breakpoint at line %v in %v\n", f.line, f.name)
+	}
+	t.printLine(f.line, "")
+	for {
+		fmt.Fprint(t.out, "(glox) ")
+		if !t.in.Scan() {
+			// without commands the program runs to its end
+			fmt.Fprintln(t.out)
+			hook = nil
+			return
+		}
+		cmd := strings.TrimSpace(t.in.Text())
+		if cmd == "" {
+			cmd = t.lastCmd
+		}
+		t.lastCmd = cmd
+		if t.command(cmd) {
+			return
+		}
+	}
+}
+
+// command runs the command and reports whether the program resumes.
+func (t *debugTerm) command(cmd string) bool {
+	d := t.d
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return false
+	}
+	arg := strings.TrimSpace(strings.TrimPrefix(cmd, fields[0]))
+	switch fields[0] {
+	case "b", "break":
+		if arg == "" {
+			t.listBreakpoints()
+			break
+		}
+		if n, ok := t.lineArg(arg); ok {
+			if l := d.setBreakpoint(n); l > 0 {
+				fmt.Fprintf(t.out, "breakpoint at line %v\n", l)
+			} else {
+				fmt.Fprintf(t.out, "no statement at or after line %v\n", n)
+			}
+		}
+	case "clear":
+		if arg == "" {
+			d.breakpoints = make(map[int]bool)
+		} else if n, ok := t.lineArg(arg); ok {
+			delete(d.breakpoints, n)
+		}
+	case "c", "continue":
+		d.resume(stepNone)
+		return true
+	case "s", "step":
+		d.resume(stepInto)
+		return true
+	case "n", "next":
+		d.resume(stepOver)
+		return true
+	case "o", "out":
+		d.resume(stepOut)
+		return true
+	case "p", "print":
+		v, err := d.eval(arg, d.frame(t.selected).env)
+		if err != nil {
+			fmt.Fprintln(t.out, err)
+		} else {
+			fmt.Fprintln(t.out, literalString(v))
+		}
+	case "bt", "backtrace":
+		for i := range d.frames {
+			mark := " "
+			if i == t.selected {
+				mark = ">"
+			}
+			f := d.frame(i)
+			fmt.Fprintf(t.out, "%v #%v %v at line %v\n", mark, i, f.name, f.line)
+		}
+	case "up":
+		t.selectFrame(t.selected + 1)
+	case "down":
+		t.selectFrame(t.selected - 1)
+	case "frame":
+		n := t.selected
+		if arg != "" {
+			var err error
+			if n, err = strconv.Atoi(arg); err != nil {
+				fmt.Fprintf(t.out, "bad frame %q\n", arg)
+				break
+			}
+		}
+		t.selectFrame(n)
+	case "locals":
+		t.locals()
+	case "globals":
+		for _, v := range variables(d.frames[0].env.globals) {
+			fmt.Fprintf(t.out, "%v = %v\n", v.name, v.value)
+		}
+	case "l", "list":
+		line := d.frame(t.selected).line
+		if arg != "" {
+			n, ok := t.lineArg(arg)
+			if !ok {
+				break
+			}
+			line = n
+		}
+		for l := line - 5; l <= line+5; l++ {
+			mark := " "
+			if l == d.frame(t.selected).line {
+				mark = ">"
+			}
+			t.printLine(l, mark)
+		}
+	case "q", "quit":
+		hook = nil
+		panic(ExitError(0))
+	case "h", "help":
+		fmt.Fprint(t.out, debugHelp)
+	default:
+		fmt.Fprintf(t.out, "unknown command %q, try help\n", fields[0])
+	}
+	return false
+}
+
+func (t *debugTerm) lineArg(arg string) (int, bool) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 {
+		fmt.Fprintf(t.out, "bad line %q\n", arg)
+		return 0, false
+	}
+	return n, true
+}
+
+// printLine prints the source line with its number, breakpoints are
+// marked with *.
+func (t *debugTerm) printLine(line int, mark string) {
+	if line < 1 || line > len(t.src) {
+		return
+	}
+	if t.d.breakpoints[line] {
+		mark += "*"
+	} else {
+		mark += " "
+	}
+	fmt.Fprintf(t.out, "%2v%4d  %v\n", mark, line, t.src[line-1])
+}
+
+func (t *debugTerm) listBreakpoints() {
+	lines := make([]int, 0, len(t.d.breakpoints))
+	for l := range t.d.breakpoints {
+		lines = append(lines, l)
+	}
+	sort.Ints(lines)
+	for _, l := range lines {
+		fmt.Fprintf(t.out, "breakpoint at line %v\n", l)
+	}
+}
+
+func (t *debugTerm) selectFrame(n int) {
+	if n < 0 || n >= len(t.d.frames) {
+		fmt.Fprintln(t.out, "no such frame")
+		return
+	}
+	t.selected = n
+	f := t.d.frame(n)
+	fmt.Fprintf(t.out, "#%v %v at line %v\n", n, f.name, f.line)
+	t.printLine(f.line, "")
+}
+
+// locals prints the variables of the scopes of the frame up to the globals,
+// those hidden by an inner scope are left out.
+func (t *debugTerm) locals() {
+	seen := make(map[string]bool)
+	for env := t.d.frame(t.selected).env; env != env.globals; env = env.enclosing {
+		for _, v := range variables(env) {
+			if !seen[v.name] {
+				seen[v.name] = true
+				fmt.Fprintf(t.out, "%v = %v\n", v.name, v.value)
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const debugSource = `fun add(a, b) {
+  var sum = a + b;
+  return sum;
+}
+var x = 1;
+print add(x, 2);
+print x;
+`
+
+// runSession debugs the source with the commands and returns what the
+// debugger and the program printed.
+func runSession(t *testing.T, source string, commands ...string) string {
+	t.Helper()
+	stmts, errs := parseProgram(source)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	var out strings.Builder
+	saved := stdout
+	stdout = &out
+	defer func() { stdout = saved }()
+	var in strings.Builder
+	for _, cmd := range commands {
+		in.WriteString(cmd + "\n")
+	}
+	if err := debugScript(stmts, source, strings.NewReader(in.String()), &out); err != nil {
+		out.WriteString(err.Error() + "\n")
+	}
+	return out.String()
+}
+
+// TestDebugSessions debugs the source with scripted commands, the output
+// of the program is between that of the debugger.
+func TestDebugSessions(t *testing.T) {
+	tests := []struct {
+		name     string
+		commands []string
+		want     string
+	}{
+		{"breakpoint", []string{"b 2", "c", "locals", "bt", "up", "p x + 10", "c"}, `     1  fun add(a, b) {
+(glox) breakpoint at line 2
+(glox) breakpoint at line 2 in add
+ *   2    var sum = a + b;
+(glox) a = 1
+b = 2
+(glox) > #0 add at line 2
+  #1 <script> at line 6
+(glox) #1 <script> at line 6
+     6  print add(x, 2);
+(glox) 11
+(glox) 3
+1
+`},
+		{"step", []string{"s", "s", "s", "p a", "o", "n"}, `     1  fun add(a, b) {
+(glox)      5  var x = 1;
+(glox)      6  print add(x, 2);
+(glox)      2    var sum = a + b;
+(glox) 1
+(glox) 3
+     7  print x;
+(glox) 1
+`},
+		{"repeat", []string{"n", "", "", ""}, `     1  fun add(a, b) {
+(glox)      5  var x = 1;
+(glox)      6  print add(x, 2);
+(glox) 3
+     7  print x;
+(glox) 1
+`},
+		{"quit", []string{"n", "n", "globals", "q"}, `     1  fun add(a, b) {
+(glox)      5  var x = 1;
+(glox)      6  print add(x, 2);
+(glox) add = <fn add>
+args = []
+x = 1
+(glox) exit status 0
+`},
+		{"mistakes", []string{"b 9", "b 4", "b", "clear", "b", "bogus", "p nope", "frame 3", "c"}, `     1  fun add(a, b) {
+(glox) no statement at or after line 9
+(glox) breakpoint at line 5
+(glox) breakpoint at line 5
+(glox) (glox) (glox) unknown command "bogus", try help
+(glox) [line 1] runtime error: undefined variable 'nope'
+(glox) no such frame
+(glox) 3
+1
+`},
+		{"no commands", nil, `     1  fun add(a, b) {
+(glox) 
+3
+1
+`},
+	}
+	for _, tt := range tests {
+		if got := runSession(t, debugSource, tt.commands...); got != tt.want {
+			t.Errorf("%v: session\n%swant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Diagnostic is a problem at a place of a script. The errors of every phase
+// carry one: people read its Error, tools the JSON printed with
+// -error-format json, one object per line.
+
+const (
+	phaseScan    = "scan"
+	phaseParse   = "parse"
+	phaseResolve = "resolve"
+	phaseCompile = "compile"
+	phaseRuntime = "runtime"
+	phaseLint    = "lint"
+
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// Codes of the diagnostics. A code never changes meaning, new errors get
+// new codes. Codes of warnings start with W.
+const (
+	codeUnexpectedChar      = "E0101"
+	codeUnterminatedString  = "E0102"
+	codeBadNumber           = "E0103"
+	codeUnterminatedComment = "E0104"
+
+	codeExpectedExpr  = "E0201"
+	codeOutsideLoop   = "E0202" // the compiler checks it too
+	codeMissingToken  = "E0203"
+	codeAssignTarget  = "E0204"
+	codeTooManyArgs   = "E0205" // or parameters
+	codeNesting       = "E0206"
+	codeTooManyErrors = "E0207"
+	codeAssignCond    = "W0208"
+
+	codeTopReturn  = "E0301"
+	codeUninitRead = "W0302"
+
+	codeTooManyConsts   = "E0401"
+	codeTooManyLocals   = "E0402"
+	codeTooManyUpvalues = "E0403"
+	codeJumpTooFar      = "E0404"
+
+	codeUndefined     = "E0501"
+	codeUninit        = "E0502"
+	codeOperands      = "E0503"
+	codeDivZero       = "E0504"
+	codeArity         = "E0505"
+	codeStackOverflow = "E0506"
+	codeNotCallable   = "E0507"
+	codeNativeArgs    = "E0508"
+	codeAssertion     = "E0509"
+)
+
+type Diagnostic struct {
+	Code     string   `json:"code"`
+	Severity string   `json:"severity"`
+	Phase    string   `json:"phase"`
+	File     string   `json:"file,omitempty"`
+	Span     Span     `json:"span"`
+	Message  string   `json:"message"`
+	Notes    []string `json:"notes,omitempty"`
+	Fixes    []Fix    `json:"fixes,omitempty"`
+
+	where string // the token in error, " at 'x'" or " at end"
+}
+
+// Span is the text from line:col to endLine:endCol, exclusive. The columns
+// count bytes from 1 and are 0 when only the line is known.
+type Span struct {
+	Line    int `json:"line"`
+	Col     int `json:"col"`
+	EndLine int `json:"endLine"`
+	EndCol  int `json:"endCol"`
+}
+
+// Fix replaces the text of the span.
+type Fix struct {
+	Span Span   `json:"span"`
+	Text string `json:"text"`
+}
+
+type ScanError struct{ *Diagnostic }
+type ParsingError struct{ *Diagnostic }
+type ResolveError struct{ *Diagnostic }
+type CompileError struct{ *Diagnostic }
+type RuntimeError struct{ *Diagnostic }
+
+// newDiag returns the error of the phase at the line, 0 when unknown.
+func newDiag(phase, code string, line int, msg string) *Diagnostic {
+	return &Diagnostic{
+		Code:     code,
+		Severity: severityError,
+		Phase:    phase,
+		Span:     Span{line, 0, line, 0},
+		Message:  msg,
+	}
+}
+
+// errorAtToken returns the error of the phase at the token, naming it.
+func errorAtToken(phase, code string, t *tokenObj, msg string) *Diagnostic {
+	d := newDiag(phase, code, t.line, msg)
+	d.Span = spanOf(t)
+	if t.tok == EOF {
+		d.where = " at end"
+	} else {
+		d.where = " at '" + t.lexeme + "'"
+	}
+	return d
+}
+
+func spanOf(t *tokenObj) Span {
+	line, col := tokenEnd(t)
+	return Span{t.line, t.col, line, col}
+}
+
+// addHint adds the note of the hint and, with a token, the fix replacing it.
+// Nothing is added to a nil diagnostic, that of a disabled lint rule.
+func (d *Diagnostic) addHint(h *hint, t *tokenObj) {
+	if d == nil || h == nil {
+		return
+	}
+	d.Notes = append(d.Notes, h.note)
+	if t != nil {
+		d.Fixes = append(d.Fixes, Fix{spanOf(t), h.text})
+	}
+}
+
+func (d *Diagnostic) diagnostic() *Diagnostic {
+	return d
+}
+
+// text returns the message followed by the notes.
+func (d *Diagnostic) text() string {
+	s := d.Message
+	for _, n := range d.Notes {
+		s += "; " + n
+	}
+	return s
+}
+
+func (d *Diagnostic) Error() string {
+	kind := d.Severity + d.where
+	if d.Phase == phaseRuntime {
+		kind = "runtime error"
+	}
+	if d.Span.Line == 0 {
+		return fmt.Sprintf("%v: %v", kind, d.text())
+	}
+	return fmt.Sprintf("[line %v] %v: %v", d.Span.Line, kind, d.text())
+}
+
+// diagnosticOf returns the diagnostic of the error, errors without one get
+// a diagnostic without a place.
+func diagnosticOf(err error) *Diagnostic {
+	if d, ok := err.(interface{ diagnostic() *Diagnostic }); ok {
+		return d.diagnostic()
+	}
+	return &Diagnostic{Code: "E0000", Severity: severityError, Message: err.Error()}
+}
+
+// errorFormat is human or json, set by -error-format.
+var errorFormat = "human"
+
+// printError prints the error of the file, "" when the command runs a
+// single program, in the error format. JSON goes to stderr.
+func printError(file string, err error) {
+	if errorFormat == "json" {
+		d := *diagnosticOf(err)
+		d.File = file
+		printJSON(&d)
+		return
+	}
+	if file != "" {
+		fmt.Fprintf(stdout, "%v: %v\n", file, err)
+	} else {
+		fmt.Fprintln(stdout, err)
+	}
+}
+
+// reportError prints the error of the program run from the file: the
+// name of the file is in json only, people know which file they ran.
+func reportError(file string, err error) {
+	if errorFormat == "json" {
+		printError(file, err)
+	} else {
+		printError("", err)
+	}
+}
+
+func printJSON(d *Diagnostic) {
+	b, _ := json.Marshal(d)
+	fmt.Fprintf(os.Stderr, "%s\n", b)
+}
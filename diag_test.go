@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestDiagnostics checks the diagnostics of the errors of every phase, the
+// text people read and the JSON tools read.
+func TestDiagnostics(t *testing.T) {
+	tests := []struct {
+		source string
+		with   string // backend running the source, "" when it does not parse
+		text   string
+		json   string
+	}{
+		{"var a = 1;\nprint a @ 2;", "",
+			"[line 2] error: unexpected character '@'",
+			`{"code":"E0101","severity":"error","phase":"scan","span":{"line":2,"col":9,"endLine":2,"endCol":10},"message":"unexpected character '@'"}`},
+		{"print (1;", "",
+			"[line 1] error at ';': expected enclosing ')' after expression",
+			`{"code":"E0203","severity":"error","phase":"parse","span":{"line":1,"col":9,"endLine":1,"endCol":10},"message":"expected enclosing ')' after expression"}`},
+		{"return 1;", "",
+			"[line 1] error at 'return': can't return from top-level code",
+			`{"code":"E0301","severity":"error","phase":"resolve","span":{"line":1,"col":1,"endLine":1,"endCol":7},"message":"can't return from top-level code"}`},
+		{"var count = 1;\nprint cont;", "tree",
+			"[line 2] runtime error: undefined variable 'cont'; did you mean 'count'?",
+			`{"code":"E0501","severity":"error","phase":"runtime","span":{"line":2,"col":7,"endLine":2,"endCol":11},"message":"undefined variable 'cont'","notes":["did you mean 'count'?"],"fixes":[{"span":{"line":2,"col":7,"endLine":2,"endCol":11},"text":"count"}]}`},
+		{"var count = 1;\nprint cont;", "vm",
+			"[line 2] runtime error: undefined variable 'cont'; did you mean 'count'?",
+			`{"code":"E0501","severity":"error","phase":"runtime","span":{"line":2,"col":0,"endLine":2,"endCol":0},"message":"undefined variable 'cont'","notes":["did you mean 'count'?"]}`},
+		{"print 1 / 0;", "tree",
+			"[line 1] runtime error: division by zero",
+			`{"code":"E0504","severity":"error","phase":"runtime","span":{"line":1,"col":9,"endLine":1,"endCol":10},"message":"division by zero"}`},
+		{"print 1 / 0;", "vm",
+			"[line 1] runtime error: division by zero",
+			`{"code":"E0504","severity":"error","phase":"runtime","span":{"line":1,"col":0,"endLine":1,"endCol":0},"message":"division by zero"}`},
+	}
+	saved := stdout
+	defer func() { stdout = saved }()
+	for _, tt := range tests {
+		stmts, errs := parseProgram(tt.source)
+		var err error
+		switch {
+		case tt.with == "" && len(errs) == 1:
+			err = errs[0]
+		case tt.with == "tree" && len(errs) == 0:
+			stdout = &strings.Builder{}
+			err = interpret(stmts, NewEnv(nil))
+		case tt.with == "vm" && len(errs) == 0:
+			stdout = &strings.Builder{}
+			err = interpretVM(stmts)
+		default:
+			t.Errorf("%q: errors %v", tt.source, errs)
+			continue
+		}
+		if err == nil {
+			t.Errorf("%q on %v: no error", tt.source, tt.with)
+			continue
+		}
+		if err.Error() != tt.text {
+			t.Errorf("%q on %v: got %q, want %q", tt.source, tt.with, err, tt.text)
+		}
+		b, _ := json.Marshal(diagnosticOf(err))
+		if string(b) != tt.json {
+			t.Errorf("%q on %v: got\n%s\nwant\n%s", tt.source, tt.with, b, tt.json)
+		}
+	}
+}
+
+// TestPrintError prints an error in both formats, JSON goes to stderr on a
+// line of its own with the file.
+func TestPrintError(t *testing.T) {
+	_, errs := parseProgram("print (1;")
+	if len(errs) != 1 {
+		t.Fatal(errs)
+	}
+	savedStdout, savedStderr, savedFormat := stdout, os.Stderr, errorFormat
+	defer func() { stdout, os.Stderr, errorFormat = savedStdout, savedStderr, savedFormat }()
+
+	var human strings.Builder
+	stdout = &human
+	printError("prog.glx", errs[0])
+	if want := "prog.glx: [line 1] error at ';': expected enclosing ')' after expression\n"; human.String() != want {
+		t.Errorf("human: got %q, want %q", human.String(), want)
+	}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	os.Stderr, errorFormat = f, "json"
+	printError("prog.glx", errs[0])
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"code":"E0203","severity":"error","phase":"parse","file":"prog.glx","span":{"line":1,"col":9,"endLine":1,"endCol":10},"message":"expected enclosing ')' after expression"}` + "\n"
+	if string(data) != want {
+		t.Errorf("json: got %s, want %s", data, want)
+	}
+}
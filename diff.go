@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// unifiedDiff writes the differences between a and b by lines in the
+// unified format with three lines of context.
+func unifiedDiff(w io.Writer, name string, a, b string) {
+	x := splitLines(a)
+	y := splitLines(b)
+
+	// lcs[i][j] is the length of the longest common subsequence of x[i:]
+	// and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	// edits are lines prefixed by ' ', '-' or '+'
+	type edit struct {
+		op   byte
+		line string
+		i, j int // lines of x and y before the edit
+	}
+	edits := make([]edit, 0, len(x)+len(y))
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			edits = append(edits, edit{' ', x[i], i, j})
+			i++
+			j++
+		case j == len(y) || i < len(x) && lcs[i+1][j] >= lcs[i][j+1]:
+			edits = append(edits, edit{'-', x[i], i, j})
+			i++
+		default:
+			edits = append(edits, edit{'+', y[j], i, j})
+			j++
+		}
+	}
+
+	const context = 3
+	header := false
+	for k := 0; k < len(edits); {
+		if edits[k].op == ' ' {
+			k++
+			continue
+		}
+		// the hunk spans changes closer than twice the context
+		start := k - context
+		if start < 0 {
+			start = 0
+		}
+		end := k
+		for n := k; n < len(edits) && n-end <= 2*context; n++ {
+			if edits[n].op != ' ' {
+				end = n
+			}
+		}
+		end += context + 1
+		if end > len(edits) {
+			end = len(edits)
+		}
+		if !header {
+			fmt.Fprintf(w, "--- %v.orig\n+++ %v\n", name, name)
+			header = true
+		}
+		var nx, ny int
+		for _, e := range edits[start:end] {
+			if e.op != '+' {
+				nx++
+			}
+			if e.op != '-' {
+				ny++
+			}
+		}
+		fmt.Fprintf(w, "@@ -%v +%v @@\n", hunkRange(edits[start].i, nx), hunkRange(edits[start].j, ny))
+		for _, e := range edits[start:end] {
+			fmt.Fprintf(w, "%c%v\n", e.op, e.line)
+		}
+		k = end
+	}
+}
+
+func hunkRange(start, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%v,0", start)
+	}
+	if n == 1 {
+		return fmt.Sprint(start + 1)
+	}
+	return fmt.Sprintf("%v,%v", start+1, n)
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+var opNames = [...]string{
+	OpConstant:     "OpConstant",
+	OpNil:          "OpNil",
+	OpTrue:         "OpTrue",
+	OpFalse:        "OpFalse",
+	OpUninit:       "OpUninit",
+	OpUndeclared:   "OpUndeclared",
+	OpPop:          "OpPop",
+	OpGetLocal:     "OpGetLocal",
+	OpSetLocal:     "OpSetLocal",
+	OpGetGlobal:    "OpGetGlobal",
+	OpDefineGlobal: "OpDefineGlobal",
+	OpSetGlobal:    "OpSetGlobal",
+	OpGetUpvalue:   "OpGetUpvalue",
+	OpSetUpvalue:   "OpSetUpvalue",
+	OpEqual:        "OpEqual",
+	OpNotEqual:     "OpNotEqual",
+	OpGreater:      "OpGreater",
+	OpGreaterEqual: "OpGreaterEqual",
+	OpLess:         "OpLess",
+	OpLessEqual:    "OpLessEqual",
+	OpAdd:          "OpAdd",
+	OpSubtract:     "OpSubtract",
+	OpMultiply:     "OpMultiply",
+	OpDivide:       "OpDivide",
+	OpNot:          "OpNot",
+	OpNegate:       "OpNegate",
+	OpPrint:        "OpPrint",
+	OpJump:         "OpJump",
+	OpJumpIfFalse:  "OpJumpIfFalse",
+	OpLoop:         "OpLoop",
+	OpCall:         "OpCall",
+	OpTailCall:     "OpTailCall",
+	OpClosure:      "OpClosure",
+	OpCloseUpvalue: "OpCloseUpvalue",
+	OpReturn:       "OpReturn",
+}
+
+func (op opcode) String() string {
+	if int(op) < len(opNames) && opNames[op] != "" {
+		return opNames[op]
+	}
+	return fmt.Sprintf("opcode(%d)", byte(op))
+}
+
+// disassemble prints the chunk of fn followed by chunks of all functions
+// found in its constant pool.
+func disassemble(w io.Writer, fn *function) {
+	fmt.Fprintf(w, "== %v ==\n", constString(fn))
+	c := &fn.chunk
+	for off := 0; off < len(c.code); {
+		off = disassembleInstr(w, c, off)
+	}
+	fmt.Fprintln(w, "constants:")
+	for i, k := range c.constants {
+		fmt.Fprintf(w, "%6d %v\n", i, constString(k))
+	}
+	for _, k := range c.constants {
+		if f, ok := k.(*function); ok {
+			fmt.Fprintln(w)
+			disassemble(w, f)
+		}
+	}
+}
+
+// disassembleInstr prints a single instruction at the offset and returns
+// the offset of the next one.
+func disassembleInstr(w io.Writer, c *chunk, off int) int {
+	fmt.Fprintf(w, "%04d ", off)
+	if off > 0 && c.lines[off] == c.lines[off-1] {
+		fmt.Fprint(w, "   | ")
+	} else {
+		fmt.Fprintf(w, "%4d ", c.lines[off])
+	}
+	op := opcode(c.code[off])
+	short := func(at int) int {
+		return int(c.code[at])<<8 | int(c.code[at+1])
+	}
+	switch op {
+	case OpConstant, OpUninit, OpUndeclared, OpGetGlobal, OpDefineGlobal, OpSetGlobal:
+		idx := short(off + 1)
+		fmt.Fprintf(w, "%-16v %4d %v\n", op, idx, constString(c.constants[idx]))
+		return off + 3
+	case OpGetLocal, OpSetLocal, OpGetUpvalue, OpSetUpvalue, OpCall, OpTailCall:
+		fmt.Fprintf(w, "%-16v %4d\n", op, c.code[off+1])
+		return off + 2
+	case OpJump, OpJumpIfFalse:
+		fmt.Fprintf(w, "%-16v %4d -> %d\n", op, off, off+3+short(off+1))
+		return off + 3
+	case OpLoop:
+		fmt.Fprintf(w, "%-16v %4d -> %d\n", op, off, off+3-short(off+1))
+		return off + 3
+	case OpClosure:
+		idx := short(off + 1)
+		fn := c.constants[idx].(*function)
+		fmt.Fprintf(w, "%-16v %4d %v\n", op, idx, constString(fn))
+		off += 3
+		for i := 0; i < fn.upvalueCount; i++ {
+			kind := "upvalue"
+			if c.code[off] == 1 {
+				kind = "local"
+			}
+			fmt.Fprintf(w, "%04d    |                     %v %d\n", off, kind, c.code[off+1])
+			off += 2
+		}
+		return off
+	default:
+		fmt.Fprintf(w, "%v\n", op)
+		return off + 1
+	}
+}
+
+func constString(v value) string {
+	switch v := v.(type) {
+	case string:
+		return fmt.Sprintf("%q", v)
+	case *function:
+		if v.name == "" {
+			return fmt.Sprintf("<lambda (%v)>", strings.Join(v.params, ","))
+		}
+		return v.String()
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// traceInstr prints the stack of the vm followed by the instruction about
+// to be executed.
+func (vm *VM) traceInstr(f *callFrame) {
+	fmt.Fprint(vm.trace, "          ")
+	for _, v := range vm.stack {
+		fmt.Fprintf(vm.trace, "[ %v ]", traceString(v))
+	}
+	fmt.Fprintln(vm.trace)
+	disassembleInstr(vm.trace, &f.cl.fn.chunk, f.ip)
+}
+
+func traceString(v value) string {
+	switch v := v.(type) {
+	case string:
+		return fmt.Sprintf("%q", v)
+	case uninitialized:
+		return "uninit " + v.name
+	case undeclared:
+		return "undeclared " + v.name
+	}
+	return fmt.Sprintf("%v", v)
+}
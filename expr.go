@@ -30,17 +30,22 @@ type (
 	}
 
 	FunExpr struct {
-		params []*tokenObj
-		body   []Stmt
+		keyword *tokenObj
+		params  []*tokenObj
+		body    []Stmt
 		expr
 	}
 
 	GroupingExpr struct {
-		e Expr
+		paren *tokenObj
+		e     Expr
 		expr
 	}
 
+	// LiteralExpr keeps the token of the literal or, when folded by the
+	// optimizer, the first token of the expression it replaces.
 	LiteralExpr struct {
+		token *tokenObj
 		value interface{}
 		expr
 	}
@@ -74,8 +79,10 @@ type (
 
 	stmt struct{}
 
+	// BlockStmt made by the optimizer has no brace.
 	BlockStmt struct {
-		list []Stmt
+		brace *tokenObj
+		list  []Stmt
 		stmt
 	}
 
@@ -94,20 +101,35 @@ type (
 		stmt
 	}
 
+	// ForStmt has optional parts, init is a VarStmt or an ExprStmt. The
+	// variables of init are local to the loop, continue runs the increment
+	// and a missing condition loops until break.
+	ForStmt struct {
+		keyword   *tokenObj
+		init      Stmt
+		condition Expr
+		increment Expr
+		body      Stmt
+		stmt
+	}
+
 	FunStmt struct {
-		name   *tokenObj
-		params []*tokenObj
-		body   []Stmt
+		keyword *tokenObj
+		name    *tokenObj
+		params  []*tokenObj
+		body    []Stmt
 		stmt
 	}
 
 	IfStmt struct {
+		keyword        *tokenObj
 		condition      Expr
 		block1, block2 Stmt
 		stmt
 	}
 
 	PrintStmt struct {
+		keyword    *tokenObj
 		expression Expr
 		stmt
 	}
@@ -119,12 +141,14 @@ type (
 	}
 
 	VarStmt struct {
-		name *tokenObj
-		init Expr
+		keyword *tokenObj
+		name    *tokenObj
+		init    Expr
 		stmt
 	}
 
 	WhileStmt struct {
+		keyword   *tokenObj
 		condition Expr
 		body      Stmt
 		stmt
@@ -133,23 +157,3 @@ type (
 
 func (*stmt) aStmt()       {}
 func (*stmt) execute(*Env) {}
-
-// func printAST(e Expr) string {
-// 	switch o := e.(type) {
-// 	case *BinaryExpr:
-// 		return fmt.Sprintf("(%v %v %v)",
-// 			o.operator.tok, printAST(o.left), printAST(o.right))
-// 	case *TernaryExpr:
-// 		return fmt.Sprintf("(%v %v %v %v)",
-// 			o.operator.tok, printAST(o.op1), printAST(o.op2), printAST(o.op3))
-// 	case *UnaryExpr:
-// 		return fmt.Sprintf("(%v %v)",
-// 			o.operator.tok, printAST(o.right))
-// 	case *GroupingExpr:
-// 		return fmt.Sprintf("(group %v)", printAST(o.e))
-// 	case *LiteralExpr:
-// 		return fmt.Sprintf("%v", o.value)
-// 	default:
-// 		panic("unexpected type of expr")
-// 	}
-// }
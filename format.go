@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Formatter prints the syntax tree back to source in the canonical layout:
+// two spaces of indentation, opening braces on the line of their statement,
+// single spaces around binary operators and after commas, at most one blank
+// line between statements.
+//
+// Comments are not a part of the tree, they are interleaved by their
+// position: a comment following a token on the same line stays at the end
+// of that line, any other comment is put on its own line before the next
+// token. A // comment inside a statement ends its line and the statement
+// continues on the next line, indented once more. Formatting the result
+// again does not change it.
+
+type formatter struct {
+	out      bytes.Buffer
+	indent   int
+	lineOpen bool // something was written on the current line
+	lastLine int  // source line of the last token or comment written
+	last     int  // index of the last token written
+	comments []*tokenObj
+	tokens   []*tokenObj
+	index    map[*tokenObj]int // position of a token in tokens
+	oneLine  bool              // blocks are written as {...}
+	hang     int               // indent added to continue a statement broken by a comment
+}
+
+// format returns the formatted source or the errors of scanning and parsing
+// it.
+func format(source string) ([]byte, []error) {
+	s := NewScanner(source)
+	tokens, errs := s.scan()
+	stmts, perrs := NewParser(tokens).parse()
+	if errs = syntaxErrors(errs, perrs); len(errs) > 0 {
+		return nil, errs
+	}
+	f := &formatter{
+		comments: s.comments,
+		tokens:   tokens,
+		last:     -1,
+		index:    make(map[*tokenObj]int, len(tokens)),
+	}
+	for i, t := range tokens {
+		f.index[t] = i
+	}
+	if strings.HasPrefix(source, "#!") {
+		line := strings.SplitN(source, "\n", 2)[0]
+		f.out.WriteString(strings.TrimRight(line, " \t\r") + "\n")
+		f.lastLine = 1
+	}
+	f.stmts(stmts)
+	f.leading(tokens[len(tokens)-1])
+	return f.out.Bytes(), nil
+}
+
+// formatLine returns the statement on one line, without comments and with
+// the statements of its blocks left out.
+func formatLine(s Stmt) string {
+	f := &formatter{last: -1, oneLine: true}
+	f.stmt(s)
+	return f.out.String()
+}
+
+func before(a, b *tokenObj) bool {
+	return a.line < b.line || a.line == b.line && a.col < b.col
+}
+
+// endLine returns the line where the token ends.
+func endLine(t *tokenObj) int {
+	return t.line + strings.Count(t.lexeme, "\n")
+}
+
+func (f *formatter) write(s string) {
+	if !f.lineOpen {
+		f.out.WriteString(strings.Repeat("  ", f.indent))
+		f.lineOpen = true
+	}
+	f.out.WriteString(s)
+}
+
+// comment writes the first comment after the text of the open line,
+// separated by one space.
+func (f *formatter) comment() {
+	c := f.comments[0]
+	f.comments = f.comments[1:]
+	if f.lineOpen {
+		f.out.Truncate(len(bytes.TrimRight(f.out.Bytes(), " ")))
+		f.out.WriteString(" ")
+	}
+	f.write(c.lexeme)
+	f.lastLine = endLine(c)
+}
+
+// newline ends the line, after the comments which follow its last token.
+func (f *formatter) newline() {
+	for len(f.comments) > 0 && f.comments[0].line == f.lastLine && f.trailing(f.comments[0]) {
+		f.comment()
+	}
+	if f.lineOpen {
+		f.out.Truncate(len(bytes.TrimRight(f.out.Bytes(), " ")))
+		f.out.WriteString("\n")
+		f.lineOpen = false
+	}
+}
+
+// trailing reports whether only closing tokens are between the last token
+// written and the comment c.
+func (f *formatter) trailing(c *tokenObj) bool {
+	for _, t := range f.tokens[f.last+1:] {
+		if !before(t, c) {
+			break
+		}
+		if t.tok != Semicolon && t.tok != RightParen && t.tok != RightBrace {
+			return false
+		}
+	}
+	return true
+}
+
+// lineComment ends the line when a // comment on it precedes the token t,
+// so that the token starts the next line.
+func (f *formatter) lineComment(t *tokenObj) {
+	if f.lineOpen && t != nil && len(f.comments) > 0 && f.comments[0].line == f.lastLine &&
+		before(f.comments[0], t) && strings.HasPrefix(f.comments[0].lexeme, "//") {
+		f.newline()
+	}
+}
+
+// next returns the first token of the kind following the last token
+// written.
+func (f *formatter) next(kind token) *tokenObj {
+	if f.tokens == nil {
+		return nil
+	}
+	for _, t := range f.tokens[f.last+1:] {
+		if t.tok == kind {
+			return t
+		}
+	}
+	return nil
+}
+
+// blank separates statements by a blank line when they were in the source,
+// though not at the start of a block or of the file.
+func (f *formatter) blank(line int) {
+	b := f.out.Bytes()
+	if f.lastLine > 0 && line > f.lastLine+1 &&
+		!bytes.HasSuffix(b, []byte("{\n")) && !bytes.HasSuffix(b, []byte("\n\n")) {
+		f.out.WriteString("\n")
+	}
+}
+
+// leading writes the comments preceding the token t on their own lines.
+func (f *formatter) leading(t *tokenObj) {
+	for len(f.comments) > 0 && before(f.comments[0], t) {
+		c := f.comments[0]
+		if f.lineOpen && c.line == f.lastLine {
+			// between tokens of a line
+			if strings.HasPrefix(c.lexeme, "/*") {
+				f.comments = f.comments[1:]
+				f.write(c.lexeme + " ")
+				f.lastLine = endLine(c)
+				continue
+			}
+			// the rest of the statement continues on the next line
+			f.comment()
+			f.newline()
+			if f.hang == 0 {
+				f.hang = 1
+				f.indent++
+			}
+			continue
+		}
+		f.newline()
+		f.blank(c.line)
+		f.comments = f.comments[1:]
+		f.write(c.lexeme)
+		f.lastLine = endLine(c)
+		f.newline()
+	}
+}
+
+// token writes the text of the token, after the comments preceding it.
+func (f *formatter) token(t *tokenObj, text string) {
+	if t == nil || f.tokens == nil {
+		f.write(text)
+		return
+	}
+	f.leading(t)
+	f.write(text)
+	f.lastLine = endLine(t)
+	f.last = f.index[t]
+	// block comments right after the token stick to it
+	next := f.tokens[f.last+1]
+	for len(f.comments) > 0 && before(f.comments[0], next) &&
+		f.comments[0].line == t.line && strings.HasPrefix(f.comments[0].lexeme, "/*") {
+		c := f.comments[0]
+		f.comments = f.comments[1:]
+		f.write(" " + c.lexeme)
+		f.lastLine = endLine(c)
+	}
+}
+
+// closing returns the brace matching the brace open.
+func (f *formatter) closing(open *tokenObj) *tokenObj {
+	depth := 0
+	for _, t := range f.tokens[f.index[open]:] {
+		switch t.tok {
+		case LeftBrace:
+			depth++
+		case RightBrace:
+			depth--
+			if depth == 0 {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// brace returns the first brace following the token t.
+func (f *formatter) brace(t *tokenObj) *tokenObj {
+	for _, t := range f.tokens[f.index[t]:] {
+		if t.tok == LeftBrace {
+			return t
+		}
+	}
+	return nil
+}
+
+func (f *formatter) stmts(list []Stmt) {
+	hang := f.hang
+	f.hang = 0
+	for _, s := range list {
+		if t := startToken(s); t != nil {
+			f.leading(t)
+			f.blank(t.line)
+		}
+		f.stmt(s)
+		f.newline()
+		f.unhang()
+	}
+	f.hang = hang
+}
+
+// unhang ends the indent of a statement continued after a comment.
+func (f *formatter) unhang() {
+	f.indent -= f.hang
+	f.hang = 0
+}
+
+// block writes the statements between the brace open and its closing
+// brace.
+func (f *formatter) block(open *tokenObj, list []Stmt) {
+	if f.oneLine {
+		if len(list) > 0 {
+			f.write("{...}")
+		} else {
+			f.write("{}")
+		}
+		return
+	}
+	end := f.closing(open)
+	f.lineComment(open)
+	f.token(open, "{")
+	if len(list) == 0 && (len(f.comments) == 0 || !before(f.comments[0], end)) {
+		f.token(end, "}")
+		return
+	}
+	f.newline()
+	f.indent++
+	f.stmts(list)
+	f.leading(end)
+	f.indent--
+	f.token(end, "}")
+}
+
+// body writes the statement following the header of a compound statement,
+// a block stays on the line of the header.
+func (f *formatter) body(s Stmt) {
+	f.unhang()
+	if b, ok := s.(*BlockStmt); ok {
+		f.write(" ")
+		f.block(b.brace, b.list)
+		return
+	}
+	if f.oneLine {
+		f.write(" ")
+		f.stmt(s)
+		return
+	}
+	f.newline()
+	f.indent++
+	f.stmts([]Stmt{s})
+	f.indent--
+}
+
+func (f *formatter) stmt(s Stmt) {
+	switch s := s.(type) {
+	case *BlockStmt:
+		f.block(s.brace, s.list)
+	case *BreakStmt:
+		f.token(s.keyword, "break;")
+	case *ContinueStmt:
+		f.token(s.keyword, "continue;")
+	case *ExprStmt:
+		f.expr(s.expression)
+		f.write(";")
+	case *ForStmt:
+		f.token(s.keyword, "for (")
+		if s.init != nil {
+			f.stmt(s.init)
+		} else {
+			f.write(";")
+		}
+		if s.condition != nil {
+			f.write(" ")
+			f.expr(s.condition)
+		}
+		f.write(";")
+		if s.increment != nil {
+			f.write(" ")
+			f.expr(s.increment)
+		}
+		f.write(")")
+		f.body(s.body)
+	case *FunStmt:
+		f.token(s.keyword, "fun ")
+		f.token(s.name, s.name.lexeme)
+		f.params(s.params)
+		f.unhang()
+		f.write(" ")
+		f.block(f.brace(s.name), s.body)
+	case *IfStmt:
+		f.token(s.keyword, "if (")
+		f.expr(s.condition)
+		f.write(")")
+		f.body(s.block1)
+		if s.block2 == nil {
+			return
+		}
+		keyword := f.next(Else)
+		f.lineComment(keyword)
+		if f.lineOpen {
+			f.write(" ")
+		}
+		f.token(keyword, "else")
+		if elif, ok := s.block2.(*IfStmt); ok {
+			f.write(" ")
+			f.stmt(elif)
+		} else {
+			f.body(s.block2)
+		}
+	case *PrintStmt:
+		f.token(s.keyword, "print ")
+		f.expr(s.expression)
+		f.write(";")
+	case *ReturnStmt:
+		if s.value == nil {
+			f.token(s.keyword, "return;")
+			return
+		}
+		f.token(s.keyword, "return ")
+		f.expr(s.value)
+		f.write(";")
+	case *VarStmt:
+		f.token(s.keyword, "var ")
+		f.token(s.name, s.name.lexeme)
+		if s.init != nil {
+			f.write(" = ")
+			f.expr(s.init)
+		}
+		f.write(";")
+	case *WhileStmt:
+		f.token(s.keyword, "while (")
+		f.expr(s.condition)
+		f.write(")")
+		f.body(s.body)
+	default:
+		panic(fmt.Sprintf("format: unexpected statement %T", s))
+	}
+}
+
+func (f *formatter) params(params []*tokenObj) {
+	f.write("(")
+	for i, p := range params {
+		if i > 0 {
+			f.write(", ")
+		}
+		f.token(p, p.lexeme)
+	}
+	f.write(")")
+}
+
+func (f *formatter) expr(e Expr) {
+	switch e := e.(type) {
+	case *AssignExpr:
+		f.token(e.name, e.name.lexeme)
+		f.write(" = ")
+		f.expr(e.value)
+	case *BinaryExpr:
+		f.expr(e.left)
+		f.write(" ")
+		f.token(e.operator, e.operator.lexeme)
+		f.write(" ")
+		f.expr(e.right)
+	case *CallExpr:
+		f.expr(e.callee)
+		f.write("(")
+		for i, a := range e.args {
+			if i > 0 {
+				f.write(", ")
+			}
+			f.expr(a)
+		}
+		f.token(e.paren, ")")
+	case *FunExpr:
+		f.token(e.keyword, "fun ")
+		f.params(e.params)
+		f.write(" ")
+		f.block(f.brace(e.keyword), e.body)
+	case *GroupingExpr:
+		f.token(e.paren, "(")
+		f.expr(e.e)
+		f.write(")")
+	case *LiteralExpr:
+		if e.token != nil {
+			f.token(e.token, e.token.lexeme)
+		} else {
+			f.write(literalString(e.value))
+		}
+	case *LogicalExpr:
+		f.expr(e.left)
+		f.write(" ")
+		f.token(e.operator, e.operator.lexeme)
+		f.write(" ")
+		f.expr(e.right)
+	case *UnaryExpr:
+		f.token(e.operator, e.operator.lexeme)
+		f.expr(e.right)
+	case *VarExpr:
+		f.token(e.name, e.name.lexeme)
+	default:
+		panic(fmt.Sprintf("format: unexpected expression %T", e))
+	}
+}
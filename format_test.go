@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Sources with comments at the places where the formatter has to choose a
+// layout for them.
+var formatComments = []string{
+	"if (true) {\n  print 1;\n} // one\nelse {\n  print 2;\n}\n",
+	"if (true) {\n  print 1;\n}\n// one\nelse {\n  print 2;\n}\n",
+	"if (true) {\n  print 1;\n} else // one\n{\n  print 2;\n}\n",
+	"if (true) {\n  print 1;\n} else /* e */ {\n  print 2;\n}\n",
+	"if (true) {\n  print 1;\n} /* e */ else /* f */ {\n  print 2;\n}\n",
+	"if (true) {\n  print 1;\n}\nelse /* e */ {\n  print 2;\n}\n",
+	"if (true)\n  print 1; // one\nelse\n  print 2; // two\n",
+	"print 1 // c\n  + 2;\n",
+	"print 1 /* c */ + 2;\n",
+	"print (1 + // c\n  2) * // d\n  3;\n",
+	"fun f(a, b) {}\nf(true, // between args\n  2);\n",
+	"fun f(a, // a\n  b) {\n  return a; // a\n}\n",
+	"var f = fun () { // fun\n  print 1; // one\n};\n",
+	"f(1, // one\n  fun () {\n    print 2;\n  });\n",
+	"{ // block\n}\n// end\n",
+	"// one\n\n\n// two\nprint 1;  // three\n/* four */ print 2;\n",
+	"while (true) // loop\n  break;\n",
+	"for (var i = 0; // init\n  i < 2; i = i + 1) print i;\n",
+}
+
+// TestFormatStable formats the examples and the sources above twice, the
+// second pass must not change the result of the first.
+func TestFormatStable(t *testing.T) {
+	files, err := filepath.Glob("examples/*.glx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := map[string]string{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources[file] = string(data)
+	}
+	for i, source := range formatComments {
+		sources["comments #"+string(rune('a'+i))] = source
+	}
+	for name, source := range sources {
+		once, errs := format(source)
+		if len(errs) > 0 {
+			t.Errorf("%v: %v", name, errs)
+			continue
+		}
+		twice, errs := format(string(once))
+		if len(errs) > 0 {
+			t.Errorf("%v: formatted source does not parse: %v\n%s", name, errs, once)
+			continue
+		}
+		if string(once) != string(twice) {
+			t.Errorf("%v: formatting is not stable\nonce:\n%s\ntwice:\n%s", name, once, twice)
+		}
+		for n, line := range strings.Split(string(once), "\n") {
+			if strings.TrimRight(line, " \t") != line {
+				t.Errorf("%v:%v: trailing whitespace in %q", name, n+1, line)
+			}
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// Fuzz tests of the scanner, the parser and the backends: whatever the
+// input, no Go panic may escape them. testdata/fuzz keeps the inputs which
+// crashed glox. Programs run in the tree interpreter with a budget of
+// statements and of the length of strings, then in the vm when they ran to
+// their end.
+
+func FuzzScan(f *testing.F) {
+	f.Fuzz(func(t *testing.T, source string) {
+		NewScanner(source).scan()
+	})
+}
+
+func FuzzParse(f *testing.F) {
+	f.Fuzz(func(t *testing.T, source string) {
+		parseProgram(source)
+	})
+}
+
+func FuzzExec(f *testing.F) {
+	f.Fuzz(func(t *testing.T, source string) {
+		fuzzExec(source)
+	})
+}
+
+const (
+	maxFuzzSteps  = 10000   // statements run by an input
+	maxFuzzString = 1 << 16 // length of strings made by an input
+)
+
+// fuzzBudget stops programs running too long or building large strings.
+type fuzzBudget struct {
+	steps int
+}
+
+// budgetErr is panicked at a program exceeding the budget, it escapes the
+// interpreter to fuzzExec.
+type budgetErr string
+
+func (b *fuzzBudget) stop(msg string) {
+	panic(budgetErr(msg))
+}
+
+func (b *fuzzBudget) check(v value) {
+	if s, ok := v.(string); ok && len(s) > maxFuzzString {
+		b.stop("string too long")
+	}
+}
+
+func (b *fuzzBudget) stmt(s Stmt, env *Env) {
+	if b.steps++; b.steps > maxFuzzSteps {
+		b.stop("too many statements")
+	}
+}
+
+func (b *fuzzBudget) enter(fn Callable, env *Env) {
+	for _, v := range env.values {
+		b.check(v)
+	}
+}
+
+func (b *fuzzBudget) leave(v value, returned bool) {}
+
+func (b *fuzzBudget) assign(name *tokenObj, v value, env *Env) {
+	b.check(v)
+}
+
+func fuzzExec(source string) {
+	stmts, errs := parseProgram(source)
+	if len(errs) > 0 {
+		return
+	}
+	saved := stdout
+	stdout = io.Discard
+	b := &fuzzBudget{}
+	hook = b
+	defer func() {
+		stdout = saved
+		hook = nil
+		if e := recover(); e != nil {
+			if _, ok := e.(budgetErr); !ok {
+				panic(e)
+			}
+		}
+	}()
+	interpret(stmts, NewEnv(nil))
+	hook = nil
+	interpretVM(stmts)
+}
+
+// TestDeepNesting parses programs nested deeper than the parser allows,
+// they must fail with an error instead of overflowing the stack.
+func TestDeepNesting(t *testing.T) {
+	n := maxNesting + 1
+	tests := map[string]string{
+		"assign":  "var a; " + strings.Repeat("a = ", n) + "1;",
+		"blocks":  strings.Repeat("{", n) + strings.Repeat("}", n),
+		"lambdas": "var f = " + strings.Repeat("fun () { return ", n) + "1" + strings.Repeat("; }", n) + ";",
+		"parens":  "print " + strings.Repeat("(", n) + "1" + strings.Repeat(")", n) + ";",
+		"unary":   "print " + strings.Repeat("-", n) + "1;",
+	}
+	for name, source := range tests {
+		_, errs := parseProgram(source)
+		found := false
+		for _, err := range errs {
+			if d := diagnosticOf(err); d != nil && d.Code == codeNesting {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%v: got %v, want a nesting error", name, errs)
+		}
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"sort"
+)
+
+// Binary format of compiled programs (.gloxc).
+//
+// header    -> magic[4] version:u16 checksum:u32 length:u32 ;
+// payload   -> function ;
+// function  -> name:str params:uvarint str* arity:uvarint upvalues:uvarint
+//              code:bytes lines constants scopes ;
+// lines     -> runs:uvarint ( line:uvarint count:uvarint )* ;
+// constants -> count:uvarint ( tag:u8 constant )* ;
+// scopes    -> count:uvarint ( offset:uvarint names:uvarint str* )* ;
+//
+// Integers in the header are big-endian, the checksum is CRC-32 (IEEE) of
+// the payload. Strings and byte slices are prefixed by their uvarint length.
+// The version must be bumped whenever the encoding or the instruction set
+// changes.
+
+const (
+	gloxcMagic   = "GLXC"
+	gloxcVersion = 4
+	gloxcHeader  = 4 + 2 + 4 + 4
+)
+
+const (
+	tagNumber byte = iota + 1
+	tagString
+	tagFunction
+)
+
+// isCompiled reports whether data looks like a compiled program.
+func isCompiled(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(gloxcMagic))
+}
+
+// encodeProgram serializes the compiled script into the .gloxc format.
+func encodeProgram(fn *function) []byte {
+	var payload bytes.Buffer
+	writeFunction(&payload, fn)
+
+	var out bytes.Buffer
+	out.WriteString(gloxcMagic)
+	var header [gloxcHeader - 4]byte
+	binary.BigEndian.PutUint16(header[0:], gloxcVersion)
+	binary.BigEndian.PutUint32(header[2:], crc32.ChecksumIEEE(payload.Bytes()))
+	binary.BigEndian.PutUint32(header[6:], uint32(payload.Len()))
+	out.Write(header[:])
+	out.Write(payload.Bytes())
+	return out.Bytes()
+}
+
+func writeUvarint(b *bytes.Buffer, n int) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], uint64(n))])
+}
+
+func writeString(b *bytes.Buffer, s string) {
+	writeUvarint(b, len(s))
+	b.WriteString(s)
+}
+
+func writeFunction(b *bytes.Buffer, fn *function) {
+	writeString(b, fn.name)
+	writeUvarint(b, len(fn.params))
+	for _, p := range fn.params {
+		writeString(b, p)
+	}
+	writeUvarint(b, fn.arity)
+	writeUvarint(b, fn.upvalueCount)
+
+	c := &fn.chunk
+	writeUvarint(b, len(c.code))
+	b.Write(c.code)
+
+	// lines are stored run-length encoded, most instructions share a line
+	runs := make([][2]int, 0)
+	for _, l := range c.lines {
+		if n := len(runs); n > 0 && runs[n-1][0] == l {
+			runs[n-1][1]++
+		} else {
+			runs = append(runs, [2]int{l, 1})
+		}
+	}
+	writeUvarint(b, len(runs))
+	for _, r := range runs {
+		writeUvarint(b, r[0])
+		writeUvarint(b, r[1])
+	}
+
+	writeUvarint(b, len(c.constants))
+	for _, k := range c.constants {
+		switch k := k.(type) {
+		case float64:
+			b.WriteByte(tagNumber)
+			var buf [8]byte
+			binary.BigEndian.PutUint64(buf[:], math.Float64bits(k))
+			b.Write(buf[:])
+		case string:
+			b.WriteByte(tagString)
+			writeString(b, k)
+		case *function:
+			b.WriteByte(tagFunction)
+			writeFunction(b, k)
+		default:
+			panic(fmt.Sprintf("gloxc: unexpected constant %T", k))
+		}
+	}
+
+	offsets := make([]int, 0, len(fn.scopes))
+	for off := range fn.scopes {
+		offsets = append(offsets, off)
+	}
+	sort.Ints(offsets)
+	writeUvarint(b, len(offsets))
+	for _, off := range offsets {
+		writeUvarint(b, off)
+		writeUvarint(b, len(fn.scopes[off]))
+		for _, n := range fn.scopes[off] {
+			writeString(b, n)
+		}
+	}
+}
+
+// ---------------------------------------------------------
+// loading
+
+type LoadError string
+
+func (e LoadError) Error() string {
+	return string(e)
+}
+
+// decodeProgram loads the compiled script, it rejects files written by
+// other versions of the format and files with a broken checksum.
+func decodeProgram(data []byte) (fn *function, err error) {
+	if len(data) < gloxcHeader || !isCompiled(data) {
+		return nil, LoadError("not a compiled glox program")
+	}
+	version := binary.BigEndian.Uint16(data[4:])
+	if version != gloxcVersion {
+		return nil, LoadError(fmt.Sprintf(
+			"compiled program has format version %v, this glox supports version %v; recompile it",
+			version, gloxcVersion))
+	}
+	sum := binary.BigEndian.Uint32(data[6:])
+	length := binary.BigEndian.Uint32(data[10:])
+	payload := data[gloxcHeader:]
+	if uint32(len(payload)) != length {
+		return nil, LoadError("compiled program is truncated")
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return nil, LoadError("compiled program is corrupted: checksum mismatch")
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			le, ok := e.(LoadError)
+			if !ok {
+				panic(e)
+			}
+			fn, err = nil, le
+		}
+	}()
+	r := &reader{data: payload}
+	fn = r.function()
+	if r.pos != len(r.data) {
+		r.fail("trailing data")
+	}
+	// the vm runs the script without arguments nor enclosing closure
+	if fn.arity != 0 || fn.upvalueCount != 0 {
+		r.fail("script with parameters or upvalues")
+	}
+	return fn, nil
+}
+
+// reader decodes the payload, it panics with LoadError on malformed input.
+type reader struct {
+	data []byte
+	pos  int
+}
+
+func (r *reader) fail(msg string) {
+	panic(LoadError("malformed compiled program: " + msg))
+}
+
+func (r *reader) uvarint() int {
+	n, size := binary.Uvarint(r.data[r.pos:])
+	if size <= 0 || n > math.MaxInt32 {
+		r.fail("bad integer")
+	}
+	r.pos += size
+	return int(n)
+}
+
+func (r *reader) bytes(n int) []byte {
+	if n > len(r.data)-r.pos {
+		r.fail("unexpected end of data")
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *reader) string() string {
+	return string(r.bytes(r.uvarint()))
+}
+
+func (r *reader) function() *function {
+	fn := &function{name: r.string()}
+	for n := r.uvarint(); n > 0; n-- {
+		fn.params = append(fn.params, r.string())
+	}
+	fn.arity = r.uvarint()
+	fn.upvalueCount = r.uvarint()
+
+	c := &fn.chunk
+	c.code = append([]byte(nil), r.bytes(r.uvarint())...)
+	for runs := r.uvarint(); runs > 0; runs-- {
+		line, count := r.uvarint(), r.uvarint()
+		if count > len(c.code)-len(c.lines) {
+			r.fail("line table longer than code")
+		}
+		for ; count > 0; count-- {
+			c.lines = append(c.lines, line)
+		}
+	}
+	if len(c.lines) != len(c.code) {
+		r.fail("line table does not match code")
+	}
+	for n := r.uvarint(); n > 0; n-- {
+		if r.pos >= len(r.data) {
+			r.fail("unexpected end of data")
+		}
+		tag := r.data[r.pos]
+		r.pos++
+		switch tag {
+		case tagNumber:
+			bits := binary.BigEndian.Uint64(r.bytes(8))
+			c.constants = append(c.constants, math.Float64frombits(bits))
+		case tagString:
+			c.constants = append(c.constants, r.string())
+		case tagFunction:
+			c.constants = append(c.constants, r.function())
+		default:
+			r.fail(fmt.Sprintf("unknown constant tag %v", tag))
+		}
+	}
+	for n := r.uvarint(); n > 0; n-- {
+		off := r.uvarint()
+		if off >= len(c.code) {
+			r.fail("scope outside of the code")
+		}
+		if fn.scopes == nil {
+			fn.scopes = make(map[int][]string)
+		}
+		var names []string
+		for k := r.uvarint(); k > 0; k-- {
+			names = append(names, r.string())
+		}
+		fn.scopes[off] = names
+	}
+	if err := verifyChunk(fn); err != nil {
+		r.fail(err.Error())
+	}
+	return fn
+}
+
+// verifyChunk checks that every instruction of fn is complete, refers to
+// constants of the right kind and jumps to the start of an instruction.
+// Following every path through the code, it checks that the stack holds
+// the operands of each instruction and the locals it accesses, and that a
+// path reaches every instruction with the same height of the stack.
+func verifyChunk(fn *function) error {
+	c := &fn.chunk
+	short := func(at int) int {
+		return int(c.code[at])<<8 | int(c.code[at+1])
+	}
+	starts := make(map[int]bool)
+	last := OpNil
+	for off := 0; off < len(c.code); {
+		op := opcode(c.code[off])
+		starts[off] = true
+		last = op
+		size := 1
+		switch op {
+		case OpConstant, OpUninit, OpUndeclared, OpGetGlobal, OpDefineGlobal, OpSetGlobal,
+			OpJump, OpJumpIfFalse, OpLoop, OpClosure:
+			size = 3
+		case OpGetLocal, OpSetLocal, OpGetUpvalue, OpSetUpvalue, OpCall, OpTailCall:
+			size = 2
+		default:
+			if int(op) >= len(opNames) {
+				return fmt.Errorf("unknown opcode %v at %v", op, off)
+			}
+		}
+		if off+size > len(c.code) {
+			return fmt.Errorf("truncated %v at %v", op, off)
+		}
+		switch op {
+		case OpConstant, OpUninit, OpUndeclared, OpGetGlobal, OpDefineGlobal, OpSetGlobal, OpClosure:
+			idx := short(off + 1)
+			if idx >= len(c.constants) {
+				return fmt.Errorf("constant %v out of range at %v", idx, off)
+			}
+			k := c.constants[idx]
+			if _, ok := k.(string); !ok && op != OpConstant && op != OpClosure {
+				return fmt.Errorf("%v expects a name at %v", op, off)
+			}
+			if f, ok := k.(*function); op == OpClosure {
+				if !ok {
+					return fmt.Errorf("%v expects a function at %v", op, off)
+				}
+				size += 2 * f.upvalueCount
+				if off+size > len(c.code) {
+					return fmt.Errorf("truncated %v at %v", op, off)
+				}
+				for i := off + 3; i < off+size; i += 2 {
+					if c.code[i] > 1 {
+						return fmt.Errorf("bad upvalue kind at %v", off)
+					}
+					if c.code[i] == 0 && int(c.code[i+1]) >= fn.upvalueCount {
+						return fmt.Errorf("upvalue out of range at %v", off)
+					}
+				}
+			} else if ok {
+				return fmt.Errorf("%v cannot load a function at %v", op, off)
+			}
+		case OpGetUpvalue, OpSetUpvalue:
+			if int(c.code[off+1]) >= fn.upvalueCount {
+				return fmt.Errorf("upvalue out of range at %v", off)
+			}
+		}
+		off += size
+	}
+	if last != OpReturn {
+		return errors.New("code does not end with a return")
+	}
+
+	// the height of the stack above the base of the frame before each
+	// instruction reached, the frame starts with the callee and the
+	// arguments; the callee stays in its slot until the return
+	heights := make(map[int]int)
+	work := []int{0}
+	heights[0] = 1 + fn.arity
+	reach := func(from, to, height int) error {
+		if !starts[to] {
+			return fmt.Errorf("jump into an instruction at %v", from)
+		}
+		if h, ok := heights[to]; ok {
+			if h != height {
+				return fmt.Errorf("stack height %v differs from %v at %v", height, h, to)
+			}
+			return nil
+		}
+		heights[to] = height
+		work = append(work, to)
+		return nil
+	}
+	for len(work) > 0 {
+		off := work[len(work)-1]
+		work = work[:len(work)-1]
+		h := heights[off]
+		op := opcode(c.code[off])
+		// operands popped and values pushed
+		pop, push, size := 0, 0, 1
+		switch op {
+		case OpConstant, OpUninit, OpUndeclared, OpGetGlobal:
+			push, size = 1, 3
+		case OpNil, OpTrue, OpFalse:
+			push = 1
+		case OpPop, OpPrint, OpCloseUpvalue:
+			pop = 1
+		case OpGetLocal, OpSetLocal:
+			if slot := int(c.code[off+1]); slot >= h {
+				return fmt.Errorf("local %v out of range at %v", slot, off)
+			}
+			if op == OpGetLocal {
+				push = 1
+			} else {
+				pop, push = 1, 1
+			}
+			size = 2
+		case OpDefineGlobal:
+			pop, size = 1, 3
+		case OpSetGlobal:
+			pop, push, size = 1, 1, 3
+		case OpGetUpvalue:
+			push, size = 1, 2
+		case OpSetUpvalue:
+			pop, push, size = 1, 1, 2
+		case OpEqual, OpNotEqual, OpGreater, OpGreaterEqual, OpLess, OpLessEqual,
+			OpAdd, OpSubtract, OpMultiply, OpDivide:
+			pop, push = 2, 1
+		case OpNot, OpNegate:
+			pop, push = 1, 1
+		case OpCall, OpTailCall:
+			pop, push, size = int(c.code[off+1])+1, 1, 2
+		case OpClosure:
+			f := c.constants[short(off+1)].(*function)
+			for i := off + 3; i < off+3+2*f.upvalueCount; i += 2 {
+				if c.code[i] == 1 && int(c.code[i+1]) >= h {
+					return fmt.Errorf("local %v out of range at %v", c.code[i+1], off)
+				}
+			}
+			push, size = 1, 3+2*f.upvalueCount
+		case OpJump, OpJumpIfFalse:
+			if op == OpJumpIfFalse && h < 2 {
+				return fmt.Errorf("stack underflow at %v", off)
+			}
+			target := off + 3 + short(off+1)
+			if target >= len(c.code) {
+				return fmt.Errorf("jump out of range at %v", off)
+			}
+			if err := reach(off, target, h); err != nil {
+				return err
+			}
+			if op == OpJump {
+				continue
+			}
+			size = 3
+		case OpLoop:
+			target := off + 3 - short(off+1)
+			if target < 0 {
+				return fmt.Errorf("loop out of range at %v", off)
+			}
+			if err := reach(off, target, h); err != nil {
+				return err
+			}
+			continue
+		case OpReturn:
+			if h < 2 {
+				return fmt.Errorf("stack underflow at %v", off)
+			}
+			continue
+		}
+		if h-pop < 1 {
+			return fmt.Errorf("stack underflow at %v", off)
+		}
+		if err := reach(off, off+size, h-pop+push); err != nil {
+			return err
+		}
+	}
+	return nil
+}
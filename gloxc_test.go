@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestLoadRejects loads compiled programs with valid checksums whose code
+// would crash the vm, they must fail to load.
+func TestLoadRejects(t *testing.T) {
+	inner := &function{name: "f", arity: 1, upvalueCount: 1, chunk: chunk{
+		code:  []byte{byte(OpGetUpvalue), 0, byte(OpReturn)},
+		lines: []int{1, 1, 1},
+	}}
+	tests := []struct {
+		name     string
+		arity    int
+		upvalues int
+		code     []byte
+		consts   []value
+		err      string
+	}{
+		{"local out of the stack", 0, 0,
+			[]byte{byte(OpNil), byte(OpGetLocal), 200, byte(OpReturn)}, nil,
+			"local 200 out of range"},
+		{"local above the arguments", 1, 0,
+			[]byte{byte(OpGetLocal), 2, byte(OpReturn)}, nil,
+			"local 2 out of range"},
+		{"set local out of the stack", 0, 0,
+			[]byte{byte(OpNil), byte(OpSetLocal), 2, byte(OpReturn)}, nil,
+			"local 2 out of range"},
+		{"captured local out of the stack", 0, 0,
+			[]byte{byte(OpClosure), 0, 0, 1, 5, byte(OpReturn)}, []value{inner},
+			"local 5 out of range"},
+		{"bad upvalue kind", 0, 0,
+			[]byte{byte(OpClosure), 0, 0, 7, 0, byte(OpReturn)}, []value{inner},
+			"bad upvalue kind"},
+		{"call with more arguments than the stack", 0, 0,
+			[]byte{byte(OpNil), byte(OpCall), 3, byte(OpReturn)}, nil,
+			"stack underflow"},
+		{"tail call with more arguments than the stack", 0, 0,
+			[]byte{byte(OpNil), byte(OpTailCall), 9, byte(OpReturn)}, nil,
+			"stack underflow"},
+		{"binary operator on one value", 0, 0,
+			[]byte{byte(OpNil), byte(OpAdd), byte(OpReturn)}, nil,
+			"stack underflow"},
+		{"return of an empty stack", 0, 0,
+			[]byte{byte(OpPop), byte(OpReturn)}, nil,
+			"stack underflow"},
+		{"jump into an instruction", 0, 0,
+			[]byte{byte(OpJump), 0, 1, byte(OpConstant), 0, 0, byte(OpReturn)}, []value{1.0},
+			"jump into an instruction"},
+		{"paths with different heights", 0, 0,
+			[]byte{byte(OpTrue), byte(OpJumpIfFalse), 0, 1, byte(OpNil), byte(OpReturn)}, nil,
+			"stack height"},
+		{"script with parameters", 1, 0,
+			[]byte{byte(OpGetLocal), 1, byte(OpReturn)}, nil,
+			"script with parameters"},
+		{"script with upvalues", 0, 1,
+			[]byte{byte(OpGetUpvalue), 0, byte(OpReturn)}, nil,
+			"script with parameters or upvalues"},
+		{"script capturing its upvalue", 0, 1,
+			[]byte{byte(OpClosure), 0, 0, 0, 0, byte(OpReturn)}, []value{inner},
+			"script with parameters or upvalues"},
+	}
+	for _, tt := range tests {
+		lines := make([]int, len(tt.code))
+		for i := range lines {
+			lines[i] = 1
+		}
+		fn := &function{name: "script", arity: tt.arity, upvalueCount: tt.upvalues, chunk: chunk{
+			code: tt.code, lines: lines, constants: tt.consts,
+		}}
+		_, err := decodeProgram(encodeProgram(fn))
+		if err == nil {
+			t.Errorf("%v: loaded", tt.name)
+			continue
+		}
+		if _, ok := err.(LoadError); !ok || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v: got %v, want a LoadError about %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+// TestLoadHeader loads compiled programs with a broken header or payload.
+func TestLoadHeader(t *testing.T) {
+	stmts, errs := parseProgram("print 1;")
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	fn, errs := compile(stmts)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	tests := []struct {
+		name   string
+		change func(data []byte) []byte
+		err    string
+	}{
+		{"other version", func(data []byte) []byte {
+			binary.BigEndian.PutUint16(data[4:], gloxcVersion+1)
+			return data
+		}, "format version"},
+		{"changed payload", func(data []byte) []byte {
+			data[len(data)-1] ^= 0xff
+			return data
+		}, "checksum mismatch"},
+		{"truncated payload", func(data []byte) []byte {
+			return data[:len(data)-1]
+		}, "truncated"},
+		{"truncated header", func(data []byte) []byte {
+			return data[:gloxcHeader-1]
+		}, "not a compiled glox program"},
+	}
+	for _, tt := range tests {
+		_, err := decodeProgram(tt.change(encodeProgram(fn)))
+		if _, ok := err.(LoadError); !ok || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v: got %v, want a LoadError about %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+// TestLoadCompiled compiles the examples, they must load back and print
+// what they print when run from the source.
+func TestLoadCompiled(t *testing.T) {
+	files, err := filepath.Glob("examples/*.glx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := stdout
+	defer func() { stdout = saved }()
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stmts, errs := parseProgram(string(data))
+		if len(errs) > 0 {
+			t.Fatalf("%v: %v", file, errs)
+		}
+		fn, errs := compile(stmts)
+		if len(errs) > 0 {
+			t.Fatalf("%v: %v", file, errs)
+		}
+		loaded, err := decodeProgram(encodeProgram(fn))
+		if err != nil {
+			t.Errorf("%v: %v", file, err)
+			continue
+		}
+		var want, got bytes.Buffer
+		stdout = &want
+		wantErr := interpretVM(stmts)
+		stdout = &got
+		gotErr := runVM(loaded)
+		if got.String() != want.String() || fmt.Sprint(gotErr) != fmt.Sprint(wantErr) {
+			t.Errorf("%v: loaded program printed\n%s%v\nwant\n%s%v", file, &got, gotErr, &want, wantErr)
+		}
+	}
+}
@@ -1,3 +1,3 @@
 module github.com/ysmolsky/glox
 
-go 1.17
+go 1.18
@@ -4,21 +4,19 @@ import (
 	"errors"
 	"fmt"
 	"strings"
-	"time"
 )
 
-type RuntimeError string
-
-func (e RuntimeError) Error() string {
-	return string(e)
+func runtimeErr(t *tokenObj, code, msg string) error {
+	panic(RuntimeError{runtimeDiag(t, code, msg)})
 }
 
-func runtimeErr(t *tokenObj, msg string) error {
-	panic(RuntimeError(
-		fmt.Sprintf("[line %v] runtime error: %v", t.line, msg)))
+func runtimeDiag(t *tokenObj, code, msg string) *Diagnostic {
+	d := newDiag(phaseRuntime, code, t.line, msg)
+	d.Span = spanOf(t)
+	return d
 }
 
-type ReturnHack value
+type ReturnHack struct{ v value }
 type BreakErr struct{ t *tokenObj }
 type ContinueErr struct{ t *tokenObj }
 
@@ -62,40 +60,50 @@ func (e *Env) define(name string) {
 }
 
 func (e *Env) get(name *tokenObj) value {
-	if v, ok := e.values[name.lexeme]; ok {
-		if _, ok := e.init[name.lexeme]; !ok {
-			runtimeErr(name, "variable '"+name.lexeme+"' should be initialized first")
+	for env := e; env != nil; env = env.enclosing {
+		if v, ok := env.values[name.lexeme]; ok {
+			if _, ok := env.init[name.lexeme]; !ok {
+				runtimeErr(name, codeUninit, "variable '"+name.lexeme+"' should be initialized first")
+			}
+			return v
 		}
-		return v
-	}
-	if e.enclosing != nil {
-		return e.enclosing.get(name)
 	}
-
-	runtimeErr(name, "undefined variable '"+name.lexeme+"'")
+	e.undefined(name)
 	return nil
 }
 
 func (e *Env) assign(name *tokenObj, v value) {
-	if _, ok := e.values[name.lexeme]; ok {
-		e.values[name.lexeme] = v
-		e.init[name.lexeme] = true
-		return
-	}
-	if e.enclosing != nil {
-		e.enclosing.assign(name, v)
-		return
+	for env := e; env != nil; env = env.enclosing {
+		if _, ok := env.values[name.lexeme]; ok {
+			env.values[name.lexeme] = v
+			env.init[name.lexeme] = true
+			if hook != nil {
+				hook.assign(name, v, env)
+			}
+			return
+		}
 	}
+	e.undefined(name)
+}
 
-	runtimeErr(name, "undefined variable '"+name.lexeme+"'")
-	return
+// undefined raises the error for the name, suggesting a name visible in e.
+func (e *Env) undefined(name *tokenObj) {
+	var names []string
+	for env := e; env != nil; env = env.enclosing {
+		for n := range env.values {
+			names = append(names, n)
+		}
+	}
+	d := runtimeDiag(name, codeUndefined, "undefined variable '"+name.lexeme+"'")
+	d.addHint(nameHint(name.lexeme, names), name)
+	panic(RuntimeError{d})
 }
 
 // ------------------------------------------
 // interpret
 
 func interpret(stmt []Stmt, env *Env) (err error) {
-	env.defineInit("clock", clockFn{})
+	defineGlobals(env.defineInit)
 	defer func() {
 		if e := recover(); e != nil {
 			if b, ok := e.(BreakErr); ok {
@@ -104,26 +112,40 @@ func interpret(stmt []Stmt, env *Env) (err error) {
 				err = errors.New(s)
 				return
 			}
-			err = e.(RuntimeError)
+			if x, ok := e.(ExitError); ok {
+				err = x
+				return
+			}
+			rerr, ok := e.(RuntimeError)
+			if !ok {
+				panic(e)
+			}
+			err = rerr
 		}
 	}()
 	for _, s := range stmt {
-		s.execute(env)
+		exec(s, env)
 	}
 	return nil
 }
 
-// ------------------------------------------
-// clockFn
-
-type clockFn struct{}
-
-func (c clockFn) arity() int {
-	return 0
+// execHook is told about the execution of the program, it is set by the
+// debugger, coverage, the profiler or the tracer and is nil otherwise.
+type execHook interface {
+	stmt(s Stmt, env *Env)                    // before the statement is executed
+	enter(fn Callable, env *Env)              // the body of fn starts in env
+	leave(v value, returned bool)             // the body returned v or panics
+	assign(name *tokenObj, v value, env *Env) // the variable of env is assigned
 }
 
-func (c clockFn) call(_ *Env, _ []value) value {
-	return float64(time.Now().UnixNano())
+var hook execHook
+
+// exec executes the statement, all statements are executed through it.
+func exec(s Stmt, env *Env) {
+	if hook != nil {
+		hook.stmt(s, env)
+	}
+	s.execute(env)
 }
 
 // ------------------------------------------
@@ -138,20 +160,8 @@ func (f *FunObj) arity() int {
 	return len(f.decl.params)
 }
 
-func (f *FunObj) call(e *Env, args []value) (v value) {
-	env := NewEnv(f.closure)
-	for i, p := range f.decl.params {
-		env.defineInit(p.lexeme, args[i])
-	}
-
-	defer func() {
-		if e := recover(); e != nil {
-			// return whatever value is being panicked at us from return stmt
-			v = e.(ReturnHack)
-		}
-	}()
-	execBlock(f.decl.body, env)
-	return nil
+func (f *FunObj) call(e *Env, args []value) value {
+	return callFun(f, args)
 }
 
 func (f *FunObj) String() string {
@@ -167,21 +177,8 @@ func (f *FunAnon) arity() int {
 	return len(f.decl.params)
 }
 
-func (f *FunAnon) call(e *Env, args []value) (v value) {
-	// Should it use env that is passed by e?
-	env := NewEnv(f.closure)
-	for i, p := range f.decl.params {
-		env.defineInit(p.lexeme, args[i])
-	}
-
-	defer func() {
-		if e := recover(); e != nil {
-			// return whatever value is being panicked at us from return stmt
-			v = e.(ReturnHack)
-		}
-	}()
-	execBlock(f.decl.body, env)
-	return nil
+func (f *FunAnon) call(e *Env, args []value) value {
+	return callFun(f, args)
 }
 
 func (f *FunAnon) String() string {
@@ -192,6 +189,69 @@ func (f *FunAnon) String() string {
 	return fmt.Sprintf("<lambda (%v)>", strings.Join(s, ","))
 }
 
+// tailCall is returned by a function instead of the result of the call in
+// its return statement, the caller makes the call in its place.
+type tailCall struct {
+	fn    Callable
+	args  []value
+	paren *tokenObj
+}
+
+// callDepth is the number of glox functions being executed.
+var callDepth = 0
+
+const maxCallDepth = 10000
+
+// callFun calls a glox function. Calls in tail position are made in a loop
+// here, so tail recursion does not grow the Go stack.
+func callFun(fn Callable, args []value) value {
+	var paren *tokenObj
+	for {
+		var v value
+		switch f := fn.(type) {
+		case *FunObj:
+			v = runBody(f, f.decl.params, f.decl.body, f.closure, args)
+		case *FunAnon:
+			v = runBody(f, f.decl.params, f.decl.body, f.closure, args)
+		default:
+			return callNative(paren, fn, args)
+		}
+		tc, ok := v.(*tailCall)
+		if !ok {
+			return v
+		}
+		fn, args, paren = tc.fn, tc.args, tc.paren
+	}
+}
+
+func runBody(fn Callable, params []*tokenObj, body []Stmt, closure *Env, args []value) (v value) {
+	env := NewEnv(closure)
+	for i, p := range params {
+		env.defineInit(p.lexeme, args[i])
+	}
+
+	callDepth++
+	if hook != nil {
+		hook.enter(fn, env)
+	}
+	defer func() {
+		callDepth--
+		e := recover()
+		// return whatever value is being panicked at us from return stmt
+		if r, ok := e.(ReturnHack); ok {
+			v, e = r.v, nil
+		}
+		if hook != nil {
+			hook.leave(v, e == nil)
+		}
+		if e != nil {
+			panic(e)
+		}
+	}()
+	execBlock(body, env)
+	return nil
+}
+
 // ------------------------------------------
 // Expression Eval
 
@@ -206,22 +266,22 @@ func (e *BinaryExpr) eval(env *Env) value {
 			if yok {
 				return xval + yval
 			}
-			runtimeErr(e.operator, "expected number as right operand")
+			runtimeErr(e.operator, codeOperands, "expected number as right operand")
 		}
 		if xval, xok := x.(string); xok {
 			if yval, yok := e.right.eval(env).(string); yok {
 				return xval + yval
 			}
-			runtimeErr(e.operator, "expected string as right operand")
+			runtimeErr(e.operator, codeOperands, "expected string as right operand")
 		}
-		runtimeErr(e.operator, "operands must be two numbers or two strings")
+		runtimeErr(e.operator, codeOperands, "operands must be two numbers or two strings")
 	case Minus:
 		xval, yval := e.evalFloats(env)
 		return xval - yval
 	case Slash:
 		xval, yval := e.evalFloats(env)
 		if yval == 0 {
-			runtimeErr(e.operator, "division by zero")
+			runtimeErr(e.operator, codeDivZero, "division by zero")
 		}
 		return xval / yval
 	case Star:
@@ -250,11 +310,11 @@ func (e *BinaryExpr) eval(env *Env) value {
 func (e *BinaryExpr) evalFloats(env *Env) (float64, float64) {
 	x, ok := e.left.eval(env).(float64)
 	if !ok {
-		runtimeErr(e.operator, "left operand must be a number")
+		runtimeErr(e.operator, codeOperands, "left operand must be a number")
 	}
 	y, ok := e.right.eval(env).(float64)
 	if !ok {
-		runtimeErr(e.operator, "left operand must be a number")
+		runtimeErr(e.operator, codeOperands, "right operand must be a number")
 	}
 	return x, y
 }
@@ -272,6 +332,19 @@ func (e *BinaryExpr) equal(env *Env) bool {
 }
 
 func (e *CallExpr) eval(env *Env) value {
+	fn, args := e.prepare(env)
+	switch fn.(type) {
+	case *FunObj, *FunAnon:
+		if callDepth >= maxCallDepth {
+			runtimeErr(e.paren, codeStackOverflow, "stack overflow")
+		}
+		return fn.call(env, args)
+	}
+	return callNative(e.paren, fn, args)
+}
+
+// prepare evaluates the callee and the arguments of the call.
+func (e *CallExpr) prepare(env *Env) (Callable, []value) {
 	callee := e.callee.eval(env)
 	args := make([]value, 0)
 	for _, a := range e.args {
@@ -279,14 +352,14 @@ func (e *CallExpr) eval(env *Env) value {
 	}
 	if fn, ok := callee.(Callable); ok {
 		if len(args) != fn.arity() {
-			runtimeErr(e.paren,
+			runtimeErr(e.paren, codeArity,
 				fmt.Sprintf("expected %v arguments but got %v", fn.arity(), len(args)))
 		}
-		return fn.call(env, args)
+		return fn, args
 	} else {
 		err := fmt.Sprintf("'%v' is not a function or class", callee)
-		runtimeErr(e.paren, err)
-		return nil
+		runtimeErr(e.paren, codeNotCallable, err)
+		return nil, nil
 	}
 }
 
@@ -323,8 +396,7 @@ func (e *UnaryExpr) eval(env *Env) value {
 	case Minus:
 		f, ok := val.(float64)
 		if !ok {
-			// TODO: handle this as error
-			panic("not a float")
+			runtimeErr(e.operator, codeOperands, "operand must be a number")
 		}
 		return -f
 	case Bang:
@@ -369,7 +441,7 @@ func (s *FunStmt) execute(env *Env) {
 
 func (s *PrintStmt) execute(env *Env) {
 	v := s.expression.eval(env)
-	fmt.Printf("%v\n", v)
+	fmt.Fprintf(stdout, "%v\n", v)
 }
 
 func (s *VarStmt) execute(env *Env) {
@@ -388,25 +460,34 @@ func (s *BlockStmt) execute(env *Env) {
 
 func execBlock(list []Stmt, env *Env) {
 	for _, s := range list {
-		s.execute(env)
+		exec(s, env)
 	}
 }
 
 func (s *IfStmt) execute(env *Env) {
 	if isTruthy(s.condition.eval(env)) {
-		s.block1.execute(env)
+		exec(s.block1, env)
 	} else if s.block2 != nil {
-		s.block2.execute(env)
+		exec(s.block2, env)
 	}
 }
 
 func (s *ReturnStmt) execute(env *Env) {
 	var v value
-	if s.value != nil {
+	if call, ok := s.value.(*CallExpr); ok {
+		fn, args := call.prepare(env)
+		switch fn.(type) {
+		case *FunObj, *FunAnon:
+			v = &tailCall{fn: fn, args: args, paren: call.paren}
+		default:
+			// in the frame, the functions natives call are deeper
+			v = callNative(call.paren, fn, args)
+		}
+	} else if s.value != nil {
 		v = s.value.eval(env)
 	}
 	// Ugly hack, panic to unwind the stack back to the call
-	panic(ReturnHack(v))
+	panic(ReturnHack{v})
 }
 
 func (s *BreakStmt) execute(env *Env) {
@@ -417,6 +498,39 @@ func (s *ContinueStmt) execute(env *Env) {
 	panic(ContinueErr{t: s.keyword})
 }
 
+func (s *ForStmt) execute(env *Env) {
+	if s.init != nil {
+		env = NewEnv(env)
+		exec(s.init, env)
+	}
+	for s.condition == nil || isTruthy(s.condition.eval(env)) {
+		if s.iterate(env) {
+			break
+		}
+		if s.increment != nil {
+			s.increment.eval(env)
+		}
+	}
+}
+
+// iterate runs the body once and reports whether the loop was broken.
+func (s *ForStmt) iterate(env *Env) (broken bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			switch e.(type) {
+			case ContinueErr:
+				broken = false
+			case BreakErr:
+				broken = true
+			default:
+				panic(e)
+			}
+		}
+	}()
+	exec(s.body, env)
+	return false
+}
+
 func (s *WhileStmt) execute(env *Env) {
 	for !s.isDone(env) {
 	}
@@ -440,7 +554,7 @@ func (s *WhileStmt) isDone(env *Env) (done bool) {
 		}
 	}()
 	for isTruthy(s.condition.eval(env)) {
-		s.body.execute(env)
+		exec(s.body, env)
 	}
 	return true
 }
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Linter reports mistakes the parser accepts. Each problem belongs to
+// a rule, rules can be disabled for the whole run or, by a comment
+//
+//	// lint:ignore rule, other
+//
+// for its line or, when alone on the line, for the next one. Without rules
+// the comment ignores all.
+
+type lintRule struct {
+	name    string
+	doc     string
+	enabled bool // by default
+}
+
+var lintRules = []*lintRule{
+	{"unused", "local variables, functions and parameters never used", true},
+	{"shadow", "declarations hiding a variable of an outer scope", true},
+	{"unreachable", "statements after return, break or continue", true},
+	{"undeclared", "uses and assignments of globals never declared", true},
+	{"assigncond", "assignments used as conditions", true},
+	{"uninit", "variables which may be read before they are assigned", true},
+	{"selfcompare", "comparison of an expression with itself", true},
+	{"libprint", "print in scripts declaring only variables and functions", true},
+	{"arity", "calls of known functions with a wrong number of arguments", true},
+}
+
+type lintIssue struct {
+	t    *tokenObj
+	diag *Diagnostic // the warning, its code is the name of the rule
+}
+
+func (i lintIssue) String() string {
+	return fmt.Sprintf("%v:%v: %v (%v)", i.t.line, i.t.col, i.diag.text(), i.diag.Code)
+}
+
+type linter struct {
+	enabled  map[string]bool
+	res      *resolution
+	assigned map[*tokenObj]bool // names of assignments
+	issues   []lintIssue
+}
+
+// defaultRules returns the rules enabled by default.
+func defaultRules() map[string]bool {
+	m := make(map[string]bool)
+	for _, r := range lintRules {
+		m[r.name] = r.enabled
+	}
+	return m
+}
+
+// lint returns the problems of the source found by the enabled rules, or
+// the errors when the source cannot be parsed.
+func lint(source string, enabled map[string]bool) ([]lintIssue, []error) {
+	s := NewScanner(source)
+	tokens, errs := s.scan()
+	stmts, perrs := NewParser(tokens).parse()
+	if errs = syntaxErrors(errs, perrs); len(errs) > 0 {
+		return nil, errs
+	}
+	res, errs := resolveHints(stmts, true)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	l := &linter{enabled: enabled, res: res, assigned: make(map[*tokenObj]bool)}
+	inspectList(stmts, func(n interface{}) bool {
+		if a, ok := n.(*AssignExpr); ok {
+			l.assigned[a.name] = true
+		}
+		return true
+	})
+
+	l.unused()
+	l.shadow()
+	l.unreachable(stmts)
+	inspectList(stmts, l.node)
+	for _, t := range uninitReads(stmts, res) {
+		l.report("uninit", t, "%v may be read before it is assigned", t.lexeme)
+	}
+	l.libprint(stmts)
+
+	issues := suppress(l.issues, s.comments, tokens)
+	sort.SliceStable(issues, func(i, j int) bool {
+		return before(issues[i].t, issues[j].t)
+	})
+	return issues, nil
+}
+
+// report adds the issue and returns its warning, nil when the rule is
+// disabled.
+func (l *linter) report(rule string, t *tokenObj, format string, args ...interface{}) *Diagnostic {
+	if !l.enabled[rule] {
+		return nil
+	}
+	d := errorAtToken(phaseLint, rule, t, fmt.Sprintf(format, args...))
+	d.Severity = severityWarning
+	l.issues = append(l.issues, lintIssue{t, d})
+	return d
+}
+
+func (l *linter) unused() {
+	for _, d := range l.res.decls {
+		if d.global || len(d.refs) > 0 || strings.HasPrefix(d.name.lexeme, "_") {
+			continue
+		}
+		switch d.kind {
+		case declVar:
+			l.report("unused", d.name, "variable %v is never used", d.name.lexeme)
+		case declFun:
+			l.report("unused", d.name, "function %v is never used", d.name.lexeme)
+		case declParam:
+			l.report("unused", d.name, "parameter %v is never used", d.name.lexeme)
+		}
+	}
+}
+
+func (l *linter) shadow() {
+	for _, d := range l.res.decls {
+		if s := d.shadows; s != nil {
+			l.report("shadow", d.name, "%v shadows the declaration at line %v",
+				d.name.lexeme, s.name.line)
+		}
+	}
+}
+
+// unreachable reports the first statement after a jump in every list of
+// statements.
+func (l *linter) unreachable(stmts []Stmt) {
+	check := func(list []Stmt) {
+		for i := 0; i+1 < len(list); i++ {
+			switch list[i].(type) {
+			case *ReturnStmt, *BreakStmt, *ContinueStmt:
+				if t := startToken(list[i+1]); t != nil {
+					l.report("unreachable", t, "unreachable code")
+				}
+				return
+			}
+		}
+	}
+	check(stmts)
+	inspectList(stmts, func(n interface{}) bool {
+		switch n := n.(type) {
+		case *BlockStmt:
+			check(n.list)
+		case *FunStmt:
+			check(n.body)
+		case *FunExpr:
+			check(n.body)
+		}
+		return true
+	})
+}
+
+func (l *linter) node(n interface{}) bool {
+	switch n := n.(type) {
+	case *AssignExpr:
+		if h, ok := l.res.hints[n.name]; ok {
+			l.report("undeclared", n.name, "assignment to undeclared variable %v", n.name.lexeme).addHint(h, n.name)
+		}
+	case *VarExpr:
+		if h, ok := l.res.hints[n.name]; ok {
+			l.report("undeclared", n.name, "undeclared variable %v", n.name.lexeme).addHint(h, n.name)
+		}
+	case *IfStmt:
+		l.assigncond(n.condition)
+	case *WhileStmt:
+		l.assigncond(n.condition)
+	case *ForStmt:
+		if n.condition != nil {
+			l.assigncond(n.condition)
+		}
+	case *BinaryExpr:
+		switch n.operator.tok {
+		case EqualEqual, BangEqual, Greater, GreaterEqual, Less, LessEqual:
+			if sameExpr(n.left, n.right) {
+				l.report("selfcompare", n.operator, "comparison of %v with itself", printAST(n.left))
+			}
+		}
+	case *CallExpr:
+		l.arity(n)
+	}
+	return true
+}
+
+// assigncond reports an assignment used as a condition, likely meant to be
+// a comparison. Parentheses around it mark it as intended.
+func (l *linter) assigncond(cond Expr) {
+	if a, ok := cond.(*AssignExpr); ok {
+		l.report("assigncond", a.name, "assignment to %v used as a condition", a.name.lexeme).
+			addHint(&hint{note: "did you mean '=='?"}, nil)
+	}
+}
+
+// sameExpr reports whether the expressions are equal and have no calls
+// which could return different values.
+func sameExpr(a, b Expr) bool {
+	calls := false
+	inspect(a, func(n interface{}) bool {
+		if _, ok := n.(*CallExpr); ok {
+			calls = true
+		}
+		return !calls
+	})
+	return !calls && printAST(a) == printAST(b)
+}
+
+func (l *linter) arity(call *CallExpr) {
+	v, ok := call.callee.(*VarExpr)
+	if !ok {
+		return
+	}
+	name := v.name.lexeme
+	want := -1
+	if d := l.res.refs[v.name]; d != nil {
+		if d.kind == declFun && !l.reassigned(d) && (!d.global || len(l.res.globals[name]) == 1) {
+			want = len(d.params)
+		}
+	} else {
+		for _, fn := range natives {
+			if fn.name == name {
+				want = fn.nargs
+			}
+		}
+	}
+	if want >= 0 && want != len(call.args) {
+		l.report("arity", v.name, "%v expects %v arguments but got %v", name, want, len(call.args))
+	}
+}
+
+// reassigned reports whether the name of the declaration is assigned.
+func (l *linter) reassigned(d *decl) bool {
+	for _, t := range d.refs {
+		if l.assigned[t] {
+			return true
+		}
+	}
+	return false
+}
+
+// libprint reports print statements in a library, a script whose top level
+// only declares.
+func (l *linter) libprint(stmts []Stmt) {
+	for _, s := range stmts {
+		switch s.(type) {
+		case *VarStmt, *FunStmt:
+		default:
+			return
+		}
+	}
+	inspectList(stmts, func(n interface{}) bool {
+		if p, ok := n.(*PrintStmt); ok {
+			l.report("libprint", p.keyword, "print in library code")
+		}
+		return true
+	})
+}
+
+// isPredeclared reports whether the name is defined by defineGlobals.
+func isPredeclared(name string) bool {
+	predeclared := false
+	defineGlobals(func(n string, _ value) {
+		predeclared = predeclared || n == name
+	})
+	return predeclared
+}
+
+// suppress drops the issues ignored by lint:ignore comments.
+func suppress(issues []lintIssue, comments, tokens []*tokenObj) []lintIssue {
+	type key struct {
+		line int
+		rule string
+	}
+	first := make(map[int]*tokenObj) // first token of a line
+	for _, t := range tokens {
+		if first[t.line] == nil {
+			first[t.line] = t
+		}
+	}
+	ignored := make(map[key]bool)
+	for _, c := range comments {
+		text := strings.TrimSpace(commentText(c.lexeme))
+		if !strings.HasPrefix(text, "lint:ignore") {
+			continue
+		}
+		rules := strings.FieldsFunc(strings.TrimPrefix(text, "lint:ignore"), func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(rules) == 0 {
+			rules = []string{""}
+		}
+		line := c.line
+		if t := first[line]; t == nil || !before(t, c) {
+			line = endLine(c) + 1
+		}
+		for _, r := range rules {
+			ignored[key{line, r}] = true
+		}
+	}
+	res := issues[:0]
+	for _, i := range issues {
+		if !ignored[key{i.t.line, i.diag.Code}] && !ignored[key{i.t.line, ""}] {
+			res = append(res, i)
+		}
+	}
+	return res
+}
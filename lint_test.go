@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestLintRules lints sources with a mistake of every rule, and the
+// comments ignoring them.
+func TestLintRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   []string
+	}{
+		{"unused", "fun f() { var x = 1; }\nf();",
+			[]string{"1:15: variable x is never used (unused)"}},
+		{"unused with _", "fun f(_a) { var _x = 1; }\nf(1);", nil},
+		{"shadow", "var x = 1;\nfun f() { var x = 2; return x; }\nprint f() + x;",
+			[]string{"2:15: x shadows the declaration at line 1 (shadow)"}},
+		{"unreachable", "fun f() { return 1; print 2; }\nprint f();",
+			[]string{"1:21: unreachable code (unreachable)"}},
+		{"undeclared", "var count = 1;\nprint cout;\ntotal = 2;",
+			[]string{
+				"2:7: undeclared variable cout; did you mean 'count'? (undeclared)",
+				"3:1: assignment to undeclared variable total (undeclared)",
+			}},
+		{"assigncond", "var a = 1;\nif (a = 2) print a;\nif ((a = 3)) print a;",
+			[]string{"2:5: assignment to a used as a condition; did you mean '=='? (assigncond)"}},
+		{"uninit", "fun f() { var x; if (clock() > 0) x = 1; return x; }\nprint f();",
+			[]string{"1:49: x may be read before it is assigned (uninit)"}},
+		{"selfcompare", "var a = 1;\nprint a == a;\nprint clock() == clock();",
+			[]string{"2:9: comparison of a with itself (selfcompare)"}},
+		{"libprint", "var a = 1;\nfun f() { print a; }",
+			[]string{"2:11: print in library code (libprint)"}},
+		{"arity", "fun f(a) { return a; }\nprint f(1, 2);\nprint clock(1);",
+			[]string{
+				"2:7: f expects 1 arguments but got 2 (arity)",
+				"3:7: clock expects 0 arguments but got 1 (arity)",
+			}},
+
+		{"ignore the rule", "fun f() { var x = 1; } // lint:ignore unused\nf();", nil},
+		{"ignore another rule", "fun f() { var x = 1; } // lint:ignore shadow\nf();",
+			[]string{"1:15: variable x is never used (unused)"}},
+		{"ignore a list", "fun f() { var x = 1; } // lint:ignore shadow, unused\nf();", nil},
+		{"ignore all on the next line", "// lint:ignore\nfun f() { var x = 1; return y; }\nf();", nil},
+		{"ignore the next line only", "// lint:ignore\nfun f() { var x = 1; }\nfun g() { var y = 1; }\nf();\ng();",
+			[]string{"3:15: variable y is never used (unused)"}},
+	}
+	for _, tt := range tests {
+		issues, errs := lint(tt.source, defaultRules())
+		if len(errs) > 0 {
+			t.Errorf("%v: %v", tt.name, errs)
+			continue
+		}
+		var got []string
+		for _, i := range issues {
+			got = append(got, i.String())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestLintDisabled lints with a rule disabled for the whole run.
+func TestLintDisabled(t *testing.T) {
+	enabled := defaultRules()
+	enabled["unused"] = false
+	issues, errs := lint("fun f() { var x = 1; return y; }\nf();", enabled)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if len(issues) != 1 || issues[0].diag.Code != "undeclared" {
+		t.Errorf("got %v, want only the undeclared y", issues)
+	}
+}
@@ -0,0 +1,793 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Language server speaking LSP over a pair of streams, documents are
+// synchronized in full on every change.
+
+type lspServer struct {
+	in       *bufio.Reader
+	out      io.Writer
+	docs     map[string]*document
+	shutdown bool
+}
+
+type rpcMessage struct {
+	ID     *json.RawMessage `json:"id"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	rpcParseError     = -32700
+	rpcInvalidParams  = -32602
+	rpcMethodNotFound = -32601
+	rpcInternalError  = -32603
+	rpcRequestFailed  = -32803
+)
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Code     string   `json:"code,omitempty"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+type lspSymbol struct {
+	Name           string      `json:"name"`
+	Kind           int         `json:"kind"`
+	Range          lspRange    `json:"range"`
+	SelectionRange lspRange    `json:"selectionRange"`
+	Children       []lspSymbol `json:"children,omitempty"`
+}
+
+type lspCompletion struct {
+	Label  string `json:"label"`
+	Kind   int    `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// kinds of symbols and completions
+const (
+	symbolFunction   = 12
+	symbolVariable   = 13
+	completeFunction = 3
+	completeVariable = 6
+	completeKeyword  = 14
+)
+
+type positionParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+// serveLSP answers the requests read from in until the exit notification
+// or the end of in. It returns the exit code.
+func serveLSP(in io.Reader, out io.Writer) int {
+	s := &lspServer{
+		in:   bufio.NewReader(in),
+		out:  out,
+		docs: make(map[string]*document),
+	}
+	for {
+		data, err := readMessage(s.in)
+		if err != nil {
+			if err == io.EOF {
+				return exitOK
+			}
+			fmt.Fprintln(os.Stderr, err)
+			return exitSoftware
+		}
+		var m rpcMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			s.reply(nil, nil, &rpcError{rpcParseError, err.Error()})
+			continue
+		}
+		if m.Method == "exit" {
+			if s.shutdown {
+				return exitOK
+			}
+			return exitFindings
+		}
+		result, rerr := s.call(m.Method, m.Params)
+		if m.ID != nil {
+			s.reply(m.ID, result, rerr)
+		}
+	}
+}
+
+// readMessage reads the content of a message with its headers.
+func readMessage(r *bufio.Reader) ([]byte, error) {
+	h, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		if err == io.EOF || len(h) == 0 {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	n, err := strconv.Atoi(h.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("lsp: bad Content-Length: %v", err)
+	}
+	data := make([]byte, n)
+	_, err = io.ReadFull(r, data)
+	return data, err
+}
+
+func writeMessage(w io.Writer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(w, "Content-Length: %d\r\n\r\n%s", len(data), data)
+}
+
+func (s *lspServer) reply(id *json.RawMessage, result interface{}, err *rpcError) {
+	m := map[string]interface{}{"jsonrpc": "2.0", "id": id}
+	if err != nil {
+		m["error"] = err
+	} else {
+		m["result"] = result
+	}
+	writeMessage(s.out, m)
+}
+
+func (s *lspServer) notify(method string, params interface{}) {
+	writeMessage(s.out, map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  method,
+		"params":  params,
+	})
+}
+
+// call handles the message, a panic fails the request instead of the
+// server.
+func (s *lspServer) call(method string, params json.RawMessage) (result interface{}, rerr *rpcError) {
+	defer func() {
+		if e := recover(); e != nil {
+			result, rerr = nil, &rpcError{rpcInternalError, fmt.Sprintf("%v failed: %v", method, e)}
+		}
+	}()
+	return s.handle(method, params)
+}
+
+func (s *lspServer) handle(method string, params json.RawMessage) (interface{}, *rpcError) {
+	switch method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":       1, // full
+				"definitionProvider":     true,
+				"referencesProvider":     true,
+				"hoverProvider":          true,
+				"documentSymbolProvider": true,
+				"completionProvider":     map[string]interface{}{},
+				"renameProvider":         true,
+			},
+			"serverInfo": map[string]string{"name": "glox"},
+		}, nil
+	case "initialized", "$/cancelRequest", "$/setTrace", "workspace/didChangeConfiguration":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var p struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+		s.update(p.TextDocument.URI, p.TextDocument.Text)
+		return nil, nil
+	case "textDocument/didChange":
+		var p struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+		if n := len(p.ContentChanges); n > 0 {
+			s.update(p.TextDocument.URI, p.ContentChanges[n-1].Text)
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		var p positionParams
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+		delete(s.docs, p.TextDocument.URI)
+		s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+			"uri":         p.TextDocument.URI,
+			"diagnostics": []lspDiagnostic{},
+		})
+		return nil, nil
+	case "textDocument/definition", "textDocument/references", "textDocument/hover",
+		"textDocument/completion", "textDocument/rename":
+		var p struct {
+			positionParams
+			Context struct {
+				IncludeDeclaration bool `json:"includeDeclaration"`
+			} `json:"context"`
+			NewName string `json:"newName"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+		d := s.docs[p.TextDocument.URI]
+		if d == nil {
+			return nil, &rpcError{rpcInvalidParams, "unknown document " + p.TextDocument.URI}
+		}
+		line, col := d.bytePos(p.Position)
+		switch method {
+		case "textDocument/definition":
+			return d.definition(line, col), nil
+		case "textDocument/references":
+			return d.references(line, col, p.Context.IncludeDeclaration), nil
+		case "textDocument/hover":
+			return d.hover(line, col), nil
+		case "textDocument/completion":
+			return d.completion(line, col), nil
+		default:
+			return d.rename(line, col, p.NewName)
+		}
+	case "textDocument/documentSymbol":
+		var p positionParams
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+		d := s.docs[p.TextDocument.URI]
+		if d == nil {
+			return nil, &rpcError{rpcInvalidParams, "unknown document " + p.TextDocument.URI}
+		}
+		return d.symbols(d.stmts), nil
+	}
+	if strings.HasPrefix(method, "$/") {
+		return nil, nil
+	}
+	return nil, &rpcError{rpcMethodNotFound, "method not supported: " + method}
+}
+
+func (s *lspServer) update(uri, text string) {
+	d := analyze(uri, text)
+	s.docs[uri] = d
+	s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+		"uri":         uri,
+		"diagnostics": d.diags,
+	})
+}
+
+// document is an open file with the results of its analysis: the tree and
+// the resolved names, of the declarations without errors.
+type document struct {
+	uri    string
+	lines  []string
+	tokens []*tokenObj
+	stmts  []Stmt
+	ends   map[interface{}]int
+	res    *resolution
+	diags  []lspDiagnostic
+}
+
+func analyze(uri, text string) *document {
+	d := &document{uri: uri, lines: strings.Split(text, "\n"), diags: []lspDiagnostic{}}
+	s := NewScanner(text)
+	s.keepTrivia = true
+	tokens, errs := s.scan()
+	p := NewParser(tokens)
+	p.ends = make(map[interface{}]int)
+	stmts, perrs := p.parse()
+	// the declarations around syntax errors are parsed, their names can
+	// still be found
+	d.tokens, d.stmts, d.ends = tokens, stmts, p.ends
+	res, rerrs := resolve(stmts)
+	d.res = res
+	if errs = syntaxErrors(errs, perrs); len(errs) == 0 {
+		errs = rerrs
+	}
+	if len(errs) > 0 {
+		d.errors(errs)
+		return d
+	}
+	issues, _ := lint(text, defaultRules())
+	for _, i := range issues {
+		d.diags = append(d.diags, lspDiagnostic{
+			Range:    d.tokenRange(i.t),
+			Severity: 2,
+			Code:     i.diag.Code,
+			Source:   "glox lint",
+			Message:  fmt.Sprintf("%v (%v)", i.diag.text(), i.diag.Code),
+		})
+	}
+	return d
+}
+
+// errors adds diagnostics for the errors, which span their tokens or the
+// lines they are reported at.
+func (d *document) errors(errs []error) {
+	for _, e := range errs {
+		diag := diagnosticOf(e)
+		line := diag.Span.Line
+		if line < 1 {
+			line = 1
+		}
+		if line > len(d.lines) {
+			line = len(d.lines)
+		}
+		r := lspRange{
+			Start: lspPosition{line - 1, 0},
+			End:   d.lspPos(line, len(d.lines[line-1])+1),
+		}
+		if s := diag.Span; s.Col > 0 && s.Line <= len(d.lines) {
+			r = lspRange{d.lspPos(s.Line, s.Col), d.lspPos(s.EndLine, s.EndCol)}
+		}
+		d.diags = append(d.diags, lspDiagnostic{
+			Range:    r,
+			Severity: 1,
+			Code:     diag.Code,
+			Source:   "glox",
+			Message:  diag.text(),
+		})
+	}
+}
+
+// lspPos converts the line and byte column, both from 1, to the position
+// of LSP counting UTF-16 units from 0.
+func (d *document) lspPos(line, col int) lspPosition {
+	if line > len(d.lines) {
+		return lspPosition{line - 1, 0}
+	}
+	s := d.lines[line-1]
+	if col-1 < len(s) {
+		s = s[:col-1]
+	}
+	return lspPosition{line - 1, len(utf16.Encode([]rune(s)))}
+}
+
+// bytePos returns the line and column of the position, clamped to the
+// document.
+func (d *document) bytePos(p lspPosition) (line, col int) {
+	if p.Line < 0 {
+		return 1, 1
+	}
+	if p.Line >= len(d.lines) {
+		last := len(d.lines) - 1
+		return last + 1, len(d.lines[last]) + 1
+	}
+	s := d.lines[p.Line]
+	units := 0
+	for i, r := range s {
+		if units >= p.Character {
+			return p.Line + 1, i + 1
+		}
+		units += len(utf16.Encode([]rune{r}))
+	}
+	return p.Line + 1, len(s) + 1
+}
+
+// tokenEnd returns the position right after the token.
+func tokenEnd(t *tokenObj) (line, col int) {
+	if i := strings.LastIndexByte(t.lexeme, '\n'); i >= 0 {
+		return endLine(t), len(t.lexeme) - i
+	}
+	return t.line, t.col + len(t.lexeme)
+}
+
+func (d *document) tokenRange(t *tokenObj) lspRange {
+	line, col := tokenEnd(t)
+	return lspRange{d.lspPos(t.line, t.col), d.lspPos(line, col)}
+}
+
+// nodeRange returns the range of the node up to its last token.
+func (d *document) nodeRange(n interface{}) lspRange {
+	start := startToken(n)
+	last := d.tokens[d.ends[n]-1]
+	line, col := tokenEnd(last)
+	return lspRange{d.lspPos(start.line, start.col), d.lspPos(line, col)}
+}
+
+// nameAt returns the identifier at the position, a position right after
+// the identifier counts too.
+func (d *document) nameAt(line, col int) *tokenObj {
+	for _, t := range d.tokens {
+		if t.tok == Identifier && t.line == line && t.col <= col && col <= t.col+len(t.lexeme) {
+			return t
+		}
+	}
+	return nil
+}
+
+// declAt returns the declaration of the name at the position.
+func (d *document) declAt(line, col int) (*tokenObj, *decl) {
+	if d.res == nil {
+		return nil, nil
+	}
+	t := d.nameAt(line, col)
+	if t == nil {
+		return nil, nil
+	}
+	if dcl := d.res.refs[t]; dcl != nil {
+		return t, dcl
+	}
+	for _, dcl := range d.res.decls {
+		if dcl.name == t {
+			return t, dcl
+		}
+	}
+	return t, nil
+}
+
+func (d *document) location(t *tokenObj) lspLocation {
+	return lspLocation{URI: d.uri, Range: d.tokenRange(t)}
+}
+
+func (d *document) definition(line, col int) interface{} {
+	_, dcl := d.declAt(line, col)
+	if dcl == nil {
+		return nil
+	}
+	return d.location(dcl.name)
+}
+
+func (d *document) references(line, col int, withDecl bool) []lspLocation {
+	locs := []lspLocation{}
+	_, dcl := d.declAt(line, col)
+	if dcl == nil {
+		return locs
+	}
+	if withDecl {
+		locs = append(locs, d.location(dcl.name))
+	}
+	for _, t := range dcl.refs {
+		locs = append(locs, d.location(t))
+	}
+	return locs
+}
+
+func (d *document) hover(line, col int) interface{} {
+	t, dcl := d.declAt(line, col)
+	if t == nil {
+		return nil
+	}
+	var sig, doc string
+	switch {
+	case dcl == nil:
+		for _, fn := range natives {
+			if fn.name == t.lexeme {
+				sig = fmt.Sprintf("native fun %v (%v arguments)", fn.name, fn.nargs)
+			}
+		}
+		if sig == "" {
+			return nil
+		}
+	case dcl.kind == declFun:
+		sig = fmt.Sprintf("fun %v(%v)", dcl.name.lexeme, joinNames(dcl.params))
+		doc = d.docOf(dcl)
+	case dcl.kind == declParam:
+		sig = "parameter " + dcl.name.lexeme
+	default:
+		sig = "var " + dcl.name.lexeme
+		doc = d.docOf(dcl)
+	}
+	value := "```glox\n" + sig + "\n```"
+	if doc != "" {
+		value += "\n\n" + doc
+	}
+	return map[string]interface{}{
+		"contents": map[string]string{"kind": "markdown", "value": value},
+		"range":    d.tokenRange(t),
+	}
+}
+
+// docOf returns the doc comment of the statement declaring dcl.
+func (d *document) docOf(dcl *decl) string {
+	for i, t := range d.tokens {
+		if t == dcl.name && i > 0 {
+			return docComment(d.tokens[i-1])
+		}
+	}
+	return ""
+}
+
+func joinNames(names []*tokenObj) string {
+	s := make([]string, 0, len(names))
+	for _, n := range names {
+		s = append(s, n.lexeme)
+	}
+	return strings.Join(s, ", ")
+}
+
+func (d *document) symbols(list []Stmt) []lspSymbol {
+	syms := []lspSymbol{}
+	for _, s := range list {
+		switch s := s.(type) {
+		case *FunStmt:
+			syms = append(syms, lspSymbol{
+				Name:           s.name.lexeme,
+				Kind:           symbolFunction,
+				Range:          d.nodeRange(s),
+				SelectionRange: d.tokenRange(s.name),
+				Children:       d.symbols(s.body),
+			})
+		case *VarStmt:
+			sym := lspSymbol{
+				Name:           s.name.lexeme,
+				Kind:           symbolVariable,
+				Range:          d.nodeRange(s),
+				SelectionRange: d.tokenRange(s.name),
+			}
+			if fn, ok := s.init.(*FunExpr); ok {
+				sym.Kind = symbolFunction
+				sym.Children = d.symbols(fn.body)
+			}
+			syms = append(syms, sym)
+		}
+	}
+	return syms
+}
+
+func (d *document) completion(line, col int) []lspCompletion {
+	items := make([]lspCompletion, 0)
+	for k := range keywords {
+		items = append(items, lspCompletion{Label: k, Kind: completeKeyword})
+	}
+	seen := make(map[string]bool)
+	add := func(name string, kind int, detail string) {
+		if !seen[name] {
+			seen[name] = true
+			items = append(items, lspCompletion{Label: name, Kind: kind, Detail: detail})
+		}
+	}
+	for _, fn := range natives {
+		add(fn.name, completeFunction, "native")
+	}
+	add("args", completeVariable, "list of script arguments")
+	if d.res != nil {
+		at := &tokenObj{line: line, col: col}
+		for _, dcl := range d.visible(at) {
+			kind := completeVariable
+			if dcl.kind == declFun {
+				kind = completeFunction
+			}
+			add(dcl.name.lexeme, kind, "")
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Label < items[j].Label
+	})
+	return items
+}
+
+// visible returns the declarations in scope at the position, innermost
+// first.
+func (d *document) visible(at *tokenObj) []*decl {
+	byName := make(map[*tokenObj]*decl)
+	for _, dcl := range d.res.decls {
+		byName[dcl.name] = dcl
+	}
+	var list []*decl
+	add := func(t *tokenObj) {
+		if dcl := byName[t]; dcl != nil {
+			list = append(list, dcl)
+		}
+	}
+	var walk func(stmts []Stmt)
+	var descend func(n interface{})
+	walk = func(stmts []Stmt) {
+		for _, s := range stmts {
+			if !before(startToken(s), at) {
+				break
+			}
+			switch s := s.(type) {
+			case *FunStmt:
+				add(s.name)
+			case *VarStmt:
+				if !d.contains(s, at) {
+					add(s.name)
+				}
+			}
+			if d.contains(s, at) {
+				descend(s)
+			}
+		}
+	}
+	descend = func(n interface{}) {
+		switch n := n.(type) {
+		case *BlockStmt:
+			walk(n.list)
+			return
+		case *FunStmt:
+			for _, p := range n.params {
+				add(p)
+			}
+			walk(n.body)
+			return
+		case *FunExpr:
+			for _, p := range n.params {
+				add(p)
+			}
+			walk(n.body)
+			return
+		case *ForStmt:
+			if v, ok := n.init.(*VarStmt); ok && !d.contains(v, at) {
+				add(v.name)
+			}
+		}
+		for _, c := range astChildren(n) {
+			if d.contains(c, at) {
+				descend(c)
+			}
+		}
+	}
+	// globals are visible everywhere
+	for _, ds := range d.res.globals {
+		list = append(list, ds[len(ds)-1])
+	}
+	walk(d.stmts)
+	// innermost declarations first
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	return list
+}
+
+// contains reports whether the position is inside the node.
+func (d *document) contains(n interface{}, at *tokenObj) bool {
+	start := startToken(n)
+	if start == nil || before(at, start) {
+		return false
+	}
+	line, col := tokenEnd(d.tokens[d.ends[n]-1])
+	return before(at, &tokenObj{line: line, col: col + 1})
+}
+
+func (d *document) rename(line, col int, name string) (interface{}, *rpcError) {
+	_, dcl := d.declAt(line, col)
+	if dcl == nil {
+		return nil, &rpcError{rpcRequestFailed, "no variable at the position"}
+	}
+	if dcl.global {
+		return nil, &rpcError{rpcRequestFailed, "only local variables can be renamed"}
+	}
+	if !isIdentifier(name) {
+		return nil, &rpcError{rpcInvalidParams, fmt.Sprintf("%q is not a valid name", name)}
+	}
+	if d.conflicts(dcl, name) {
+		return nil, &rpcError{rpcRequestFailed, fmt.Sprintf("%v is already used where %v is visible", name, dcl.name.lexeme)}
+	}
+	edits := []lspTextEdit{{d.tokenRange(dcl.name), name}}
+	for _, t := range dcl.refs {
+		edits = append(edits, lspTextEdit{d.tokenRange(t), name})
+	}
+	return map[string]interface{}{
+		"changes": map[string][]lspTextEdit{d.uri: edits},
+	}, nil
+}
+
+// conflicts reports whether renaming the local to the name could change the
+// program: a local of that name is in scope at the declaration, or the name
+// is declared or used where the local is visible. The scope of a parameter
+// is the body of its function, other locals are taken as visible up to the
+// end of their block.
+func (d *document) conflicts(dcl *decl, name string) bool {
+	for _, v := range d.visible(dcl.name) {
+		if !v.global && v != dcl && v.name.lexeme == name {
+			return true
+		}
+	}
+	i := 0
+	for d.tokens[i] != dcl.name {
+		i++
+	}
+	depth, body := 0, false
+	for ; i < len(d.tokens); i++ {
+		t := d.tokens[i]
+		switch t.tok {
+		case LeftBrace:
+			depth++
+			body = true
+		case RightBrace:
+			depth--
+		case Identifier:
+			if t.lexeme == name {
+				return true
+			}
+		}
+		if depth < 0 || dcl.kind == declParam && body && depth == 0 {
+			break
+		}
+	}
+	return false
+}
+
+func isIdentifier(s string) bool {
+	if s == "" || !isAlpha(s[0]) {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isAlphaNum(s[i]) {
+			return false
+		}
+	}
+	_, keyword := keywords[s]
+	return !keyword
+}
+
+// replayLSP runs the server on the messages of the script, one JSON
+// message per line, and prints every message of the server on its own
+// line. It is a client for scripted sessions.
+func replayLSP(script io.Reader, w io.Writer) int {
+	var in bytes.Buffer
+	sc := bufio.NewScanner(script)
+	sc.Buffer(nil, 1<<24)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(line), line)
+	}
+	if err := sc.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitNoInput
+	}
+	var out bytes.Buffer
+	code := serveLSP(&in, &out)
+	r := bufio.NewReader(&out)
+	for {
+		data, err := readMessage(r)
+		if err != nil {
+			break
+		}
+		fmt.Fprintf(w, "%s\n", data)
+	}
+	return code
+}
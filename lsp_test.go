@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+// pipeClient talks to a server of messages with headers, serveLSP or
+// serveDAP, running in the test through pipes.
+type pipeClient struct {
+	t    *testing.T
+	w    *io.PipeWriter
+	r    *bufio.Reader
+	code chan int // of the server when it returns
+}
+
+func newPipeClient(t *testing.T, serve func(in io.Reader, out io.Writer) int) *pipeClient {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	c := &pipeClient{t: t, w: inW, r: bufio.NewReader(outR), code: make(chan int, 1)}
+	go func() {
+		c.code <- serve(inR, outW)
+		outW.Close()
+	}()
+	return c
+}
+
+// readJSON decodes the next message of the server into v.
+func (c *pipeClient) readJSON(v interface{}) {
+	c.t.Helper()
+	data, err := readMessage(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// lspClient talks to serveLSP.
+type lspClient struct {
+	*pipeClient
+	id int
+}
+
+func newLSPClient(t *testing.T) *lspClient {
+	return &lspClient{pipeClient: newPipeClient(t, serveLSP)}
+}
+
+type lspReply struct {
+	ID     *int            `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+}
+
+func (c *lspClient) read() lspReply {
+	c.t.Helper()
+	var m lspReply
+	c.readJSON(&m)
+	return m
+}
+
+func (c *lspClient) notify(method string, params interface{}) {
+	writeMessage(c.w, map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+// call sends the request and returns its reply, notifications sent before
+// it are dropped.
+func (c *lspClient) call(method string, params interface{}) lspReply {
+	c.t.Helper()
+	c.id++
+	writeMessage(c.w, map[string]interface{}{"jsonrpc": "2.0", "id": c.id, "method": method, "params": params})
+	for {
+		if m := c.read(); m.ID != nil && *m.ID == c.id {
+			return m
+		}
+	}
+}
+
+// diagnostics returns the diagnostics published next.
+func (c *lspClient) diagnostics() []lspDiagnostic {
+	c.t.Helper()
+	m := c.read()
+	if m.Method != "textDocument/publishDiagnostics" {
+		c.t.Fatalf("got %v, want diagnostics", m.Method)
+	}
+	var p struct {
+		Diagnostics []lspDiagnostic `json:"diagnostics"`
+	}
+	if err := json.Unmarshal(m.Params, &p); err != nil {
+		c.t.Fatal(err)
+	}
+	return p.Diagnostics
+}
+
+func (c *lspClient) at(method string, line, char int, extra map[string]interface{}) lspReply {
+	c.t.Helper()
+	p := map[string]interface{}{
+		"textDocument": map[string]string{"uri": "file:///t.glx"},
+		"position":     lspPosition{line, char},
+	}
+	for k, v := range extra {
+		p[k] = v
+	}
+	return c.call(method, p)
+}
+
+func decode(t *testing.T, m lspReply, v interface{}) {
+	t.Helper()
+	if m.Error != nil {
+		t.Fatalf("error %v", m.Error.Message)
+	}
+	if err := json.Unmarshal(m.Result, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const lspSource = `// Adds two numbers.
+fun add(a, b) {
+  var sum = a + b;
+  return sum;
+}
+print add(1, 2);
+print add(3, 4);
+`
+
+func TestLSP(t *testing.T) {
+	c := newLSPClient(t)
+	c.call("initialize", map[string]interface{}{})
+	c.notify("initialized", map[string]interface{}{})
+
+	c.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": "file:///t.glx", "version": 1, "text": "print 1 +;\nprint cont;\n"},
+	})
+	diags := c.diagnostics()
+	if len(diags) != 1 || diags[0].Code != "E0201" || diags[0].Range.Start != (lspPosition{0, 9}) {
+		t.Errorf("diagnostics of the syntax error: %+v", diags)
+	}
+	c.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": "file:///t.glx", "version": 2},
+		"contentChanges": []map[string]string{{"text": "var count = 1;\nprint cont;\n"}},
+	})
+	diags = c.diagnostics()
+	if len(diags) != 1 || diags[0].Code != "undeclared" || !strings.Contains(diags[0].Message, "did you mean 'count'?") {
+		t.Errorf("diagnostics of the lint warning: %+v", diags)
+	}
+	c.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": "file:///t.glx", "version": 3},
+		"contentChanges": []map[string]string{{"text": lspSource}},
+	})
+	if diags = c.diagnostics(); len(diags) != 0 {
+		t.Errorf("diagnostics of a correct script: %+v", diags)
+	}
+
+	var def lspLocation
+	decode(t, c.at("textDocument/definition", 5, 7, nil), &def)
+	if def.Range.Start != (lspPosition{1, 4}) {
+		t.Errorf("definition of add at %+v", def.Range.Start)
+	}
+
+	var refs []lspLocation
+	decode(t, c.at("textDocument/references", 2, 6, map[string]interface{}{
+		"context": map[string]bool{"includeDeclaration": true},
+	}), &refs)
+	if len(refs) != 2 || refs[0].Range.Start != (lspPosition{2, 6}) || refs[1].Range.Start != (lspPosition{3, 9}) {
+		t.Errorf("references of sum: %+v", refs)
+	}
+
+	var hover struct {
+		Contents struct {
+			Value string `json:"value"`
+		} `json:"contents"`
+	}
+	decode(t, c.at("textDocument/hover", 6, 6, nil), &hover)
+	if v := hover.Contents.Value; !strings.Contains(v, "fun add(a, b)") || !strings.Contains(v, "Adds two numbers.") {
+		t.Errorf("hover of add: %q", v)
+	}
+
+	var items []lspCompletion
+	decode(t, c.at("textDocument/completion", 3, 9, nil), &items)
+	labels := make(map[string]bool)
+	for _, i := range items {
+		labels[i.Label] = true
+	}
+	for _, want := range []string{"sum", "a", "b", "add", "print", "len"} {
+		if !labels[want] {
+			t.Errorf("completion lacks %v", want)
+		}
+	}
+
+	var rename struct {
+		Changes map[string][]lspTextEdit `json:"changes"`
+	}
+	decode(t, c.at("textDocument/rename", 3, 9, map[string]interface{}{"newName": "total"}), &rename)
+	edits := rename.Changes["file:///t.glx"]
+	if len(edits) != 2 || edits[0].NewText != "total" || edits[0].Range.Start != (lspPosition{2, 6}) {
+		t.Errorf("rename of sum: %+v", edits)
+	}
+	if m := c.at("textDocument/rename", 3, 9, map[string]interface{}{"newName": "b"}); m.Error == nil {
+		t.Errorf("rename of sum to the parameter b was accepted")
+	}
+	if m := c.at("textDocument/rename", 1, 4, map[string]interface{}{"newName": "plus"}); m.Error == nil {
+		t.Errorf("rename of the global add was accepted")
+	}
+
+	c.call("shutdown", nil)
+	c.notify("exit", nil)
+	if code := <-c.code; code != exitOK {
+		t.Errorf("exit code %v", code)
+	}
+}
+
+// TestLSPPositions sends positions out of the document, they are clamped.
+func TestLSPPositions(t *testing.T) {
+	c := newLSPClient(t)
+	c.call("initialize", map[string]interface{}{})
+	c.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": "file:///t.glx", "version": 1, "text": lspSource},
+	})
+	c.diagnostics()
+	for _, pos := range []lspPosition{{-1, 0}, {0, -5}, {-3, -3}, {100, 0}, {2, 1000}} {
+		for _, method := range []string{"textDocument/definition", "textDocument/hover", "textDocument/completion", "textDocument/references"} {
+			if m := c.at(method, pos.Line, pos.Character, nil); m.Error != nil {
+				t.Errorf("%v at %+v: %v", method, pos, m.Error.Message)
+			}
+		}
+	}
+	c.call("shutdown", nil)
+	c.notify("exit", nil)
+	<-c.code
+}
+
+// TestLSPSyntaxError asks about a document with syntax errors, the names
+// of the declarations around them are known.
+func TestLSPSyntaxError(t *testing.T) {
+	const source = `// Adds two numbers.
+fun add(a, b) {
+  var sum = a + b;
+  var = 1;
+  return sum;
+}
+print add(1, 2) +;
+print add(3, 4);
+`
+	c := newLSPClient(t)
+	c.call("initialize", map[string]interface{}{})
+	c.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": "file:///t.glx", "version": 1, "text": source},
+	})
+	if diags := c.diagnostics(); len(diags) != 2 {
+		t.Errorf("diagnostics: %+v", diags)
+	}
+
+	var def lspLocation
+	decode(t, c.at("textDocument/definition", 7, 7, nil), &def)
+	if def.Range.Start != (lspPosition{1, 4}) {
+		t.Errorf("definition of add at %+v", def.Range.Start)
+	}
+
+	var syms []lspSymbol
+	decode(t, c.call("textDocument/documentSymbol", map[string]interface{}{
+		"textDocument": map[string]string{"uri": "file:///t.glx"},
+	}), &syms)
+	if len(syms) != 1 || syms[0].Name != "add" || len(syms[0].Children) != 1 || syms[0].Children[0].Name != "sum" {
+		t.Errorf("symbols: %+v", syms)
+	}
+
+	var refs []lspLocation
+	decode(t, c.at("textDocument/references", 2, 6, map[string]interface{}{
+		"context": map[string]bool{"includeDeclaration": true},
+	}), &refs)
+	if len(refs) != 2 || refs[1].Range.Start != (lspPosition{4, 9}) {
+		t.Errorf("references of sum: %+v", refs)
+	}
+
+	var hover struct {
+		Contents struct {
+			Value string `json:"value"`
+		} `json:"contents"`
+	}
+	decode(t, c.at("textDocument/hover", 7, 6, nil), &hover)
+	if v := hover.Contents.Value; !strings.Contains(v, "fun add(a, b)") || !strings.Contains(v, "Adds two numbers.") {
+		t.Errorf("hover of add: %q", v)
+	}
+
+	var rename struct {
+		Changes map[string][]lspTextEdit `json:"changes"`
+	}
+	decode(t, c.at("textDocument/rename", 4, 9, map[string]interface{}{"newName": "total"}), &rename)
+	if edits := rename.Changes["file:///t.glx"]; len(edits) != 2 || edits[0].Range.Start != (lspPosition{2, 6}) {
+		t.Errorf("rename of sum: %+v", edits)
+	}
+
+	c.call("shutdown", nil)
+	c.notify("exit", nil)
+	<-c.code
+}
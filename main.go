@@ -3,33 +3,84 @@ package main
 import (
 	"bufio"
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"sort"
 )
 
-var hadError = false
+// Exit codes, as in sysexits.h
+const (
+	exitOK       = 0
+	exitFindings = 1  // lint found problems or tests failed
+	exitUsage    = 64 // wrong command line
+	exitData     = 65 // scan, parse or compile errors
+	exitNoInput  = 66 // script cannot be read
+	exitSoftware = 70 // runtime error
+)
+
+var (
+	hadError        = false
+	hadRuntimeError = false
+	exitStatus      = -1 // set by the exit native
+)
+
+// stdout receives everything the program prints.
+var stdout io.Writer = os.Stdout
+
+// options shared by the commands running programs
+var (
+	backend   = "tree"
+	vmTrace   = false
+	optAST    = false
+	traceExec = false
+	traceFunc = ""
+	traceOut  = ""
+)
 
 func main() {
-	args := os.Args
-	if len(args) > 2 {
-		fmt.Fprint(os.Stderr, "usage: glox [script]\n")
-		os.Exit(1)
-	} else if len(args) == 2 {
-		runFile(args[1])
+	code := runCommand(os.Args[1:])
+	if tracing != nil {
+		tracing.close()
+	}
+	os.Exit(code)
+}
+
+// exitCode returns the exit code for the errors reported so far.
+func exitCode() int {
+	switch {
+	case exitStatus >= 0:
+		return exitStatus
+	case hadError:
+		return exitData
+	case hadRuntimeError:
+		return exitSoftware
+	}
+	return exitOK
+}
+
+func runFile(file string) int {
+	data, ok := readSource(file)
+	if !ok {
+		return exitNoInput
+	}
+	if isCompiled(data) {
+		runCompiled(file, data)
 	} else {
-		runPrompt()
+		run(file, string(data))
 	}
+	return exitCode()
 }
 
-func runFile(file string) {
-	data, err := os.ReadFile(file)
+// runCompiled loads the program written by glox compile and runs it in
+// the vm.
+func runCompiled(file string, data []byte) {
+	fn, err := decodeProgram(data)
 	if err != nil {
-		log.Fatal(err)
-	}
-	run(string(data))
-	if hadError {
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "%v: %v\n", file, err)
+		hadError = true
+		return
 	}
+	reportRuntime(file, runVM(fn))
 }
 
 func runPrompt() {
@@ -40,50 +91,107 @@ func runPrompt() {
 			break
 		}
 		line := scanner.Text()
-		run(line)
+		run("", line)
 		hadError = false
+		hadRuntimeError = false
 	}
 }
 
-func run(source string) {
-	scanner := NewScanner(source)
-	tokens, err := scanner.scan()
-	if err != nil {
-		fmt.Println(err)
-		hadError = true
+// run runs the source of the file, "" when it is not read from one.
+func run(file, source string) {
+	stmt := parseSource(file, source)
+	if stmt == nil {
 		return
 	}
-	// for _, t := range tokens {
-	// 	fmt.Println("token ", t)
-	// }
 
-	p := NewParser(tokens)
-	stmt, errs := p.parse()
-	if len(errs) > 0 {
-		for _, e := range errs {
-			fmt.Println(e)
+	var err error
+	if backend == "vm" {
+		err = interpretVM(stmt)
+	} else {
+		globals := NewEnv(nil) // root env has no enclosure
+		if tracing != nil {
+			tracing.start()
+			hook = tracing
+			defer func() {
+				hook = nil
+				tracing.flush()
+			}()
 		}
-		hadError = true
-		return
+		err = interpret(stmt, globals)
 	}
+	reportRuntime(file, err)
+}
 
-	globals := NewEnv(nil) // root env has no enclosure
-	if err := interpret(stmt, globals); err != nil {
-		fmt.Println(err)
-		hadError = true
+// reportRuntime records the result of running a program.
+func reportRuntime(file string, err error) {
+	if x, ok := err.(ExitError); ok {
+		exitStatus = int(x)
+	} else if err != nil {
+		reportError(file, err)
+		hadRuntimeError = true
 	}
 }
 
-func errorAtToken(t *tokenObj, msg string) string {
-	var e string
-	if t.tok == EOF {
-		e = errorAt(t.line, " at end", msg)
-	} else {
-		e = errorAt(t.line, " at '"+t.lexeme+"'", msg)
+// parseProgram scans, parses and resolves the source.
+func parseProgram(source string) ([]Stmt, []error) {
+	stmt, errs, _ := parseWarnings(source)
+	return stmt, errs
+}
+
+// parseWarnings is parseProgram returning the warnings of the parser too.
+func parseWarnings(source string) ([]Stmt, []error, []*Diagnostic) {
+	tokens, errs := NewScanner(source).scan()
+	p := NewParser(tokens)
+	stmt, perrs := p.parse()
+	if errs = syntaxErrors(errs, perrs); len(errs) == 0 {
+		_, errs = resolve(stmt)
+	}
+	return stmt, errs, p.warns
+}
+
+// maxErrors is the number of syntax errors reported, the others are likely
+// to follow from them.
+const maxErrors = 20
+
+// syntaxErrors returns the errors of the scanner and the parser in the
+// order of their lines, at most maxErrors of them.
+func syntaxErrors(scan, parse []error) []error {
+	// both come in the order of lines, the first ones of each are enough
+	// and sorting the thousands of errors of a binary file is wasted
+	if len(scan) > maxErrors+1 {
+		scan = scan[:maxErrors+1]
+	}
+	if len(parse) > maxErrors+1 {
+		parse = parse[:maxErrors+1]
+	}
+	errs := append(scan[:len(scan):len(scan)], parse...)
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errLine(errs[i]) < errLine(errs[j])
+	})
+	if len(errs) > maxErrors {
+		errs = append(errs[:maxErrors], ParsingError{newDiag(phaseParse, codeTooManyErrors, errLine(errs[maxErrors]), "too many errors")})
 	}
-	return e
+	return errs
 }
 
-func errorAt(line int, where, msg string) string {
-	return fmt.Sprintf("[line %v] error%v: %v", line, where, msg)
+// errLine returns the line of the error, 0 when unknown.
+func errLine(err error) int {
+	return diagnosticOf(err).Span.Line
+}
+
+// parseSource returns the program ready to be run. On errors it reports
+// them and returns nil.
+func parseSource(file, source string) []Stmt {
+	stmt, errs := parseProgram(source)
+	if len(errs) > 0 {
+		for _, e := range errs {
+			reportError(file, e)
+		}
+		hadError = true
+		return nil
+	}
+	if optAST {
+		stmt = optimize(stmt)
+	}
+	return stmt
 }
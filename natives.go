@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// nativeFn is a function implemented in Go. It reports errors by panicking
+// with nativeError.
+type nativeFn struct {
+	name  string
+	nargs int
+	fn    func(args []value) value
+}
+
+func (n *nativeFn) arity() int {
+	return n.nargs
+}
+
+func (n *nativeFn) call(_ *Env, args []value) value {
+	return n.fn(args)
+}
+
+func (n *nativeFn) String() string {
+	return fmt.Sprintf("<native fn %v>", n.name)
+}
+
+type nativeError struct {
+	code string
+	msg  string
+}
+
+// ExitError stops the program with the exit status.
+type ExitError int
+
+func (e ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+// callNative calls the native function, the errors it reports become
+// runtime errors at the token of the call.
+func callNative(t *tokenObj, fn Callable, args []value) value {
+	defer func() {
+		if e := recover(); e != nil {
+			if n, ok := e.(nativeError); ok {
+				runtimeErr(t, n.code, n.msg)
+			}
+			panic(e)
+		}
+	}()
+	return fn.call(nil, args)
+}
+
+// List is an immutable sequence of values.
+type List struct {
+	elems []value
+}
+
+func (l *List) String() string {
+	s := make([]string, 0, len(l.elems))
+	for _, v := range l.elems {
+		s = append(s, fmt.Sprintf("%v", v))
+	}
+	return "[" + strings.Join(s, ", ") + "]"
+}
+
+func stringList(ss []string) *List {
+	l := &List{elems: make([]value, 0, len(ss))}
+	for _, s := range ss {
+		l.elems = append(l.elems, s)
+	}
+	return l
+}
+
+// natives are defined in the global environment of every program.
+var natives = []*nativeFn{
+	{"clock", 0, func(args []value) value {
+		return float64(time.Now().UnixNano())
+	}},
+	{"len", 1, func(args []value) value {
+		switch v := args[0].(type) {
+		case string:
+			return float64(utf8.RuneCountInString(v))
+		case *List:
+			return float64(len(v.elems))
+		}
+		panic(nativeError{codeNativeArgs, "len expects a string or a list"})
+	}},
+	{"at", 2, func(args []value) value {
+		l, ok := args[0].(*List)
+		if !ok {
+			panic(nativeError{codeNativeArgs, "at expects a list"})
+		}
+		i := intArg(args[1], "index")
+		if i < 0 || i >= len(l.elems) {
+			panic(nativeError{codeNativeArgs, fmt.Sprintf("index %v out of range [0, %v)", i, len(l.elems))})
+		}
+		return l.elems[i]
+	}},
+	{"getenv", 1, func(args []value) value {
+		name, ok := args[0].(string)
+		if !ok {
+			panic(nativeError{codeNativeArgs, "getenv expects a string"})
+		}
+		if v, ok := os.LookupEnv(name); ok {
+			return v
+		}
+		return nil
+	}},
+	{"exit", 1, func(args []value) value {
+		code := intArg(args[0], "exit status")
+		if code < 0 || code > 255 {
+			panic(nativeError{codeNativeArgs, "exit status must be between 0 and 255"})
+		}
+		panic(ExitError(code))
+	}},
+	{"assert", 1, func(args []value) value {
+		if !isTruthy(args[0]) {
+			panic(nativeError{codeAssertion, "assertion failed"})
+		}
+		return nil
+	}},
+	{"assertEqual", 2, func(args []value) value {
+		if !valuesEqual(args[0], args[1]) {
+			panic(nativeError{codeAssertion, fmt.Sprintf("got %v, want %v", literalString(args[0]), literalString(args[1]))})
+		}
+		return nil
+	}},
+	{"assertThrows", 1, func(args []value) value {
+		msg := throws(args[0])
+		if msg == "" {
+			panic(nativeError{codeAssertion, "expected a runtime error"})
+		}
+		return msg
+	}},
+}
+
+// valuesEqual is the equality of ==, though lists are equal when their
+// elements are.
+func valuesEqual(x, y value) bool {
+	a, ok := x.(*List)
+	b, ok2 := y.(*List)
+	if !ok || !ok2 {
+		return x == y
+	}
+	if len(a.elems) != len(b.elems) {
+		return false
+	}
+	for i := range a.elems {
+		if !valuesEqual(a.elems[i], b.elems[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// throws calls the function without arguments and returns the message of
+// the runtime error it makes, or "" without errors.
+func throws(fn value) (msg string) {
+	defer func() {
+		if e := recover(); e != nil {
+			rerr, ok := e.(RuntimeError)
+			if !ok {
+				panic(e)
+			}
+			msg = rerr.text()
+		}
+	}()
+	callValue(fn, nil)
+	return ""
+}
+
+// callValue calls the function for a native, with either backend.
+func callValue(fn value, args []value) value {
+	switch f := fn.(type) {
+	case *closure:
+		return activeVM.callback(f, args)
+	case Callable:
+		if f.arity() != len(args) {
+			panic(nativeError{codeArity, fmt.Sprintf("expected %v arguments but got %v", f.arity(), len(args))})
+		}
+		if callDepth >= maxCallDepth {
+			panic(nativeError{codeStackOverflow, "stack overflow"})
+		}
+		return f.call(nil, args)
+	}
+	panic(nativeError{codeNotCallable, fmt.Sprintf("'%v' is not a function", literalString(fn))})
+}
+
+func intArg(v value, what string) int {
+	f, ok := v.(float64)
+	if !ok || f != math.Trunc(f) || math.Abs(f) > math.MaxInt32 {
+		panic(nativeError{codeNativeArgs, what + " must be an integer"})
+	}
+	return int(f)
+}
+
+// defineGlobals defines the natives and args, the list of arguments given
+// to the script.
+func defineGlobals(define func(name string, v value)) {
+	for _, fn := range natives {
+		define(fn.name, fn)
+	}
+	define("args", stringList(scriptArgs))
+}
@@ -0,0 +1,256 @@
+package main
+
+// Optimization pass over the AST.
+//
+// Constant subtrees of expressions are folded into literals unless their
+// evaluation would fail at runtime, so errors like division by zero are
+// still reported when the code runs. Branches of if and while statements
+// with constant conditions that can never run are removed.
+//
+// Local variables initialized with a literal are replaced by the literal
+// in the code following the declaration. Only names declared once in the
+// whole program and never assigned are propagated, this way neither
+// shadowing nor closures can observe a different value.
+
+type optimizer struct {
+	consts   map[string]value // literals of local variables in scope
+	declared map[string]int   // number of declarations of each name
+	assigned map[string]bool
+}
+
+// optimize returns the optimized program, the tree is modified in place.
+func optimize(stmts []Stmt) []Stmt {
+	o := &optimizer{
+		consts:   make(map[string]value),
+		declared: make(map[string]int),
+		assigned: make(map[string]bool),
+	}
+	declare := func(params []*tokenObj) {
+		for _, p := range params {
+			o.declared[p.lexeme]++
+		}
+	}
+	inspectList(stmts, func(n interface{}) bool {
+		switch n := n.(type) {
+		case *VarStmt:
+			o.declared[n.name.lexeme]++
+		case *FunStmt:
+			o.declared[n.name.lexeme]++
+			declare(n.params)
+		case *FunExpr:
+			declare(n.params)
+		case *AssignExpr:
+			o.assigned[n.name.lexeme] = true
+		}
+		return true
+	})
+	return o.stmts(stmts, false)
+}
+
+// scope runs f with a copy of the known constants, so that declarations
+// made by f are forgotten afterwards.
+func (o *optimizer) scope(f func()) {
+	saved := o.consts
+	o.consts = make(map[string]value, len(saved))
+	for k, v := range saved {
+		o.consts[k] = v
+	}
+	f()
+	o.consts = saved
+}
+
+func (o *optimizer) stmts(list []Stmt, local bool) []Stmt {
+	res := make([]Stmt, 0, len(list))
+	for _, s := range list {
+		if s = o.stmt(s, local); s != nil {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// stmt returns the optimized statement or nil when it can be dropped.
+func (o *optimizer) stmt(s Stmt, local bool) Stmt {
+	switch s := s.(type) {
+	case *BlockStmt:
+		o.scope(func() {
+			s.list = o.stmts(s.list, true)
+		})
+	case *ExprStmt:
+		s.expression = o.expr(s.expression)
+	case *ForStmt:
+		var res Stmt = s
+		o.scope(func() {
+			if s.init != nil {
+				s.init = o.stmt(s.init, true)
+			}
+			if s.condition != nil {
+				s.condition = o.expr(s.condition)
+				if lit, ok := s.condition.(*LiteralExpr); ok && !isTruthy(lit.value) {
+					res = nil
+					if s.init != nil {
+						res = &BlockStmt{list: []Stmt{s.init}}
+					}
+					return
+				}
+			}
+			if s.increment != nil {
+				s.increment = o.expr(s.increment)
+			}
+			s.body = o.body(s.body)
+		})
+		return res
+	case *FunStmt:
+		s.body = o.function(s.body)
+	case *IfStmt:
+		s.condition = o.expr(s.condition)
+		if lit, ok := s.condition.(*LiteralExpr); ok {
+			if isTruthy(lit.value) {
+				return o.stmt(s.block1, local)
+			}
+			if s.block2 == nil {
+				return nil
+			}
+			return o.stmt(s.block2, local)
+		}
+		s.block1 = o.body(s.block1)
+		if s.block2 != nil {
+			s.block2 = o.stmt(s.block2, local)
+		}
+	case *PrintStmt:
+		s.expression = o.expr(s.expression)
+	case *ReturnStmt:
+		if s.value != nil {
+			s.value = o.expr(s.value)
+		}
+	case *VarStmt:
+		if s.init != nil {
+			s.init = o.expr(s.init)
+		}
+		name := s.name.lexeme
+		lit, ok := s.init.(*LiteralExpr)
+		if ok && local && o.declared[name] == 1 && !o.assigned[name] {
+			o.consts[name] = lit.value
+		}
+	case *WhileStmt:
+		s.condition = o.expr(s.condition)
+		if lit, ok := s.condition.(*LiteralExpr); ok && !isTruthy(lit.value) {
+			return nil
+		}
+		s.body = o.body(s.body)
+	}
+	return s
+}
+
+// body optimizes the statement that cannot be dropped because it is
+// a part of another statement.
+func (o *optimizer) body(s Stmt) Stmt {
+	if s = o.stmt(s, true); s == nil {
+		return &BlockStmt{list: []Stmt{}}
+	}
+	return s
+}
+
+func (o *optimizer) function(body []Stmt) (res []Stmt) {
+	o.scope(func() {
+		res = o.stmts(body, true)
+	})
+	return res
+}
+
+func (o *optimizer) expr(e Expr) Expr {
+	switch e := e.(type) {
+	case *AssignExpr:
+		e.value = o.expr(e.value)
+	case *BinaryExpr:
+		e.left = o.expr(e.left)
+		e.right = o.expr(e.right)
+		x, xok := e.left.(*LiteralExpr)
+		y, yok := e.right.(*LiteralExpr)
+		if xok && yok {
+			if v, ok := foldBinary(e.operator.tok, x.value, y.value); ok {
+				return &LiteralExpr{token: startToken(e), value: v}
+			}
+		}
+	case *CallExpr:
+		e.callee = o.expr(e.callee)
+		for i, a := range e.args {
+			e.args[i] = o.expr(a)
+		}
+	case *FunExpr:
+		e.body = o.function(e.body)
+	case *GroupingExpr:
+		e.e = o.expr(e.e)
+		if lit, ok := e.e.(*LiteralExpr); ok {
+			return lit
+		}
+	case *LogicalExpr:
+		e.left = o.expr(e.left)
+		e.right = o.expr(e.right)
+		if lit, ok := e.left.(*LiteralExpr); ok {
+			if isTruthy(lit.value) == (e.operator.tok == Or) {
+				return lit
+			}
+			return e.right
+		}
+	case *UnaryExpr:
+		e.right = o.expr(e.right)
+		if lit, ok := e.right.(*LiteralExpr); ok {
+			if v, ok := lit.value.(float64); ok && e.operator.tok == Minus {
+				return &LiteralExpr{token: e.operator, value: -v}
+			}
+			if e.operator.tok == Bang {
+				return &LiteralExpr{token: e.operator, value: !isTruthy(lit.value)}
+			}
+		}
+	case *VarExpr:
+		if v, ok := o.consts[e.name.lexeme]; ok {
+			return &LiteralExpr{token: e.name, value: v}
+		}
+	}
+	return e
+}
+
+// foldBinary evaluates the operator on two constants the way BinaryExpr.eval
+// does. It reports false when the evaluation would fail.
+func foldBinary(op token, x, y value) (value, bool) {
+	switch op {
+	case EqualEqual:
+		return x == y, true
+	case BangEqual:
+		return x != y, true
+	}
+	if xs, ok := x.(string); ok && op == Plus {
+		if ys, ok := y.(string); ok {
+			return xs + ys, true
+		}
+		return nil, false
+	}
+	a, aok := x.(float64)
+	b, bok := y.(float64)
+	if !aok || !bok {
+		return nil, false
+	}
+	switch op {
+	case Plus:
+		return a + b, true
+	case Minus:
+		return a - b, true
+	case Star:
+		return a * b, true
+	case Slash:
+		if b == 0 {
+			return nil, false
+		}
+		return a / b, true
+	case Greater:
+		return a > b, true
+	case GreaterEqual:
+		return a >= b, true
+	case Less:
+		return a < b, true
+	case LessEqual:
+		return a <= b, true
+	}
+	return nil, false
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// TestOptimizeFolds optimizes small programs and compares the tree they
+// leave with the one expected.
+func TestOptimizeFolds(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"print 1 + 2 * 3;", "(print 7)\n"},
+		{`print "a" + "b";`, "(print \"ab\")\n"},
+		{"print -(2);", "(print -2)\n"},
+		{"print !nil;", "(print true)\n"},
+		{"{ var x = 2; print x * 3; }", "(block\n  (var x 2)\n  (print 6))\n"},
+		{"if (false) print 1; else print 2;", "(print 2)\n"},
+		{"while (false) print 1;", ""},
+
+		// Left for the runtime to report or to see the assignment.
+		{"print 1 / 0;", "(print (/ 1 0))\n"},
+		{`print "a" + 1;`, "(print (+ \"a\" 1))\n"},
+		{"var g = 1; print g + 1;", "(var g 1)\n(print (+ g 1))\n"},
+		{"{ var x = 1; x = 2; print x; }", "(block\n  (var x 1)\n  (expr (= x 2))\n  (print x))\n"},
+	}
+	for _, tt := range tests {
+		stmts, errs := parseProgram(tt.source)
+		if len(errs) > 0 {
+			t.Fatalf("%v: %v", tt.source, errs)
+		}
+		var got bytes.Buffer
+		dumpAST(&got, optimize(stmts), false)
+		if got.String() != tt.want {
+			t.Errorf("%v: optimized to\n%swant\n%s", tt.source, &got, tt.want)
+		}
+	}
+}
+
+// TestOptimizeOutput runs the examples and the conformance scripts with and
+// without -O on both backends, the output must not change.
+func TestOptimizeOutput(t *testing.T) {
+	saved := optAST
+	defer func() { optAST = saved }()
+	for _, file := range conformScripts(t) {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, with := range []string{"tree", "vm"} {
+			optAST = false
+			want := runCaptured(string(data), with)
+			optAST = true
+			got := runCaptured(string(data), with)
+			if got != want {
+				t.Errorf("%v on %v: -O printed\n%swant\n%s", file, with, got, want)
+			}
+		}
+	}
+}
@@ -1,7 +1,5 @@
 package main
 
-import "fmt"
-
 // Recursive-descent parser
 //
 // program        -> declaration* EOF ;
@@ -65,10 +63,16 @@ type parser struct {
 	current int
 	errs    []error
 	inLoop  int
+	inCond  int                 // parsing the condition of an if, while or for
+	condAt  int                 // index of the first token of the condition
+	depth   int                 // of the nested expressions and statements
+	errAt   *tokenObj           // of the last error
+	warns   []*Diagnostic       // reported by glox check
+	ends    map[interface{}]int // token after each node, kept for the CST
 }
 
 func NewParser(tokens []*tokenObj) *parser {
-	p := &parser{tokens, 0, make([]error, 0), 0}
+	p := &parser{tokens: tokens, errs: make([]error, 0)}
 	return p
 }
 
@@ -115,64 +119,127 @@ func (p *parser) consume(expected token, msg string) *tokenObj {
 	if p.check(expected) {
 		return p.advance()
 	}
-	p.perror(p.peek(), msg)
+	p.perror(p.peek(), codeMissingToken, msg)
 	return nil
 }
 
-type ParsingError string
+// perror reports the error and abandons the declaration being parsed.
+func (p *parser) perror(t *tokenObj, code, msg string) {
+	panic(p.yerror(t, code, msg))
+}
+
+// yerror reports the error, unless it follows from an earlier one: the
+// scanner reported the Illegal tokens and an error at the token of the
+// last one cascades from it.
+func (p *parser) yerror(t *tokenObj, code, msg string) ParsingError {
+	e := ParsingError{errorAtToken(phaseParse, code, t, msg)}
+	if t.tok != Illegal && t != p.errAt {
+		p.errs = append(p.errs, e)
+	}
+	p.errAt = t
+	return e
+}
 
-func (e ParsingError) Error() string {
-	return string(e)
+// closeParen consumes the ')' closing the header of a statement. A missing
+// one before a '{' is reported and taken as present, so the block is
+// parsed as the body.
+func (p *parser) closeParen(msg string) {
+	if p.check(LeftBrace) {
+		p.yerror(p.peek(), codeMissingToken, msg)
+		return
+	}
+	p.consume(RightParen, msg)
 }
 
-func (p *parser) perror(t *tokenObj, msg string) {
-	e := ParsingError(errorAtToken(t, msg))
-	p.errs = append(p.errs, e)
-	panic(e)
+// maxNesting limits the depth of expressions and statements, deeper trees
+// would overflow the stack of the passes walking them.
+const maxNesting = 256
+
+// nest enters a nested expression or statement, unnest leaves it.
+func (p *parser) nest() {
+	p.depth++
+	if p.depth > maxNesting {
+		p.perror(p.peek(), codeNesting, "too deeply nested")
+	}
 }
 
-func (p *parser) yerror(t *tokenObj, msg string) {
-	e := ParsingError(errorAtToken(t, msg))
-	p.errs = append(p.errs, e)
+func (p *parser) unnest() {
+	p.depth--
 }
 
-func (p *parser) sync() {
-	fmt.Println("sync")
-	p.advance()
+// sync skips the rest of the declaration in error, which started at the
+// token start: to the end of a statement, before a keyword starting one or
+// before the '}' closing the block around it. Blocks are skipped whole
+// with the ';' or else following them. At least a token is skipped.
+func (p *parser) sync(start int) {
+	depth := 0
 	for !p.atEnd() {
-		if p.prev().tok == Semicolon {
-			return
-		}
-		switch p.peek().tok {
-		case Class, Fun, Var, For, If, While, Print, Return:
-			return
+		t := p.peek()
+		if depth == 0 && p.current > start {
+			if p.prev().tok == Semicolon {
+				return
+			}
+			switch t.tok {
+			case RightBrace, Class, Fun, Var, For, If, While, Print, Return, Break, Continue:
+				return
+			}
 		}
 		p.advance()
+		switch t.tok {
+		case LeftBrace:
+			depth++
+		case RightBrace:
+			if depth > 0 {
+				if depth--; depth == 0 && !p.check(Semicolon) && !p.check(Else) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// endStmt records the end of the statement when the parser keeps tokens.
+func (p *parser) endStmt(s Stmt) Stmt {
+	if p.ends != nil {
+		p.ends[s] = p.current
+	}
+	return s
+}
+
+func (p *parser) endExpr(e Expr) Expr {
+	if p.ends != nil {
+		p.ends[e] = p.current
 	}
+	return e
 }
 
 // ---------------------------------------------------------
 //
 
 // parse returns an AST of parsed tokens, if it cannot parse then it returns
-// the error.
+// the error. The declarations in error are left out of the tree.
 func (p *parser) parse() (s []Stmt, errs []error) {
 	s = make([]Stmt, 0)
-	for !p.atEnd() {
-		s = append(s, p.declaration())
+	for !p.atEnd() && len(p.errs) <= maxErrors {
+		if d := p.declaration(); d != nil {
+			s = append(s, d)
+		}
 	}
 
 	return s, p.errs
 }
 
 func (p *parser) declaration() (s Stmt) {
-	defer func() {
+	defer func(start, nerrs int) {
 		if e := recover(); e != nil {
 			_ = e.(ParsingError) // Panic for other errors
-			p.sync()
+			if len(p.errs) > nerrs {
+				p.keywordHint(start)
+			}
+			p.sync(start)
 			s = nil
 		}
-	}()
+	}(p.current, len(p.errs))
 	if p.match(Fun) {
 		if p.check(LeftParen) {
 			return p.lambdaCall()
@@ -185,14 +252,34 @@ func (p *parser) declaration() (s Stmt) {
 	return p.statement()
 }
 
+// keywordHint adds a hint to the last error, of the declaration starting
+// at start, when its first token is an identifier likely meant to be a keyword:
+// a keyword of another language, or one close to a keyword followed by the
+// error or, like a condition, by a parenthesized expression and the error
+// at a '{'.
+func (p *parser) keywordHint(start int) {
+	t := p.tokens[start]
+	if t.tok != Identifier || !before(t, p.errAt) {
+		return
+	}
+	next := p.tokens[start+1]
+	_, foreign := foreignKeywords[t.lexeme]
+	header := next.tok == LeftParen && p.errAt.tok == LeftBrace
+	if !foreign && !header && p.errAt != next {
+		return
+	}
+	diagnosticOf(p.errs[len(p.errs)-1]).addHint(keywordHint(t.lexeme), t)
+}
+
 func (p *parser) funDecl(kind string) Stmt {
+	keyword := p.prev()
 	name := p.consume(Identifier, "expected "+kind+" name")
 	p.consume(LeftParen, "expected '(' after "+kind+" name")
 	params := make([]*tokenObj, 0)
 	if !p.check(RightParen) {
 		for {
-			if len(params) >= 255 {
-				p.yerror(p.peek(), "can't have more than 255 parameters")
+			if len(params) == 255 {
+				p.yerror(p.peek(), codeTooManyArgs, "can't have more than 255 parameters")
 			}
 			params = append(params, p.consume(Identifier, "expected parameter name"))
 			if !p.match(Comma) {
@@ -200,13 +287,14 @@ func (p *parser) funDecl(kind string) Stmt {
 			}
 		}
 	}
-	p.consume(RightParen, "expected ')' after parameters")
+	p.closeParen("expected ')' after parameters")
 	p.consume(LeftBrace, "expected '{' after "+kind+" signature")
-	body := p.block()
-	return &FunStmt{name: name, params: params, body: body}
+	body := p.funBody()
+	return p.endStmt(&FunStmt{keyword: keyword, name: name, params: params, body: body})
 }
 
 func (p *parser) varDecl() Stmt {
+	keyword := p.prev()
 	name := p.consume(Identifier, "expected variable name")
 	var init Expr
 
@@ -214,10 +302,12 @@ func (p *parser) varDecl() Stmt {
 		init = p.expression()
 	}
 	p.consume(Semicolon, "expected ';' after variable declaration")
-	return &VarStmt{name: name, init: init}
+	return p.endStmt(&VarStmt{keyword: keyword, name: name, init: init})
 }
 
 func (p *parser) statement() Stmt {
+	p.nest()
+	defer p.unnest()
 	if p.match(Break) {
 		return p.breakStatement()
 	}
@@ -240,7 +330,7 @@ func (p *parser) statement() Stmt {
 		return p.whileStatement()
 	}
 	if p.match(LeftBrace) {
-		return &BlockStmt{list: p.block()}
+		return p.endStmt(&BlockStmt{brace: p.prev(), list: p.block()})
 	}
 	return p.exprStatement()
 }
@@ -248,22 +338,23 @@ func (p *parser) statement() Stmt {
 func (p *parser) breakStatement() Stmt {
 	key := p.prev()
 	if p.inLoop < 1 {
-		p.perror(key, "expected inside the loop")
+		p.yerror(key, codeOutsideLoop, "expected inside the loop")
 	}
 	p.consume(Semicolon, "expected ';' after break")
-	return &BreakStmt{keyword: key}
+	return p.endStmt(&BreakStmt{keyword: key})
 }
 
 func (p *parser) continueStatement() Stmt {
 	key := p.prev()
 	if p.inLoop < 1 {
-		p.perror(key, "expected inside the loop")
+		p.yerror(key, codeOutsideLoop, "expected inside the loop")
 	}
 	p.consume(Semicolon, "expected ';' after continue")
-	return &ContinueStmt{keyword: key}
+	return p.endStmt(&ContinueStmt{keyword: key})
 }
 
 func (p *parser) forStatement() Stmt {
+	keyword := p.prev()
 	p.consume(LeftParen, "expected '(' after 'for'")
 
 	var initial Stmt
@@ -278,7 +369,7 @@ func (p *parser) forStatement() Stmt {
 
 	var cond Expr
 	if !p.check(Semicolon) {
-		cond = p.expression()
+		cond = p.condition()
 	}
 	p.consume(Semicolon, "expected ';' after for condition")
 
@@ -286,44 +377,49 @@ func (p *parser) forStatement() Stmt {
 	if !p.check(RightParen) {
 		incr = p.expression()
 	}
-	p.consume(RightParen, "expected ')' after for clauses")
+	p.closeParen("expected ')' after for clauses")
 
 	p.inLoop += 1
 	body := p.statement()
 	p.inLoop -= 1
 
-	if incr != nil {
-		body = &BlockStmt{list: []Stmt{
-			body,
-			&ExprStmt{expression: incr}}}
-	}
-	if cond != nil {
-		body = &WhileStmt{condition: cond, body: body}
-	}
-	if initial != nil {
-		body = &BlockStmt{list: []Stmt{
-			initial,
-			body}}
-	}
-	return body
+	return p.endStmt(&ForStmt{
+		keyword:   keyword,
+		init:      initial,
+		condition: cond,
+		increment: incr,
+		body:      body,
+	})
 }
 
 func (p *parser) ifStatement() Stmt {
+	keyword := p.prev()
 	p.consume(LeftParen, "expected '(' after 'if'")
-	e := p.expression()
-	p.consume(RightParen, "expected ')' after if condition")
+	e := p.condition()
+	p.closeParen("expected ')' after if condition")
 	a := p.statement()
 	var b Stmt = nil
 	if p.match(Else) {
 		b = p.statement()
 	}
-	return &IfStmt{condition: e, block1: a, block2: b}
+	return p.endStmt(&IfStmt{keyword: keyword, condition: e, block1: a, block2: b})
+}
+
+// condition parses the condition of a statement, where an invalid
+// assignment is likely a comparison.
+func (p *parser) condition() Expr {
+	p.inCond++
+	saved := p.condAt
+	p.condAt = p.current
+	defer func() { p.inCond, p.condAt = p.inCond-1, saved }()
+	return p.expression()
 }
 
 func (p *parser) printStatement() Stmt {
+	keyword := p.prev()
 	e := p.expression()
 	p.consume(Semicolon, "expected ';' after expression")
-	return &PrintStmt{expression: e}
+	return p.endStmt(&PrintStmt{keyword: keyword, expression: e})
 }
 
 func (p *parser) returnStatement() Stmt {
@@ -333,32 +429,43 @@ func (p *parser) returnStatement() Stmt {
 		val = p.expression()
 	}
 	p.consume(Semicolon, "expected ';' after return value")
-	return &ReturnStmt{keyword: k, value: val}
+	return p.endStmt(&ReturnStmt{keyword: k, value: val})
 }
 
 func (p *parser) whileStatement() Stmt {
+	keyword := p.prev()
 	p.consume(LeftParen, "expected '(' after while")
-	expr := p.expression()
-	p.consume(RightParen, "expected ')' after while condition")
+	expr := p.condition()
+	p.closeParen("expected ')' after while condition")
 	p.inLoop += 1
 	body := p.statement()
 	p.inLoop -= 1
-	return &WhileStmt{condition: expr, body: body}
+	return p.endStmt(&WhileStmt{keyword: keyword, condition: expr, body: body})
 }
 
 func (p *parser) block() []Stmt {
 	list := make([]Stmt, 0)
 	for !p.check(RightBrace) && !p.atEnd() {
-		list = append(list, p.declaration())
+		if d := p.declaration(); d != nil {
+			list = append(list, d)
+		}
 	}
 	p.consume(RightBrace, "expected '}' after block")
 	return list
 }
 
+// funBody parses the block of a function, break and continue cannot cross
+// its boundary.
+func (p *parser) funBody() []Stmt {
+	defer func(n int) { p.inLoop = n }(p.inLoop)
+	p.inLoop = 0
+	return p.block()
+}
+
 func (p *parser) exprStatement() Stmt {
 	e := p.expression()
 	p.consume(Semicolon, "expected ';' after expression")
-	return &ExprStmt{expression: e}
+	return p.endStmt(&ExprStmt{expression: e})
 }
 
 func (p *parser) expression() Expr {
@@ -369,12 +476,13 @@ func (p *parser) expression() Expr {
 }
 
 func (p *parser) funExpr() Expr {
+	keyword := p.prev()
 	p.consume(LeftParen, "expected '(' after 'fun'")
 	params := make([]*tokenObj, 0)
 	if !p.check(RightParen) {
 		for {
-			if len(params) >= 255 {
-				p.yerror(p.peek(), "can't have more than 255 parameters")
+			if len(params) == 255 {
+				p.yerror(p.peek(), codeTooManyArgs, "can't have more than 255 parameters")
 			}
 			params = append(params, p.consume(Identifier, "expected parameter name"))
 			if !p.match(Comma) {
@@ -382,10 +490,10 @@ func (p *parser) funExpr() Expr {
 			}
 		}
 	}
-	p.consume(RightParen, "expected ')' after parameters")
+	p.closeParen("expected ')' after parameters")
 	p.consume(LeftBrace, "expected '{' after anonymous function signature")
-	body := p.block()
-	return &FunExpr{params: params, body: body}
+	body := p.funBody()
+	return p.endExpr(&FunExpr{keyword: keyword, params: params, body: body})
 }
 
 func (p *parser) lambdaCall() Stmt {
@@ -398,19 +506,32 @@ func (p *parser) lambdaCall() Stmt {
 		}
 	}
 	p.consume(Semicolon, "expected ';' call to a function")
-	return &ExprStmt{expression: expr}
+	return p.endStmt(&ExprStmt{expression: expr})
 }
 
 func (p *parser) assignment() Expr {
+	p.nest()
+	defer p.unnest()
+	start := p.current
 	expr := p.or()
 	if p.match(Equal) {
 		equals := p.prev()
 		value := p.assignment()
 		if ev, ok := expr.(*VarExpr); ok {
 			name := ev.name
-			return &AssignExpr{name: name, value: value}
+			if p.inCond > 0 && start == p.condAt {
+				// parentheses around it mark it as intended
+				w := errorAtToken(phaseParse, codeAssignCond, name, "assignment to "+name.lexeme+" used as a condition")
+				w.Severity = severityWarning
+				w.addHint(&hint{"did you mean '=='?", "=="}, equals)
+				p.warns = append(p.warns, w)
+			}
+			return p.endExpr(&AssignExpr{name: name, value: value})
+		}
+		e := p.yerror(equals, codeAssignTarget, "invalid assignment target")
+		if p.inCond > 0 {
+			e.addHint(&hint{"did you mean '=='?", "=="}, equals)
 		}
-		p.yerror(equals, "invalid assignment target")
 	}
 	return expr
 }
@@ -420,7 +541,7 @@ func (p *parser) or() Expr {
 	for p.match(Or) {
 		op := p.prev()
 		right := p.and()
-		expr = &LogicalExpr{operator: op, left: expr, right: right}
+		expr = p.endExpr(&LogicalExpr{operator: op, left: expr, right: right})
 	}
 	return expr
 }
@@ -430,7 +551,7 @@ func (p *parser) and() Expr {
 	for p.match(And) {
 		op := p.prev()
 		right := p.equality()
-		expr = &LogicalExpr{operator: op, left: expr, right: right}
+		expr = p.endExpr(&LogicalExpr{operator: op, left: expr, right: right})
 	}
 	return expr
 }
@@ -441,7 +562,7 @@ func (p *parser) equality() Expr {
 	for p.match(BangEqual, EqualEqual) {
 		op := p.prev()
 		right := p.comparison()
-		expr = &BinaryExpr{operator: op, left: expr, right: right}
+		expr = p.endExpr(&BinaryExpr{operator: op, left: expr, right: right})
 	}
 	return expr
 }
@@ -452,7 +573,7 @@ func (p *parser) comparison() Expr {
 	for p.match(Greater, GreaterEqual, Less, LessEqual) {
 		op := p.prev()
 		right := p.term()
-		expr = &BinaryExpr{operator: op, left: expr, right: right}
+		expr = p.endExpr(&BinaryExpr{operator: op, left: expr, right: right})
 	}
 	return expr
 }
@@ -463,7 +584,7 @@ func (p *parser) term() Expr {
 	for p.match(Plus, Minus) {
 		op := p.prev()
 		right := p.factor()
-		expr = &BinaryExpr{operator: op, left: expr, right: right}
+		expr = p.endExpr(&BinaryExpr{operator: op, left: expr, right: right})
 	}
 	return expr
 }
@@ -474,7 +595,7 @@ func (p *parser) factor() Expr {
 	for p.match(Slash, Star) {
 		op := p.prev()
 		right := p.unary()
-		expr = &BinaryExpr{operator: op, left: expr, right: right}
+		expr = p.endExpr(&BinaryExpr{operator: op, left: expr, right: right})
 	}
 	return expr
 }
@@ -484,8 +605,10 @@ func (p *parser) factor() Expr {
 func (p *parser) unary() Expr {
 	if p.match(Bang, Minus) {
 		op := p.prev()
+		p.nest()
+		defer p.unnest()
 		right := p.unary()
-		return &UnaryExpr{operator: op, right: right}
+		return p.endExpr(&UnaryExpr{operator: op, right: right})
 	}
 	return p.call()
 }
@@ -506,8 +629,8 @@ func (p *parser) finishCall(expr Expr) Expr {
 	args := make([]Expr, 0)
 	if !p.check(RightParen) {
 		for {
-			if len(args) >= 255 {
-				p.yerror(p.peek(), "can't have more than 255 arguments")
+			if len(args) == 255 {
+				p.yerror(p.peek(), codeTooManyArgs, "can't have more than 255 arguments")
 			}
 			args = append(args, p.expression())
 			if !p.match(Comma) {
@@ -516,7 +639,7 @@ func (p *parser) finishCall(expr Expr) Expr {
 		}
 	}
 	paren := p.consume(RightParen, "expected ')' after arguments")
-	return &CallExpr{callee: expr, paren: paren, args: args}
+	return p.endExpr(&CallExpr{callee: expr, paren: paren, args: args})
 }
 
 // primary -> NUMBER | STRING | "true" | "false" | "nil"
@@ -524,20 +647,21 @@ func (p *parser) finishCall(expr Expr) Expr {
 func (p *parser) primary() Expr {
 	switch {
 	case p.match(False):
-		return &LiteralExpr{value: false}
+		return p.endExpr(&LiteralExpr{token: p.prev(), value: false})
 	case p.match(True):
-		return &LiteralExpr{value: true}
+		return p.endExpr(&LiteralExpr{token: p.prev(), value: true})
 	case p.match(Nil):
-		return &LiteralExpr{value: nil}
+		return p.endExpr(&LiteralExpr{token: p.prev(), value: nil})
 	case p.match(Number, String):
-		return &LiteralExpr{value: p.prev().literal}
+		return p.endExpr(&LiteralExpr{token: p.prev(), value: p.prev().literal})
 	case p.match(Identifier):
-		return &VarExpr{name: p.prev()}
+		return p.endExpr(&VarExpr{name: p.prev()})
 	case p.match(LeftParen):
+		paren := p.prev()
 		expr := p.expression()
 		p.consume(RightParen, "expected enclosing ')' after expression")
-		return &GroupingExpr{e: expr}
+		return p.endExpr(&GroupingExpr{paren: paren, e: expr})
 	}
-	p.perror(p.peek(), "expected expression")
+	p.perror(p.peek(), codeExpectedExpr, "expected expression")
 	return nil
 }
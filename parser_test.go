@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestParseErrors parses sources with several mistakes, every one must be
+// reported once, without the errors following from it, and the statements
+// after them must be parsed.
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		stmts  int
+		errs   []string
+	}{
+		{"var = 1;\nprint 2;\nvar y = ;\n", 1, []string{
+			"[line 1] error at '=': expected variable name",
+			"[line 3] error at ';': expected expression",
+		}},
+		{"print (1 + 2;\nprint 3;\n", 1, []string{
+			"[line 1] error at ';': expected enclosing ')' after expression",
+		}},
+		{"if (x print 1;\nwhile (true) { print 2 }\nprint 3;", 3, []string{
+			"[line 1] error at 'print': expected ')' after if condition",
+			"[line 2] error at '}': expected ';' after expression",
+		}},
+		{"fun f( { print 1; }\nprint 2;\n{ print 3\n}\nprint 4;", 3, []string{
+			"[line 1] error at '{': expected parameter name",
+			"[line 4] error at '}': expected ';' after expression",
+		}},
+		{"var a = 1 @ 2;\nprint #;\nvar = 3;", 0, []string{
+			"[line 1] error: unexpected character '@'",
+			"[line 2] error: unexpected character '#'",
+			"[line 3] error at '=': expected variable name",
+		}},
+		{"print \"abc;\n", 0, []string{
+			"[line 1] error: unterminated string",
+		}},
+	}
+	for _, tt := range tests {
+		stmts, errs := parseProgram(tt.source)
+		var got []string
+		for _, err := range errs {
+			got = append(got, err.Error())
+		}
+		if !reflect.DeepEqual(got, tt.errs) {
+			t.Errorf("%q: errors\n%v\nwant\n%v", tt.source, strings.Join(got, "\n"), strings.Join(tt.errs, "\n"))
+		}
+		if len(stmts) != tt.stmts {
+			t.Errorf("%q: %v statements, want %v", tt.source, len(stmts), tt.stmts)
+		}
+	}
+}
+
+// TestParseTooManyErrors parses a source with more errors than reported,
+// the last one reported says so.
+func TestParseTooManyErrors(t *testing.T) {
+	_, errs := parseProgram(strings.Repeat("var = 1;\n", 2*maxErrors))
+	if len(errs) != maxErrors+1 {
+		t.Fatalf("%v errors, want %v", len(errs), maxErrors+1)
+	}
+	for i, err := range errs[:maxErrors] {
+		if want := fmt.Sprintf("[line %v] error at '=': expected variable name", i+1); err.Error() != want {
+			t.Errorf("got %q, want %q", err, want)
+		}
+	}
+	if want := fmt.Sprintf("[line %v] error: too many errors", maxErrors+1); errs[maxErrors].Error() != want {
+		t.Errorf("got %q, want %q", errs[maxErrors], want)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Profiler of the tree interpreter. It counts the calls of every function
+// and the statements run on every line. Instrumenting, it times every call
+// for the total and self time of functions; sampling, it records the call
+// stack instead at the first statement run after every interval, once for
+// each interval passed.
+
+type profFunc struct {
+	id    int
+	name  string
+	line  int
+	calls int
+	total time.Duration // without nested calls of itself
+	self  time.Duration
+
+	samples, selfSamples int
+}
+
+type profFrame struct {
+	fn    *profFunc
+	start time.Duration
+	child time.Duration // of the calls made
+}
+
+type profStack struct {
+	fns   []*profFunc // the outermost first
+	value int64       // nanoseconds or samples
+}
+
+type profiler struct {
+	start    time.Time
+	funcs    map[interface{}]*profFunc // by declaration
+	order    []*profFunc
+	stack    []*profFrame
+	lines    map[int]int
+	stacks   map[string]*profStack
+	duration time.Duration
+
+	interval time.Duration // of samples, 0 when instrumenting
+	next     time.Duration // of the next sample
+}
+
+func newProfiler(interval time.Duration) *profiler {
+	p := &profiler{
+		start:    time.Now(),
+		funcs:    make(map[interface{}]*profFunc),
+		lines:    make(map[int]int),
+		stacks:   make(map[string]*profStack),
+		interval: interval,
+		next:     interval,
+	}
+	p.stack = []*profFrame{{fn: p.function(nil, "<script>", 0)}}
+	p.stack[0].fn.calls = 1
+	return p
+}
+
+func (p *profiler) function(decl interface{}, name string, line int) *profFunc {
+	if f := p.funcs[decl]; f != nil {
+		return f
+	}
+	f := &profFunc{id: len(p.order) + 1, name: name, line: line}
+	p.funcs[decl] = f
+	p.order = append(p.order, f)
+	return f
+}
+
+func (p *profiler) stmt(s Stmt, env *Env) {
+	if _, ok := s.(*BlockStmt); !ok {
+		if t := startToken(s); t != nil {
+			p.lines[t.line]++
+		}
+	}
+	if p.interval > 0 {
+		if now := time.Since(p.start); now >= p.next {
+			n := (now-p.next)/p.interval + 1
+			p.next += n * p.interval
+			p.sample(int(n))
+		}
+	}
+}
+
+func (p *profiler) enter(fn Callable, env *Env) {
+	var f *profFunc
+	switch fn := fn.(type) {
+	case *FunObj:
+		f = p.function(fn.decl, fn.decl.name.lexeme, fn.decl.name.line)
+	case *FunAnon:
+		f = p.function(fn.decl, "<lambda>", fn.decl.keyword.line)
+	default:
+		f = p.function(fn, funName(fn), 0)
+	}
+	f.calls++
+	p.stack = append(p.stack, &profFrame{fn: f, start: time.Since(p.start)})
+}
+
+func (p *profiler) leave(v value, returned bool) {
+	fr := p.stack[len(p.stack)-1]
+	p.stack = p.stack[:len(p.stack)-1]
+	if p.interval == 0 {
+		p.timeFrame(fr, time.Since(p.start)-fr.start)
+	}
+}
+
+func (p *profiler) assign(name *tokenObj, v value, env *Env) {}
+
+// timeFrame adds the time of the call of the frame just returned.
+func (p *profiler) timeFrame(fr *profFrame, d time.Duration) {
+	self := d - fr.child
+	fr.fn.self += self
+	recursive := false
+	for _, f := range p.stack {
+		recursive = recursive || f.fn == fr.fn
+	}
+	if !recursive {
+		fr.fn.total += d
+	}
+	if len(p.stack) > 0 {
+		p.stack[len(p.stack)-1].child += d
+	}
+	p.addStack(append(p.stack, fr), int64(self))
+}
+
+func (p *profiler) sample(n int) {
+	p.addStack(p.stack, int64(n))
+	seen := make(map[*profFunc]bool)
+	for _, fr := range p.stack {
+		if !seen[fr.fn] {
+			seen[fr.fn] = true
+			fr.fn.samples += n
+		}
+	}
+	p.stack[len(p.stack)-1].fn.selfSamples += n
+}
+
+func (p *profiler) addStack(frames []*profFrame, v int64) {
+	ids := make([]string, len(frames))
+	for i, fr := range frames {
+		ids[i] = fmt.Sprint(fr.fn.id)
+	}
+	key := strings.Join(ids, ",")
+	s := p.stacks[key]
+	if s == nil {
+		s = &profStack{}
+		for _, fr := range frames {
+			s.fns = append(s.fns, fr.fn)
+		}
+		p.stacks[key] = s
+	}
+	s.value += v
+}
+
+// stop ends the profile when the program ended.
+func (p *profiler) stop() {
+	p.duration = time.Since(p.start)
+	if p.interval > 0 {
+		return
+	}
+	root := p.stack[0]
+	p.stack = p.stack[:0]
+	p.timeFrame(root, p.duration-root.start)
+}
+
+func (f *profFunc) String() string {
+	if f.line == 0 {
+		return f.name
+	}
+	return fmt.Sprintf("%v:%v", f.name, f.line)
+}
+
+func (s *profStack) String() string {
+	names := make([]string, len(s.fns))
+	for i, f := range s.fns {
+		names[i] = f.String()
+	}
+	return strings.Join(names, ";")
+}
+
+func ms(d time.Duration) string {
+	return fmt.Sprintf("%.3fms", float64(d)/float64(time.Millisecond))
+}
+
+// writeReport writes the functions, those taking most time first, and the
+// lines run most often.
+func (p *profiler) writeReport(w io.Writer, source string, maxLines int) {
+	funcs := append([]*profFunc(nil), p.order...)
+	if p.interval > 0 {
+		total := 0
+		for _, s := range p.stacks {
+			total += int(s.value)
+		}
+		sort.SliceStable(funcs, func(i, j int) bool {
+			return funcs[i].selfSamples > funcs[j].selfSamples
+		})
+		fmt.Fprintf(w, "functions, %v samples every %v in %v\n", total, p.interval, ms(p.duration))
+		fmt.Fprintf(w, "%8v %8v %8v  %v\n", "calls", "total%", "self%", "function")
+		for _, f := range funcs {
+			fmt.Fprintf(w, "%8v %8v %8v  %v\n", f.calls, percent(f.samples, total), percent(f.selfSamples, total), f)
+		}
+	} else {
+		sort.SliceStable(funcs, func(i, j int) bool {
+			return funcs[i].self > funcs[j].self
+		})
+		fmt.Fprintf(w, "functions in %v\n", ms(p.duration))
+		fmt.Fprintf(w, "%8v %12v %12v %8v  %v\n", "calls", "total", "self", "self%", "function")
+		for _, f := range funcs {
+			fmt.Fprintf(w, "%8v %12v %12v %8v  %v\n", f.calls, ms(f.total), ms(f.self),
+				percent(int(f.self), int(p.duration)), f)
+		}
+	}
+
+	lines := make([]int, 0, len(p.lines))
+	for l := range p.lines {
+		lines = append(lines, l)
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		a, b := lines[i], lines[j]
+		return p.lines[a] > p.lines[b] || p.lines[a] == p.lines[b] && a < b
+	})
+	if len(lines) > maxLines {
+		lines = lines[:maxLines]
+	}
+	src := strings.Split(source, "\n")
+	fmt.Fprintf(w, "\nlines\n%8v %6v  %v\n", "hits", "line", "source")
+	for _, l := range lines {
+		text := ""
+		if l <= len(src) {
+			text = strings.TrimSpace(src[l-1])
+		}
+		fmt.Fprintf(w, "%8v %6v  %v\n", p.lines[l], l, text)
+	}
+}
+
+func (p *profiler) sortedStacks() []*profStack {
+	list := make([]*profStack, 0, len(p.stacks))
+	for _, s := range p.stacks {
+		if s.value > 0 {
+			list = append(list, s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].String() < list[j].String()
+	})
+	return list
+}
+
+// writeFolded writes a line per call stack, the functions separated by ;
+// followed by the self time in microseconds or the number of samples, the
+// input of flame graph tools.
+func (p *profiler) writeFolded(w io.Writer) {
+	for _, s := range p.sortedStacks() {
+		v := s.value
+		if p.interval == 0 {
+			v /= int64(time.Microsecond)
+			if v == 0 {
+				continue
+			}
+		}
+		fmt.Fprintf(w, "%v %v\n", s, v)
+	}
+}
+
+// writePprof writes the stacks in the gzipped protocol buffer format of
+// pprof, with a location per function.
+func (p *profiler) writePprof(w io.Writer, file string) error {
+	strs := map[string]int{"": 0}
+	table := []string{""}
+	str := func(s string) int {
+		if i, ok := strs[s]; ok {
+			return i
+		}
+		strs[s] = len(table)
+		table = append(table, s)
+		return len(table) - 1
+	}
+	var prof pbuf
+	valueType := func(typ, unit string) []byte {
+		var b pbuf
+		b.int(1, str(typ))
+		b.int(2, str(unit))
+		return b.Bytes()
+	}
+	if p.interval > 0 {
+		prof.bytes(1, valueType("samples", "count"))
+		prof.bytes(1, valueType("cpu", "nanoseconds"))
+	} else {
+		prof.bytes(1, valueType("time", "nanoseconds"))
+	}
+	for _, s := range p.sortedStacks() {
+		var sample, locs, vals pbuf
+		for i := len(s.fns) - 1; i >= 0; i-- {
+			locs.varint(uint64(s.fns[i].id))
+		}
+		sample.bytes(1, locs.Bytes())
+		if p.interval > 0 {
+			vals.varint(uint64(s.value))
+			vals.varint(uint64(s.value * int64(p.interval)))
+		} else {
+			vals.varint(uint64(s.value))
+		}
+		sample.bytes(2, vals.Bytes())
+		prof.bytes(2, sample.Bytes())
+	}
+	for _, f := range p.order {
+		var loc, line pbuf
+		loc.int(1, f.id)
+		line.int(1, f.id)
+		line.int(2, f.line)
+		loc.bytes(4, line.Bytes())
+		prof.bytes(4, loc.Bytes())
+	}
+	for _, f := range p.order {
+		var fn pbuf
+		fn.int(1, f.id)
+		// pprof drops names in angle brackets as template arguments
+		name := strings.Trim(f.name, "<>")
+		fn.int(2, str(name))
+		fn.int(3, str(name))
+		fn.int(4, str(file))
+		fn.int(5, f.line)
+		prof.bytes(5, fn.Bytes())
+	}
+	prof.int(9, int(p.start.UnixNano()))
+	prof.int(10, int(p.duration))
+	if p.interval > 0 {
+		prof.bytes(11, valueType("cpu", "nanoseconds"))
+		prof.int(12, int(p.interval))
+	}
+	// the table is complete once the other fields are written
+	for _, s := range table {
+		prof.bytes(6, []byte(s))
+	}
+
+	z := gzip.NewWriter(w)
+	if _, err := z.Write(prof.Bytes()); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+// pbuf encodes the fields of a protocol buffer message.
+type pbuf struct {
+	bytes.Buffer
+}
+
+func (b *pbuf) varint(x uint64) {
+	for x >= 0x80 {
+		b.WriteByte(byte(x) | 0x80)
+		x >>= 7
+	}
+	b.WriteByte(byte(x))
+}
+
+func (b *pbuf) int(field, x int) {
+	if x == 0 {
+		return
+	}
+	b.varint(uint64(field) << 3)
+	b.varint(uint64(x))
+}
+
+func (b *pbuf) bytes(field int, data []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(data)))
+	b.Write(data)
+}
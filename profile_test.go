@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+	"time"
+)
+
+const profileSource = `fun fib(n) {
+  if (n < 2) return n;
+  return fib(n - 1) + fib(n - 2);
+}
+var f = fun () {};
+f();
+f();
+print fib(10);
+`
+
+// TestProfileCalls profiles a program and checks the calls of every
+// function, the hits of the lines and that the self times add up to the
+// duration.
+func TestProfileCalls(t *testing.T) {
+	stmts, errs := parseProgram(profileSource)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	p := newProfiler(0)
+	saved := stdout
+	stdout, hook = &bytes.Buffer{}, p
+	err := interpret(stmts, NewEnv(nil))
+	stdout, hook = saved, nil
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.stop()
+
+	calls := map[string]int{"<script>": 1, "fib:1": 177, "<lambda>:5": 2}
+	var self time.Duration
+	for _, f := range p.order {
+		if f.calls != calls[f.String()] {
+			t.Errorf("%v: %v calls, want %v", f, f.calls, calls[f.String()])
+		}
+		delete(calls, f.String())
+		if f.self > f.total {
+			t.Errorf("%v: self time %v over the total %v", f, f.self, f.total)
+		}
+		self += f.self
+	}
+	for name := range calls {
+		t.Errorf("%v: not profiled", name)
+	}
+	if self != p.duration {
+		t.Errorf("self times add up to %v, want the duration %v", self, p.duration)
+	}
+	// line 2 has the if and the return of the 89 leaves of the calls
+	for line, hits := range map[int]int{2: 177 + 89, 3: 88, 6: 1, 8: 1} {
+		if p.lines[line] != hits {
+			t.Errorf("line %v: %v hits, want %v", line, p.lines[line], hits)
+		}
+	}
+}
+
+// timedProfile returns a profile of the script calling a, which calls b,
+// and calling b again, with the durations of the calls given.
+func timedProfile() *profiler {
+	p := newProfiler(0)
+	a := p.function("a", "a", 1)
+	b := p.function("b", "b", 5)
+	root := p.stack[0]
+	call := func(f *profFunc) { p.stack = append(p.stack, &profFrame{fn: f}) }
+	ret := func(d time.Duration) {
+		fr := p.stack[len(p.stack)-1]
+		p.stack = p.stack[:len(p.stack)-1]
+		p.timeFrame(fr, d)
+	}
+	call(a)
+	call(b)
+	ret(3 * time.Millisecond)
+	ret(5 * time.Millisecond)
+	call(b)
+	ret(time.Millisecond)
+	p.duration = 10 * time.Millisecond
+	p.stack = p.stack[:0]
+	p.timeFrame(root, p.duration)
+	return p
+}
+
+// TestProfileSelfTime checks that the time of nested calls is not counted
+// in the self time of the caller.
+func TestProfileSelfTime(t *testing.T) {
+	p := timedProfile()
+	want := map[string][2]time.Duration{
+		"<script>": {10 * time.Millisecond, 4 * time.Millisecond},
+		"a:1":      {5 * time.Millisecond, 2 * time.Millisecond},
+		"b:5":      {4 * time.Millisecond, 4 * time.Millisecond},
+	}
+	for _, f := range p.order {
+		if w := want[f.String()]; f.total != w[0] || f.self != w[1] {
+			t.Errorf("%v: total %v and self %v, want %v and %v", f, f.total, f.self, w[0], w[1])
+		}
+	}
+}
+
+// TestProfileFolded writes the stacks of the timed profile in microseconds.
+func TestProfileFolded(t *testing.T) {
+	var got bytes.Buffer
+	timedProfile().writeFolded(&got)
+	want := `<script> 4000
+<script>;a:1 2000
+<script>;a:1;b:5 3000
+<script>;b:5 1000
+`
+	if got.String() != want {
+		t.Errorf("folded stacks\n%swant\n%s", &got, want)
+	}
+}
+
+// TestProfilePprof decodes the fields of the profile written for pprof.
+func TestProfilePprof(t *testing.T) {
+	var buf bytes.Buffer
+	if err := timedProfile().writePprof(&buf, "prog.glx"); err != nil {
+		t.Fatal(err)
+	}
+	z, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := make(map[int]int)
+	strs := make(map[string]bool)
+	for len(data) > 0 {
+		key, n := pbVarint(data)
+		data = data[n:]
+		field := int(key >> 3)
+		fields[field]++
+		if key&7 == 0 {
+			_, n = pbVarint(data)
+			data = data[n:]
+			continue
+		}
+		size, n := pbVarint(data)
+		data = data[n:]
+		if field == 6 {
+			strs[string(data[:size])] = true
+		}
+		data = data[size:]
+	}
+	// sample types, samples, locations, functions
+	for field, count := range map[int]int{1: 1, 2: 4, 4: 3, 5: 3} {
+		if fields[field] != count {
+			t.Errorf("field %v: %v times, want %v", field, fields[field], count)
+		}
+	}
+	for _, s := range []string{"time", "nanoseconds", "script", "a", "b", "prog.glx"} {
+		if !strs[s] {
+			t.Errorf("string %q not in the table", s)
+		}
+	}
+}
+
+// pbVarint decodes the varint at the start of the data and returns it and
+// its size.
+func pbVarint(data []byte) (uint64, int) {
+	var x uint64
+	for i, b := range data {
+		x |= uint64(b&0x7f) << (7 * i)
+		if b < 0x80 {
+			return x, i + 1
+		}
+	}
+	return x, len(data)
+}
@@ -0,0 +1,237 @@
+package main
+
+// Resolver binds every use of a variable to its declaration.
+//
+// Like in the vm, names declared in blocks and functions are resolved
+// lexically while names of the top level are global and looked up by name,
+// so a function can use a global declared after it.
+
+type declKind int
+
+const (
+	declVar declKind = iota
+	declFun
+	declParam
+)
+
+// decl is a declaration of a variable, a function or a parameter.
+type decl struct {
+	name    *tokenObj
+	kind    declKind
+	global  bool
+	params  []*tokenObj // of a function
+	refs    []*tokenObj // uses of the name, including assignments
+	shadows *decl       // declaration visible before this one
+}
+
+type resolution struct {
+	decls   []*decl
+	refs    map[*tokenObj]*decl // use of a name to its declaration
+	globals map[string][]*decl  // all declarations of a global name
+
+	// uses of names never declared to the suggestion of a visible name,
+	// nil when none is close, filled by resolveHints only
+	hints map[*tokenObj]*hint
+}
+
+type resolver struct {
+	scopes     []map[string]*decl
+	inFunction int
+	hints      bool // suggest names for undeclared uses
+	errs       []error
+	res        *resolution
+}
+
+// resolve resolves names of the program, uses of globals which are never
+// declared stay unresolved.
+func resolve(stmts []Stmt) (*resolution, []error) {
+	return resolveHints(stmts, false)
+}
+
+// resolveHints resolves like resolve and, when hints is set, suggests a
+// visible name for each use of an undeclared one. Each suggestion is
+// compared with every visible name, so only lint asks for them.
+func resolveHints(stmts []Stmt, hints bool) (*resolution, []error) {
+	r := &resolver{
+		hints: hints,
+		errs:  make([]error, 0),
+		res: &resolution{
+			refs:    make(map[*tokenObj]*decl),
+			globals: make(map[string][]*decl),
+			hints:   make(map[*tokenObj]*hint),
+		},
+	}
+	// globals may be used before they are declared, collect them first
+	for _, s := range stmts {
+		switch s := s.(type) {
+		case *VarStmt:
+			r.declareGlobal(&decl{name: s.name, kind: declVar})
+		case *FunStmt:
+			r.declareGlobal(&decl{name: s.name, kind: declFun, params: s.params})
+		}
+	}
+	r.stmts(stmts)
+	return r.res, r.errs
+}
+
+func (r *resolver) error(t *tokenObj, code, msg string) {
+	r.errs = append(r.errs, ResolveError{errorAtToken(phaseResolve, code, t, msg)})
+}
+
+func (r *resolver) declareGlobal(d *decl) {
+	d.global = true
+	r.res.decls = append(r.res.decls, d)
+	r.res.globals[d.name.lexeme] = append(r.res.globals[d.name.lexeme], d)
+}
+
+func (r *resolver) declare(d *decl) {
+	d.shadows = r.lookup(d.name)
+	r.res.decls = append(r.res.decls, d)
+	r.scopes[len(r.scopes)-1][d.name.lexeme] = d
+}
+
+func (r *resolver) beginScope() {
+	r.scopes = append(r.scopes, make(map[string]*decl))
+}
+
+func (r *resolver) endScope() {
+	r.scopes = r.scopes[:len(r.scopes)-1]
+}
+
+// lookup returns the declaration visible for the name at this point.
+func (r *resolver) lookup(name *tokenObj) *decl {
+	for i := len(r.scopes) - 1; i >= 0; i-- {
+		if d, ok := r.scopes[i][name.lexeme]; ok {
+			return d
+		}
+	}
+	if ds := r.res.globals[name.lexeme]; len(ds) > 0 {
+		return ds[len(ds)-1]
+	}
+	return nil
+}
+
+func (r *resolver) use(name *tokenObj) {
+	if d := r.lookup(name); d != nil {
+		d.refs = append(d.refs, name)
+		r.res.refs[name] = d
+	} else if r.hints && !isPredeclared(name.lexeme) {
+		r.res.hints[name] = nameHint(name.lexeme, r.visible())
+	}
+}
+
+// visible returns the names declared at this point.
+func (r *resolver) visible() []string {
+	var names []string
+	for _, scope := range r.scopes {
+		for n := range scope {
+			names = append(names, n)
+		}
+	}
+	for n := range r.res.globals {
+		names = append(names, n)
+	}
+	defineGlobals(func(n string, _ value) {
+		names = append(names, n)
+	})
+	return names
+}
+
+func (r *resolver) stmts(list []Stmt) {
+	for _, s := range list {
+		r.stmt(s)
+	}
+}
+
+func (r *resolver) stmt(s Stmt) {
+	switch s := s.(type) {
+	case *BlockStmt:
+		r.beginScope()
+		r.stmts(s.list)
+		r.endScope()
+	case *ExprStmt:
+		r.expr(s.expression)
+	case *ForStmt:
+		r.beginScope()
+		if s.init != nil {
+			r.stmt(s.init)
+		}
+		if s.condition != nil {
+			r.expr(s.condition)
+		}
+		if s.increment != nil {
+			r.expr(s.increment)
+		}
+		r.stmt(s.body)
+		r.endScope()
+	case *FunStmt:
+		if len(r.scopes) > 0 {
+			r.declare(&decl{name: s.name, kind: declFun, params: s.params})
+		}
+		r.function(s.params, s.body)
+	case *IfStmt:
+		r.expr(s.condition)
+		r.stmt(s.block1)
+		if s.block2 != nil {
+			r.stmt(s.block2)
+		}
+	case *PrintStmt:
+		r.expr(s.expression)
+	case *ReturnStmt:
+		if r.inFunction == 0 {
+			r.error(s.keyword, codeTopReturn, "can't return from top-level code")
+		}
+		if s.value != nil {
+			r.expr(s.value)
+		}
+	case *VarStmt:
+		// the initializer sees the shadowed variable
+		if s.init != nil {
+			r.expr(s.init)
+		}
+		if len(r.scopes) > 0 {
+			r.declare(&decl{name: s.name, kind: declVar})
+		}
+	case *WhileStmt:
+		r.expr(s.condition)
+		r.stmt(s.body)
+	}
+}
+
+func (r *resolver) function(params []*tokenObj, body []Stmt) {
+	r.inFunction++
+	r.beginScope()
+	for _, p := range params {
+		r.declare(&decl{name: p, kind: declParam})
+	}
+	r.stmts(body)
+	r.endScope()
+	r.inFunction--
+}
+
+func (r *resolver) expr(e Expr) {
+	switch e := e.(type) {
+	case *AssignExpr:
+		r.expr(e.value)
+		r.use(e.name)
+	case *BinaryExpr:
+		r.expr(e.left)
+		r.expr(e.right)
+	case *CallExpr:
+		r.expr(e.callee)
+		for _, a := range e.args {
+			r.expr(a)
+		}
+	case *FunExpr:
+		r.function(e.params, e.body)
+	case *GroupingExpr:
+		r.expr(e.e)
+	case *LogicalExpr:
+		r.expr(e.left)
+		r.expr(e.right)
+	case *UnaryExpr:
+		r.expr(e.right)
+	case *VarExpr:
+		r.use(e.name)
+	}
+}
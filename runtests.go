@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Test runner. Tests are the top-level functions of *_test.glx files named
+// test... without parameters. Each test runs the whole file in fresh
+// globals, then its function is called; a runtime error fails it, which the
+// assert natives make.
+
+type testResult struct {
+	name   string
+	line   int
+	err    error // nil when the test passed
+	output string
+	time   time.Duration
+}
+
+type testFile struct {
+	path    string
+	errs    []error // of scanning and parsing
+	results []testResult
+	time    time.Duration
+}
+
+func (f *testFile) failed() int {
+	n := 0
+	for _, r := range f.results {
+		if r.err != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// findScripts returns the files of the paths, with the files ending in the
+// suffix from the directories walked.
+func findScripts(paths []string, suffix string) ([]string, error) {
+	var files []string
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		err = filepath.Walk(p, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() && strings.HasSuffix(path, suffix) {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// testFuncs returns the tests of the program whose names match.
+func testFuncs(stmts []Stmt, match *regexp.Regexp) []*FunStmt {
+	var list []*FunStmt
+	for _, s := range stmts {
+		fn, ok := s.(*FunStmt)
+		if ok && strings.HasPrefix(fn.name.lexeme, "test") && len(fn.params) == 0 &&
+			(match == nil || match.MatchString(fn.name.lexeme)) {
+			list = append(list, fn)
+		}
+	}
+	return list
+}
+
+// runTestFile runs the tests of the file, recording their coverage when
+// cov is not nil.
+func runTestFile(path string, match *regexp.Regexp, cov *coverage) *testFile {
+	f := &testFile{path: path}
+	start := time.Now()
+	defer func() {
+		f.time = time.Since(start)
+	}()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		f.errs = []error{err}
+		return f
+	}
+	stmts, errs := parseProgram(string(data))
+	if len(errs) > 0 {
+		f.errs = errs
+		return f
+	}
+	if optAST {
+		stmts = optimize(stmts)
+	}
+	if cov != nil {
+		cov.add(path, string(data), stmts)
+	}
+	for _, fn := range testFuncs(stmts, match) {
+		f.results = append(f.results, runTest(stmts, fn))
+	}
+	return f
+}
+
+// runTest runs the program followed by a call of the test.
+func runTest(stmts []Stmt, fn *FunStmt) testResult {
+	call := &ExprStmt{expression: &CallExpr{callee: &VarExpr{name: fn.name}, paren: fn.name}}
+	prog := append(stmts[:len(stmts):len(stmts)], call)
+
+	var buf bytes.Buffer
+	saved := stdout
+	stdout = &buf
+	defer func() {
+		stdout = saved
+	}()
+	start := time.Now()
+	var err error
+	if backend == "vm" {
+		err = interpretVM(prog)
+	} else {
+		err = interpret(prog, NewEnv(nil))
+	}
+	return testResult{fn.name.lexeme, fn.name.line, err, buf.String(), time.Since(start)}
+}
+
+// printTests prints failed tests with their output and a line per file,
+// verbose adds the tests passed.
+func printTests(w io.Writer, files []*testFile, verbose bool) {
+	for _, f := range files {
+		for _, e := range f.errs {
+			fmt.Fprintf(w, "%v: %v\n", f.path, e)
+		}
+		for _, r := range f.results {
+			if r.err == nil && !verbose {
+				continue
+			}
+			status := "PASS"
+			if r.err != nil {
+				status = "FAIL"
+			}
+			fmt.Fprintf(w, "--- %v: %v (%v:%v, %.3fs)\n", status, r.name, f.path, r.line, r.time.Seconds())
+			if r.err != nil {
+				fmt.Fprintf(w, "    %v\n", r.err)
+			}
+			if r.output != "" {
+				for _, l := range strings.Split(strings.TrimSuffix(r.output, "\n"), "\n") {
+					fmt.Fprintf(w, "    %v\n", l)
+				}
+			}
+		}
+		switch {
+		case len(f.errs) > 0 || f.failed() > 0:
+			fmt.Fprintf(w, "FAIL\t%v\t%.3fs\n", f.path, f.time.Seconds())
+		case len(f.results) == 0:
+			fmt.Fprintf(w, "ok  \t%v\t[no tests to run]\n", f.path)
+		default:
+			fmt.Fprintf(w, "ok  \t%v\t%.3fs\n", f.path, f.time.Seconds())
+		}
+	}
+}
+
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Errors   int         `xml:"errors,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	File      string        `xml:"file,attr"`
+	Line      int           `xml:"line,attr,omitempty"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit writes the results in the JUnit XML format, a suite per file.
+// Errors of parsing are the error of a case named after the file.
+func writeJUnit(w io.Writer, files []*testFile) error {
+	seconds := func(d time.Duration) string {
+		return fmt.Sprintf("%.3f", d.Seconds())
+	}
+	var doc junitSuites
+	for _, f := range files {
+		s := junitSuite{Name: f.path, Tests: len(f.results), Failures: f.failed(), Time: seconds(f.time)}
+		if len(f.errs) > 0 {
+			msg := make([]string, 0, len(f.errs))
+			for _, e := range f.errs {
+				msg = append(msg, e.Error())
+			}
+			s.Errors = 1
+			s.Tests = 1
+			s.Cases = append(s.Cases, junitCase{
+				Name:      filepath.Base(f.path),
+				Classname: f.path,
+				File:      f.path,
+				Time:      seconds(0),
+				Error:     &junitProblem{msg[0], strings.Join(msg, "\n")},
+			})
+		}
+		for _, r := range f.results {
+			c := junitCase{
+				Name:      r.name,
+				Classname: f.path,
+				File:      f.path,
+				Line:      r.line,
+				Time:      seconds(r.time),
+				SystemOut: r.output,
+			}
+			if r.err != nil {
+				c.Failure = &junitProblem{r.err.Error(), r.err.Error()}
+			}
+			s.Cases = append(s.Cases, c)
+		}
+		doc.Suites = append(doc.Suites, s)
+	}
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%v%s\n", xml.Header, data)
+	return err
+}
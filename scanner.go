@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
 var keywords = map[string]token{
@@ -26,19 +28,21 @@ var keywords = map[string]token{
 	"while":    While,
 }
 
-type ScanError string
-
-func (e ScanError) Error() string {
-	return string(e)
-}
-
 type Scanner struct {
-	source  string
-	tokens  []*tokenObj
-	start   int // start of the lexeme
-	current int // pointer of scanner
-	line    int
-	err     error
+	source    string
+	tokens    []*tokenObj
+	start     int // start of the lexeme
+	current   int // pointer of scanner
+	line      int
+	lineStart int // offset of the current line
+	startLine int // position of the lexeme
+	startCol  int
+	comments  []*tokenObj // of kind Comment, in the order of the source
+	errs      []error
+
+	keepTrivia bool
+	pending    []trivia  // leading trivia of the next token
+	last       *tokenObj // token taking trivia until the end of its line
 }
 
 func NewScanner(source string) *Scanner {
@@ -49,16 +53,30 @@ func NewScanner(source string) *Scanner {
 	}
 }
 
-func (s *Scanner) scan() ([]*tokenObj, error) {
-	for !s.atEnd() && s.err == nil {
+// scan returns the tokens of the source and the errors found. Scanning
+// goes on after errors, the text in error is an Illegal token.
+func (s *Scanner) scan() ([]*tokenObj, []error) {
+	if strings.HasPrefix(s.source, "#!") {
+		// skip the interpreter line of executable scripts
+		for s.peek() != '\n' && !s.atEnd() {
+			s.advance()
+		}
+		s.trivia(triviaComment)
+	}
+	for !s.atEnd() {
 		s.start = s.current
+		s.startLine = s.line
+		s.startCol = s.start - s.lineStart + 1
 		s.scanToken()
 	}
 
-	if s.err == nil {
-		s.tokens = append(s.tokens, &tokenObj{tok: EOF, line: s.line})
-	}
-	return s.tokens, s.err
+	s.tokens = append(s.tokens, &tokenObj{
+		tok:     EOF,
+		line:    s.line,
+		col:     s.current - s.lineStart + 1,
+		leading: s.pending,
+	})
+	return s.tokens, s.errs
 }
 
 func (s *Scanner) scanToken() {
@@ -117,15 +135,17 @@ func (s *Scanner) scanToken() {
 			for s.peek() != '\n' && !s.atEnd() {
 				s.advance()
 			}
+			s.comment()
 		} else if s.match('*') {
 			s.fullComment()
 		} else {
 			s.token(Slash)
 		}
 	case ' ', '\r', '\t':
-		break
+		s.trivia(triviaSpace)
 	case '\n':
-		s.line++
+		s.trivia(triviaNewline)
+		s.newline()
 	case '"':
 		s.stringLit()
 	default:
@@ -134,14 +154,66 @@ func (s *Scanner) scanToken() {
 		} else if isAlpha(ch) {
 			s.identifier()
 		} else {
-			s.report(fmt.Sprintf("unexpected character '%c'", ch))
-			return
+			s.unexpected()
 		}
 	}
 }
 
-func (s *Scanner) report(msg string) {
-	s.err = ScanError(errorAt(s.line, "", msg))
+// unexpected reports the run of characters starting no token as one
+// Illegal token, a binary file would make an error of each byte.
+func (s *Scanner) unexpected() {
+	for !s.atEnd() && !startsToken(s.peek()) {
+		s.advance()
+	}
+	text := s.source[s.start:s.current]
+	if utf8.RuneCountInString(text) == 1 {
+		s.report(codeUnexpectedChar, fmt.Sprintf("unexpected character '%v'", text))
+	} else {
+		s.report(codeUnexpectedChar, fmt.Sprintf("unexpected characters '%v'", text))
+	}
+}
+
+func startsToken(b byte) bool {
+	return isAlphaNum(b) || strings.IndexByte("(){},:.-?+;*!=<>/\" \r\t\n", b) >= 0
+}
+
+// newline is called after the scanner advanced past a newline.
+func (s *Scanner) newline() {
+	s.line++
+	s.lineStart = s.current
+}
+
+// trivia records the text scanned in the trivia mode.
+func (s *Scanner) trivia(kind triviaKind) {
+	if !s.keepTrivia {
+		return
+	}
+	text := s.source[s.start:s.current]
+	list := &s.pending
+	if s.last != nil {
+		list = &s.last.trailing
+	}
+	if n := len(*list); kind == triviaSpace && n > 0 && (*list)[n-1].kind == triviaSpace {
+		(*list)[n-1].text += text
+	} else {
+		*list = append(*list, trivia{kind, text})
+	}
+	if kind == triviaNewline {
+		s.last = nil
+	}
+}
+
+// report records the error of the lexeme, which becomes an Illegal token
+// for the parser not to report errors following from it. Past maxErrors
+// only the token is kept, syntaxErrors would drop the error.
+func (s *Scanner) report(code, msg string) {
+	s.literal(Illegal, msg)
+	if len(s.errs) > maxErrors {
+		return
+	}
+	d := newDiag(phaseScan, code, s.startLine, msg)
+	d.Span = spanOf(s.tokens[len(s.tokens)-1])
+	s.errs = append(s.errs, ScanError{d})
 }
 
 func isDigit(b byte) bool {
@@ -200,19 +272,24 @@ func (s *Scanner) literal(t token, literal interface{}) {
 		tok:     t,
 		lexeme:  lex,
 		literal: literal,
-		line:    s.line,
+		line:    s.startLine,
+		col:     s.startCol,
+		leading: s.pending,
 	})
+	if s.keepTrivia {
+		s.pending = nil
+		s.last = s.tokens[len(s.tokens)-1]
+	}
 }
 
 func (s *Scanner) stringLit() {
 	for s.peek() != '"' && !s.atEnd() {
-		if s.peek() == '\n' {
-			s.line++
+		if s.advance() == '\n' {
+			s.newline()
 		}
-		s.advance()
 	}
 	if s.atEnd() {
-		s.report("unterminated string")
+		s.report(codeUnterminatedString, "unterminated string")
 		return
 	}
 	s.advance() // skip closing "
@@ -232,7 +309,7 @@ func (s *Scanner) number() {
 	}
 	val, err := strconv.ParseFloat(s.source[s.start:s.current], 64)
 	if err != nil {
-		s.report("cannot parse float number")
+		s.report(codeBadNumber, "cannot parse float number")
 		return
 	}
 	s.literal(Number, val)
@@ -254,15 +331,27 @@ func (s *Scanner) identifier() {
 
 func (s *Scanner) fullComment() {
 	for !(s.peek() == '*' && s.peekNext() == '/') && !s.atEnd() {
-		if s.peek() == '\n' {
-			s.line++
+		if s.advance() == '\n' {
+			s.newline()
 		}
-		s.advance()
 	}
 	if s.atEnd() {
-		s.report("unterminated /**/ comment")
+		s.report(codeUnterminatedComment, "unterminated /**/ comment")
 		return
 	}
 	s.advance() // skip *
 	s.advance() // skip /
+	s.comment()
+}
+
+// comment records the comment just scanned, it is not a token for the
+// parser.
+func (s *Scanner) comment() {
+	s.comments = append(s.comments, &tokenObj{
+		tok:    Comment,
+		lexeme: s.source[s.start:s.current],
+		line:   s.startLine,
+		col:    s.startCol,
+	})
+	s.trivia(triviaComment)
 }
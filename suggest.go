@@ -0,0 +1,115 @@
+package main
+
+import "sort"
+
+// Suggestions for misspelled names: the candidate at the smallest edit
+// distance, when it is small for the length of the name.
+
+// editDistance returns the number of insertions, deletions, substitutions
+// and transpositions of adjacent bytes turning a into b.
+func editDistance(a, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = d[i-1][j-1] + cost
+			if n := d[i-1][j] + 1; n < d[i][j] {
+				d[i][j] = n
+			}
+			if n := d[i][j-1] + 1; n < d[i][j] {
+				d[i][j] = n
+			}
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				if n := d[i-2][j-2] + 1; n < d[i][j] {
+					d[i][j] = n
+				}
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+// suggest returns the candidate closest to the name, the first in order
+// of ties, or "" when none is close enough. Replacing every letter of a
+// name is never close, so one-letter names get no suggestion.
+func suggest(name string, candidates []string) string {
+	sorted := append([]string(nil), candidates...)
+	sort.Strings(sorted)
+	best, bestDist := "", (len(name)+2)/3+1
+	for _, c := range sorted {
+		if c == name {
+			continue
+		}
+		if d := editDistance(name, c); d < bestDist && d < len(name) {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+// hint suggests the text replacing a name, explained by the note.
+type hint struct {
+	note string
+	text string
+}
+
+// didYouMean returns the hint for the closest candidate to the name, nil
+// when none is close.
+func didYouMean(name string, candidates []string) *hint {
+	if s := suggest(name, candidates); s != "" {
+		return &hint{"did you mean '" + s + "'?", s}
+	}
+	return nil
+}
+
+// keywordNames returns the keywords of the language.
+func keywordNames() []string {
+	list := make([]string, 0, len(keywords))
+	for k := range keywords {
+		list = append(list, k)
+	}
+	return list
+}
+
+// foreignKeywords are words of other languages used for glox keywords.
+var foreignKeywords = map[string]string{
+	"function": "fun",
+	"func":     "fun",
+	"def":      "fun",
+	"fn":       "fun",
+	"let":      "var",
+	"const":    "var",
+	"elif":     "else if",
+	"elsif":    "else if",
+	"null":     "nil",
+	"None":     "nil",
+	"True":     "true",
+	"False":    "false",
+	"echo":     "print",
+	"println":  "print",
+}
+
+// keywordHint returns the hint for an identifier which is likely meant to
+// be a keyword, nil otherwise.
+func keywordHint(name string) *hint {
+	return nameHint(name, keywordNames())
+}
+
+// nameHint returns the hint for an undefined name: the glox keyword for
+// one of another language, or the closest candidate.
+func nameHint(name string, candidates []string) *hint {
+	if k, ok := foreignKeywords[name]; ok {
+		return &hint{"use '" + k + "' instead of '" + name + "'", k}
+	}
+	return didYouMean(name, candidates)
+}
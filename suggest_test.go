@@ -0,0 +1,73 @@
+package main
+
+import "testing"
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "abc", 0},
+		{"a", "", 1},
+		{"", "abc", 3},
+		{"cont", "count", 1},
+		{"lenght", "length", 1},
+		{"ab", "ba", 1},
+		{"flaw", "lawn", 2},
+		{"kitten", "sitting", 3},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+		if got := editDistance(tt.b, tt.a); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %v, want %v", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+// TestSuggest checks that only candidates close for the length of the
+// name are suggested.
+func TestSuggest(t *testing.T) {
+	tests := []struct {
+		name       string
+		candidates []string
+		want       string
+	}{
+		{"cont", []string{"x", "count"}, "count"},
+		{"cont", []string{"count", "const"}, "const"}, // the first of ties
+		{"lenght", []string{"length", "len"}, "length"},
+		{"count", []string{"count", "counts"}, "counts"},
+		{"x", []string{"y"}, ""},
+		{"abcdef", []string{"uvwxyz"}, ""},
+		{"total", nil, ""},
+	}
+	for _, tt := range tests {
+		if got := suggest(tt.name, tt.candidates); got != tt.want {
+			t.Errorf("suggest(%q, %q) = %q, want %q", tt.name, tt.candidates, got, tt.want)
+		}
+	}
+}
+
+// TestNameHint checks the hints for keywords of other languages and
+// misspelled names.
+func TestNameHint(t *testing.T) {
+	tests := []struct {
+		name       string
+		candidates []string
+		want       *hint
+	}{
+		{"function", []string{"fun"}, &hint{"use 'fun' instead of 'function'", "fun"}},
+		{"elif", nil, &hint{"use 'else if' instead of 'elif'", "else if"}},
+		{"pritn", keywordNames(), &hint{"did you mean 'print'?", "print"}},
+		{"cont", []string{"count"}, &hint{"did you mean 'count'?", "count"}},
+		{"zzz", []string{"count"}, nil},
+	}
+	for _, tt := range tests {
+		got := nameHint(tt.name, tt.candidates)
+		if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+			t.Errorf("nameHint(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -50,12 +50,14 @@ func _() {
 	_ = x[True-40]
 	_ = x[Var-41]
 	_ = x[While-42]
-	_ = x[EOF-43]
+	_ = x[Comment-43]
+	_ = x[EOF-44]
+	_ = x[Illegal-45]
 }
 
-const _token_name = "(){},.-+;:?/*!!====>>=<<=identstringnumberandbreakclasscontinueelsefalsefunforifnilorprintreturnsuperthistruevarwhileeof"
+const _token_name = "(){},.-+;:?/*!!====>>=<<=identstringnumberandbreakclasscontinueelsefalsefunforifnilorprintreturnsuperthistruevarwhilecommenteofillegal"
 
-var _token_index = [...]uint8{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 16, 17, 19, 20, 22, 23, 25, 30, 36, 42, 45, 50, 55, 63, 67, 72, 75, 78, 80, 83, 85, 90, 96, 101, 105, 109, 112, 117, 120}
+var _token_index = [...]uint8{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 16, 17, 19, 20, 22, 23, 25, 30, 36, 42, 45, 50, 55, 63, 67, 72, 75, 78, 80, 83, 85, 90, 96, 101, 105, 109, 112, 117, 124, 127, 134}
 
 func (i token) String() string {
 	i -= 1
@@ -55,14 +55,35 @@ const (
 	Var      // var
 	While    // while
 
-	EOF // eof
+	Comment // comment
+	EOF     // eof
+	Illegal // illegal
 )
 
 type tokenObj struct {
 	tok     token
 	lexeme  string
 	line    int
+	col     int // in bytes, starting from 1
 	literal interface{}
+
+	// kept by the scanner in the trivia mode
+	leading, trailing []trivia
+}
+
+type triviaKind int
+
+const (
+	triviaSpace triviaKind = iota
+	triviaNewline
+	triviaComment // also the #! line
+)
+
+// trivia is a part of the source between tokens. A token has the trivia of
+// its line after it as trailing, the rest before it as leading.
+type trivia struct {
+	kind triviaKind
+	text string
 }
 
 func (t *tokenObj) String() string {
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Tracer of the tree interpreter, set by -trace. It writes the statements
+// executed with their line, the calls of functions with their arguments and
+// results and the assignments of variables, indented by the depth of calls.
+// With a pattern only what happens in the calls of functions whose names
+// match is written.
+
+type tracer struct {
+	w     io.Writer // buffered for files, so stderr keeps the order with stdout
+	file  *os.File
+	match *regexp.Regexp
+
+	calls []bool // whether the calls being run are traced
+	on    int    // number of calls of matching functions being run
+}
+
+// tracing is the tracer of programs run, nil without -trace.
+var tracing *tracer
+
+// newTracer returns a tracer writing to the file, stderr without a file,
+// of the functions matching the pattern, all without a pattern.
+func newTracer(pattern, file string) (*tracer, error) {
+	t := &tracer{}
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		t.match = re
+	}
+	t.w = os.Stderr
+	if file != "" {
+		f, err := os.Create(file)
+		if err != nil {
+			return nil, err
+		}
+		t.w, t.file = bufio.NewWriter(f), f
+	}
+	return t, nil
+}
+
+// start prepares the tracer for a run.
+func (t *tracer) start() {
+	t.calls, t.on = nil, 0
+}
+
+// flush writes what is buffered, it is called at the end of runs.
+func (t *tracer) flush() {
+	if b, ok := t.w.(*bufio.Writer); ok {
+		if err := b.Flush(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+// close flushes and closes the file, it is called when glox exits.
+func (t *tracer) close() {
+	t.flush()
+	if t.file != nil {
+		if err := t.file.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+func (t *tracer) traced() bool {
+	return t.match == nil || t.on > 0
+}
+
+func (t *tracer) printf(format string, args ...interface{}) {
+	fmt.Fprintf(t.w, "%v%v\n", strings.Repeat("  ", len(t.calls)), fmt.Sprintf(format, args...))
+}
+
+func (t *tracer) stmt(s Stmt, env *Env) {
+	if _, ok := s.(*BlockStmt); ok || !t.traced() {
+		return
+	}
+	if tok := startToken(s); tok != nil {
+		t.printf("[line %v] %v", tok.line, formatLine(s))
+	}
+}
+
+func (t *tracer) enter(fn Callable, env *Env) {
+	var params []*tokenObj
+	switch fn := fn.(type) {
+	case *FunObj:
+		params = fn.decl.params
+	case *FunAnon:
+		params = fn.decl.params
+	}
+	name := funName(fn)
+	matched := t.match != nil && t.match.MatchString(name)
+	if matched {
+		t.on++
+	}
+	if t.traced() {
+		args := make([]string, len(params))
+		for i, p := range params {
+			args[i] = p.lexeme + " = " + literalString(env.values[p.lexeme])
+		}
+		t.printf("call %v(%v)", name, strings.Join(args, ", "))
+	}
+	t.calls = append(t.calls, matched)
+}
+
+func (t *tracer) leave(v value, returned bool) {
+	matched := t.calls[len(t.calls)-1]
+	t.calls = t.calls[:len(t.calls)-1]
+	if t.traced() {
+		switch v := v.(type) {
+		case *tailCall:
+			t.printf("tail call %v", funName(v.fn))
+		default:
+			if returned {
+				t.printf("return %v", literalString(v))
+			} else {
+				t.printf("unwind")
+			}
+		}
+	}
+	if matched {
+		t.on--
+	}
+}
+
+func (t *tracer) assign(name *tokenObj, v value, env *Env) {
+	if t.traced() {
+		t.printf("%v = %v", name.lexeme, literalString(v))
+	}
+}
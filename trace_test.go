@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const traceSource = `fun inner(x) {
+  return x * 2;
+}
+fun outer(y) {
+  var z = inner(y);
+  z = z + 1;
+  return z;
+}
+print outer(3);
+`
+
+// The trace of the whole source, the lines of calls are indented by their
+// depth.
+const traceAll = `[line 1] fun inner(x) {...}
+[line 4] fun outer(y) {...}
+[line 9] print outer(3);
+call outer(y = 3)
+  [line 5] var z = inner(y);
+  call inner(x = 3)
+    [line 2] return x * 2;
+  return 6
+  [line 6] z = z + 1;
+  z = 7
+  [line 7] return z;
+return 7
+`
+
+// runTraced runs the source on the tree backend with the tracer and
+// returns what it printed.
+func runTraced(t *testing.T, tr *tracer, source string) string {
+	t.Helper()
+	tracing = tr
+	defer func() { tracing = nil }()
+	return runCaptured(source, "tree")
+}
+
+// TestTraceFunc traces the source with the patterns of -trace-func, only
+// the calls of the matching functions and the calls they make are written.
+func TestTraceFunc(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{"", traceAll},
+		{"out", traceAll[strings.Index(traceAll, "call outer"):]},
+		{"^inner$", `  call inner(x = 3)
+    [line 2] return x * 2;
+  return 6
+`},
+		{"missing", ""},
+	}
+	for _, tt := range tests {
+		tr, err := newTracer(tt.pattern, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got strings.Builder
+		tr.w = &got
+		if out := runTraced(t, tr, traceSource); out != "7\n" {
+			t.Errorf("%q: printed %q", tt.pattern, out)
+		}
+		if got.String() != tt.want {
+			t.Errorf("%q: traced\n%swant\n%s", tt.pattern, got.String(), tt.want)
+		}
+	}
+}
+
+// TestTraceOut writes the trace to the file of -trace-out.
+func TestTraceOut(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "trace.txt")
+	tr, err := newTracer("", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := runTraced(t, tr, traceSource)
+	tr.close()
+	if out != "7\n" {
+		t.Errorf("printed %q", out)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != traceAll {
+		t.Errorf("traced\n%swant\n%s", data, traceAll)
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Stack based virtual machine executing the bytecode of the compiler.
+// It shares the value representation and the natives with the interpreter,
+// so printed values and runtime errors look the same for both backends.
+
+// uninitialized is stored in variables declared without an initializer.
+type uninitialized struct {
+	name string
+}
+
+// undeclared is stored in the slot of a local which functions use before
+// it is declared. Until then they find the global of the name, like the
+// interpreter looking the name up in the environments.
+type undeclared struct {
+	name string
+}
+
+type closure struct {
+	fn       *function
+	upvalues []*upvalue
+}
+
+func (c *closure) String() string {
+	if c.fn.name == "" {
+		return fmt.Sprintf("<lambda (%v)>", strings.Join(c.fn.params, ","))
+	}
+	return c.fn.String()
+}
+
+// upvalue points into the stack while the variable is alive there and holds
+// the value itself once it has been closed over.
+type upvalue struct {
+	slot   int // -1 when closed
+	closed value
+	next   *upvalue
+}
+
+type callFrame struct {
+	cl   *closure
+	ip   int
+	base int // stack slot of the callee
+}
+
+type VM struct {
+	stack   []value
+	frames  []callFrame
+	globals map[string]value
+	open    *upvalue // open upvalues sorted by slot, the highest first
+	trace   io.Writer
+	bottom  int // loop returns when the frames above it return
+}
+
+// activeVM is the vm running a program, natives call back into it.
+var activeVM *VM
+
+func NewVM() *VM {
+	vm := &VM{
+		stack:   make([]value, 0, 256),
+		globals: make(map[string]value),
+	}
+	defineGlobals(func(name string, v value) {
+		vm.globals[name] = v
+	})
+	return vm
+}
+
+// interpretVM compiles and runs the program in a fresh vm.
+func interpretVM(stmts []Stmt) error {
+	fn, errs := compile(stmts)
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return runVM(fn)
+}
+
+// runVM runs the compiled script in a fresh vm.
+func runVM(fn *function) error {
+	vm := NewVM()
+	if vmTrace {
+		vm.trace = os.Stderr
+	}
+	return vm.run(fn)
+}
+
+func (vm *VM) run(fn *function) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			switch e := e.(type) {
+			case RuntimeError:
+				err = e
+			case ExitError:
+				err = e
+			default:
+				panic(e)
+			}
+			vm.reset()
+		}
+	}()
+	saved := activeVM
+	activeVM = vm
+	defer func() {
+		activeVM = saved
+	}()
+	cl := &closure{fn: fn}
+	vm.push(cl)
+	vm.frames = append(vm.frames, callFrame{cl: cl})
+	vm.loop()
+	vm.stack = vm.stack[:0]
+	return nil
+}
+
+// callback calls the closure for a native and returns its result. On
+// errors the frames of the call are dropped before the panic goes on.
+func (vm *VM) callback(cl *closure, args []value) value {
+	if len(args) != cl.fn.arity {
+		panic(nativeError{codeArity, fmt.Sprintf("expected %v arguments but got %v", cl.fn.arity, len(args))})
+	}
+	if len(vm.frames) > maxCallDepth {
+		panic(nativeError{codeStackOverflow, "stack overflow"})
+	}
+	frames, base, bottom := len(vm.frames), len(vm.stack), vm.bottom
+	defer func() {
+		vm.bottom = bottom
+		if e := recover(); e != nil {
+			vm.closeUpvalues(base)
+			vm.frames = vm.frames[:frames]
+			vm.stack = vm.stack[:base]
+			panic(e)
+		}
+	}()
+	vm.push(cl)
+	for _, a := range args {
+		vm.push(a)
+	}
+	vm.frames = append(vm.frames, callFrame{cl: cl, base: base})
+	vm.bottom = frames
+	vm.loop()
+	return vm.pop()
+}
+
+func (vm *VM) reset() {
+	vm.stack = vm.stack[:0]
+	vm.frames = vm.frames[:0]
+	vm.open = nil
+}
+
+func (vm *VM) push(v value) {
+	vm.stack = append(vm.stack, v)
+}
+
+func (vm *VM) pop() value {
+	v := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return v
+}
+
+func (vm *VM) peek(dist int) value {
+	return vm.stack[len(vm.stack)-1-dist]
+}
+
+// error aborts the execution with a runtime error at the line of the
+// instruction being executed.
+func (vm *VM) error(code, msg string) {
+	panic(RuntimeError{vm.diag(code, msg)})
+}
+
+// diag returns the runtime error of the current instruction, the vm knows
+// its line only.
+func (vm *VM) diag(code, msg string) *Diagnostic {
+	f := &vm.frames[len(vm.frames)-1]
+	return newDiag(phaseRuntime, code, f.cl.fn.chunk.lines[f.ip-1], msg)
+}
+
+// undefined raises the error for the global name accessed by the current
+// instruction, suggesting the locals visible there or a global.
+func (vm *VM) undefined(name string) {
+	f := &vm.frames[len(vm.frames)-1]
+	names := append([]string(nil), f.cl.fn.scopes[f.ip-3]...)
+	for n := range vm.globals {
+		names = append(names, n)
+	}
+	d := vm.diag(codeUndefined, "undefined variable '"+name+"'")
+	d.addHint(nameHint(name, names), nil)
+	panic(RuntimeError{d})
+}
+
+func (vm *VM) loop() {
+	f := &vm.frames[len(vm.frames)-1]
+	code := f.cl.fn.chunk.code
+	consts := f.cl.fn.chunk.constants
+
+	readByte := func() byte {
+		f.ip++
+		return code[f.ip-1]
+	}
+	readShort := func() int {
+		f.ip += 2
+		return int(code[f.ip-2])<<8 | int(code[f.ip-1])
+	}
+	readString := func() string {
+		return consts[readShort()].(string)
+	}
+
+	for {
+		if vm.trace != nil {
+			vm.traceInstr(f)
+		}
+		switch opcode(readByte()) {
+		case OpConstant:
+			vm.push(consts[readShort()])
+		case OpNil:
+			vm.push(nil)
+		case OpTrue:
+			vm.push(true)
+		case OpFalse:
+			vm.push(false)
+		case OpUninit:
+			vm.push(uninitialized{readString()})
+		case OpUndeclared:
+			vm.push(undeclared{readString()})
+		case OpPop:
+			vm.pop()
+		case OpGetLocal:
+			vm.push(vm.checkInit(vm.stack[f.base+int(readByte())]))
+		case OpSetLocal:
+			vm.stack[f.base+int(readByte())] = vm.peek(0)
+		case OpGetGlobal:
+			vm.push(vm.getGlobal(readString()))
+		case OpDefineGlobal:
+			vm.globals[readString()] = vm.pop()
+		case OpSetGlobal:
+			vm.setGlobal(readString(), vm.peek(0))
+		case OpGetUpvalue:
+			u := f.cl.upvalues[readByte()]
+			v := u.closed
+			if u.slot >= 0 {
+				v = vm.stack[u.slot]
+			}
+			if d, ok := v.(undeclared); ok {
+				v = vm.getGlobal(d.name)
+			}
+			vm.push(vm.checkInit(v))
+		case OpSetUpvalue:
+			u := f.cl.upvalues[readByte()]
+			v := u.closed
+			if u.slot >= 0 {
+				v = vm.stack[u.slot]
+			}
+			if d, ok := v.(undeclared); ok {
+				vm.setGlobal(d.name, vm.peek(0))
+			} else if u.slot >= 0 {
+				vm.stack[u.slot] = vm.peek(0)
+			} else {
+				u.closed = vm.peek(0)
+			}
+		case OpEqual:
+			y, x := vm.pop(), vm.pop()
+			vm.push(x == y)
+		case OpNotEqual:
+			y, x := vm.pop(), vm.pop()
+			vm.push(x != y)
+		case OpGreater:
+			x, y := vm.popFloats()
+			vm.push(x > y)
+		case OpGreaterEqual:
+			x, y := vm.popFloats()
+			vm.push(x >= y)
+		case OpLess:
+			x, y := vm.popFloats()
+			vm.push(x < y)
+		case OpLessEqual:
+			x, y := vm.popFloats()
+			vm.push(x <= y)
+		case OpAdd:
+			y, x := vm.pop(), vm.pop()
+			switch x := x.(type) {
+			case float64:
+				yval, ok := y.(float64)
+				if !ok {
+					vm.error(codeOperands, "expected number as right operand")
+				}
+				vm.push(x + yval)
+			case string:
+				yval, ok := y.(string)
+				if !ok {
+					vm.error(codeOperands, "expected string as right operand")
+				}
+				vm.push(x + yval)
+			default:
+				vm.error(codeOperands, "operands must be two numbers or two strings")
+			}
+		case OpSubtract:
+			x, y := vm.popFloats()
+			vm.push(x - y)
+		case OpMultiply:
+			x, y := vm.popFloats()
+			vm.push(x * y)
+		case OpDivide:
+			x, y := vm.popFloats()
+			if y == 0 {
+				vm.error(codeDivZero, "division by zero")
+			}
+			vm.push(x / y)
+		case OpNot:
+			vm.push(!isTruthy(vm.pop()))
+		case OpNegate:
+			x, ok := vm.pop().(float64)
+			if !ok {
+				vm.error(codeOperands, "operand must be a number")
+			}
+			vm.push(-x)
+		case OpPrint:
+			fmt.Fprintf(stdout, "%v\n", vm.pop())
+		case OpJump:
+			off := readShort()
+			f.ip += off
+		case OpJumpIfFalse:
+			off := readShort()
+			if !isTruthy(vm.peek(0)) {
+				f.ip += off
+			}
+		case OpLoop:
+			off := readShort()
+			f.ip -= off
+		case OpCall:
+			argc := int(readByte())
+			vm.call(vm.peek(argc), argc)
+			// a new frame or natives calling back may move the frames
+			f = &vm.frames[len(vm.frames)-1]
+			code = f.cl.fn.chunk.code
+			consts = f.cl.fn.chunk.constants
+		case OpTailCall:
+			argc := int(readByte())
+			callee := vm.peek(argc)
+			if cl, ok := callee.(*closure); ok {
+				// replace the frame of the caller by the callee, the
+				// following OpReturn is never reached
+				if argc != cl.fn.arity {
+					vm.error(codeArity, fmt.Sprintf("expected %v arguments but got %v", cl.fn.arity, argc))
+				}
+				vm.closeUpvalues(f.base)
+				n := copy(vm.stack[f.base:], vm.stack[len(vm.stack)-argc-1:])
+				vm.stack = vm.stack[:f.base+n]
+				f.cl, f.ip = cl, 0
+				code = f.cl.fn.chunk.code
+				consts = f.cl.fn.chunk.constants
+			} else {
+				vm.call(callee, argc)
+				f = &vm.frames[len(vm.frames)-1]
+			}
+		case OpClosure:
+			fn := consts[readShort()].(*function)
+			cl := &closure{fn: fn, upvalues: make([]*upvalue, fn.upvalueCount)}
+			for i := range cl.upvalues {
+				isLocal, index := readByte(), int(readByte())
+				if isLocal == 1 {
+					cl.upvalues[i] = vm.capture(f.base + index)
+				} else {
+					cl.upvalues[i] = f.cl.upvalues[index]
+				}
+			}
+			vm.push(cl)
+		case OpCloseUpvalue:
+			vm.closeUpvalues(len(vm.stack) - 1)
+			vm.pop()
+		case OpReturn:
+			result := vm.pop()
+			vm.closeUpvalues(f.base)
+			vm.frames = vm.frames[:len(vm.frames)-1]
+			vm.stack = vm.stack[:f.base]
+			vm.push(result)
+			if len(vm.frames) == vm.bottom {
+				return
+			}
+			f = &vm.frames[len(vm.frames)-1]
+			code = f.cl.fn.chunk.code
+			consts = f.cl.fn.chunk.constants
+		}
+	}
+}
+
+func (vm *VM) getGlobal(name string) value {
+	v, ok := vm.globals[name]
+	if !ok {
+		vm.undefined(name)
+	}
+	return vm.checkInit(v)
+}
+
+func (vm *VM) setGlobal(name string, v value) {
+	if _, ok := vm.globals[name]; !ok {
+		vm.undefined(name)
+	}
+	vm.globals[name] = v
+}
+
+func (vm *VM) checkInit(v value) value {
+	if u, ok := v.(uninitialized); ok {
+		vm.error(codeUninit, "variable '"+u.name+"' should be initialized first")
+	}
+	return v
+}
+
+func (vm *VM) popFloats() (float64, float64) {
+	y, x := vm.pop(), vm.pop()
+	xval, ok := x.(float64)
+	if !ok {
+		vm.error(codeOperands, "left operand must be a number")
+	}
+	yval, ok := y.(float64)
+	if !ok {
+		vm.error(codeOperands, "right operand must be a number")
+	}
+	return xval, yval
+}
+
+// call calls the callee with argc arguments on top of the stack, a closure
+// gets a new frame.
+func (vm *VM) call(callee value, argc int) {
+	switch fn := callee.(type) {
+	case *closure:
+		if argc != fn.fn.arity {
+			vm.error(codeArity, fmt.Sprintf("expected %v arguments but got %v", fn.fn.arity, argc))
+		}
+		// the frame of the script is not a call
+		if len(vm.frames) > maxCallDepth {
+			vm.error(codeStackOverflow, "stack overflow")
+		}
+		vm.frames = append(vm.frames, callFrame{cl: fn, base: len(vm.stack) - argc - 1})
+		return
+	case Callable:
+		if argc != fn.arity() {
+			vm.error(codeArity, fmt.Sprintf("expected %v arguments but got %v", fn.arity(), argc))
+		}
+		args := make([]value, argc)
+		copy(args, vm.stack[len(vm.stack)-argc:])
+		result := vm.callNative(fn, args)
+		vm.stack = vm.stack[:len(vm.stack)-argc-1]
+		vm.push(result)
+		return
+	}
+	vm.error(codeNotCallable, fmt.Sprintf("'%v' is not a function or class", callee))
+}
+
+func (vm *VM) capture(slot int) *upvalue {
+	var prev *upvalue
+	u := vm.open
+	for u != nil && u.slot > slot {
+		prev, u = u, u.next
+	}
+	if u != nil && u.slot == slot {
+		return u
+	}
+	created := &upvalue{slot: slot, next: u}
+	if prev == nil {
+		vm.open = created
+	} else {
+		prev.next = created
+	}
+	return created
+}
+
+// closeUpvalues moves values of all open upvalues at or above the slot
+// from the stack into the upvalues.
+func (vm *VM) closeUpvalues(slot int) {
+	for vm.open != nil && vm.open.slot >= slot {
+		u := vm.open
+		u.closed = vm.stack[u.slot]
+		u.slot = -1
+		vm.open = u.next
+	}
+}
+
+// callNative calls the native function, the errors it reports become runtime
+// errors of the call instruction.
+func (vm *VM) callNative(fn Callable, args []value) value {
+	defer func() {
+		if e := recover(); e != nil {
+			if n, ok := e.(nativeError); ok {
+				vm.error(n.code, n.msg)
+			}
+			panic(e)
+		}
+	}()
+	return fn.call(nil, args)
+}
@@ -0,0 +1,62 @@
+package main
+
+// inspect traverses the tree in depth-first order: it calls f(n) for the
+// node n, which is an Expr or a Stmt, and when f returns true it inspects
+// each of the children of n. Missing optional children are skipped.
+func inspect(n interface{}, f func(interface{}) bool) {
+	if n == nil || !f(n) {
+		return
+	}
+	switch n := n.(type) {
+	case *AssignExpr:
+		inspect(n.value, f)
+	case *BinaryExpr:
+		inspect(n.left, f)
+		inspect(n.right, f)
+	case *CallExpr:
+		inspect(n.callee, f)
+		for _, a := range n.args {
+			inspect(a, f)
+		}
+	case *FunExpr:
+		inspectList(n.body, f)
+	case *GroupingExpr:
+		inspect(n.e, f)
+	case *LogicalExpr:
+		inspect(n.left, f)
+		inspect(n.right, f)
+	case *UnaryExpr:
+		inspect(n.right, f)
+
+	case *BlockStmt:
+		inspectList(n.list, f)
+	case *ExprStmt:
+		inspect(n.expression, f)
+	case *ForStmt:
+		inspect(n.init, f)
+		inspect(n.condition, f)
+		inspect(n.increment, f)
+		inspect(n.body, f)
+	case *FunStmt:
+		inspectList(n.body, f)
+	case *IfStmt:
+		inspect(n.condition, f)
+		inspect(n.block1, f)
+		inspect(n.block2, f)
+	case *PrintStmt:
+		inspect(n.expression, f)
+	case *ReturnStmt:
+		inspect(n.value, f)
+	case *VarStmt:
+		inspect(n.init, f)
+	case *WhileStmt:
+		inspect(n.condition, f)
+		inspect(n.body, f)
+	}
+}
+
+func inspectList(list []Stmt, f func(interface{}) bool) {
+	for _, s := range list {
+		inspect(s, f)
+	}
+}